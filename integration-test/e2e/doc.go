@@ -0,0 +1,10 @@
+// Package e2e tests the extension handler binary end to end, without Docker
+// or a guest agent. The tests emulate the guest agent: they lay out an
+// extension directory with HandlerEnvironment.json, a certificate and
+// encrypted N.settings files in a temporary directory, run the handler for
+// its commands against stub agent scripts, and check the status files,
+// sequence number state and telemetry it leaves behind.
+//
+// Run them with go test; they need bash and skip on machines the agent does
+// not support.
+package e2e
@@ -0,0 +1,185 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// storageKey is a protected setting that must never leave the handler.
+const storageKey = "c2VjcmV0LXN0b3JhZ2Uta2V5LWZvci10aGUtZTJlLXRlc3Rz"
+
+var protectedSettings = map[string]interface{}{
+	"storageAccountName": "gce2e",
+	"storageAccountKey":  storageKey,
+}
+
+// requireSucceeded requires the status of seqNum to report the operation as
+// succeeded; a warning is fine, as the preflight checks warn on machines not
+// booted with systemd, like containers.
+func requireSucceeded(t *testing.T, a *guestAgent, seqNum int, operation string) statusReport {
+	s := a.readStatus(seqNum)
+	require.Equal(t, operation, s.Operation)
+	require.Contains(t, []string{"success", "warning"}, s.Status, s.Message)
+	return s
+}
+
+func TestLifecycle(t *testing.T) {
+	skipUnlessSupported(t)
+	a := newGuestAgent(t)
+	defer a.cleanup()
+
+	// the guest agent installs and enables the extension with the first settings
+	a.writeSettings(0, map[string]interface{}{}, protectedSettings)
+	a.mustRun("install")
+	a.mustRun("enable")
+	requireSucceeded(t, a, 0, "enable")
+	require.Equal(t, 0, a.seqNum())
+	require.Equal(t, []string{"install 0", "enable 0"}, a.scriptRuns())
+	require.True(t, a.exists("GCAgent/GC/enable.sh"), "the agent package is unzipped")
+
+	// the same settings again are processed again, only older ones are skipped
+	a.mustRun("enable")
+	require.Equal(t, []string{"install 0", "enable 0", "enable 0"}, a.scriptRuns())
+
+	// new settings check the health of the installed agent
+	a.writeSettings(1, map[string]interface{}{}, protectedSettings)
+	a.mustRun("enable")
+	requireSucceeded(t, a, 1, "enable")
+	require.Equal(t, 1, a.seqNum())
+	require.Equal(t, "enable 1", a.scriptRuns()[3])
+
+	a.mustRun("update")
+	a.mustRun("disable")
+	requireSucceeded(t, a, 1, "disable")
+	require.Equal(t, []string{"update 1", "disable 1"}, a.scriptRuns()[4:])
+
+	// metrics are written for every command
+	b, err := ioutil.ReadFile(filepath.Join(a.metrics, "guest_configuration_extension.prom"))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `gc_extension_operation_success{command="enable"} 1`)
+	require.Contains(t, string(b), `gc_extension_operation_success{command="disable"} 1`)
+	require.Contains(t, string(b), `gc_extension_agent_heartbeat{state="healthy"} 1`)
+
+	a.mustRun("uninstall")
+	require.Equal(t, "uninstall 1", a.scriptRuns()[6])
+	require.False(t, a.exists("GCAgent"), "the agent is removed")
+	require.Equal(t, -1, a.seqNum(), "the sequence number is reset")
+
+	msgs := strings.Join(a.telemetryMessages(), "\n")
+	for _, op := range []string{"install", "enable", "update", "disable", "uninstall"} {
+		require.Contains(t, msgs, "Operation '"+op+"' succeeded.")
+	}
+
+	// the protected settings are decrypted, but never logged or reported
+	for name, out := range map[string]string{
+		"log":       a.handlerLog(),
+		"status":    statusFiles(t, a),
+		"telemetry": readFile(t, a.telemetry),
+	} {
+		require.NotContains(t, out, storageKey, "secret in the %s", name)
+	}
+}
+
+func TestStaleSettingsAreSkipped(t *testing.T) {
+	skipUnlessSupported(t)
+	a := newGuestAgent(t)
+	defer a.cleanup()
+
+	a.writeSettings(3, map[string]interface{}{}, nil)
+	a.mustRun("install")
+	a.mustRun("enable")
+	require.Equal(t, 3, a.seqNum())
+	runs := len(a.scriptRuns())
+
+	// the guest agent went back to older settings
+	require.Nil(t, os.Remove(filepath.Join(a.config, "3.settings")))
+	a.writeSettings(2, map[string]interface{}{}, nil)
+	a.mustRun("enable")
+	require.Equal(t, 3, a.seqNum())
+	require.Len(t, a.scriptRuns(), runs, "no agent script ran")
+}
+
+func TestEnableFailure(t *testing.T) {
+	skipUnlessSupported(t)
+	a := newGuestAgent(t)
+	defer a.cleanup()
+
+	a.writeSettings(0, map[string]interface{}{}, nil)
+	a.mustRun("install")
+	a.failScript("enable", true)
+	code, out := a.run("enable")
+	require.NotEqual(t, 0, code, out)
+	s := a.readStatus(0)
+	require.Equal(t, "error", s.Status)
+	require.Equal(t, 0, a.seqNum())
+
+	// the guest agent retries the same settings
+	a.failScript("enable", false)
+	a.mustRun("enable")
+	requireSucceeded(t, a, 0, "enable")
+	require.Equal(t, 0, a.seqNum())
+
+	b, err := ioutil.ReadFile(filepath.Join(a.metrics, "guest_configuration_extension.prom"))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `gc_extension_operation_retries{command="enable"} 1`)
+}
+
+func TestUnhealthyAgentService(t *testing.T) {
+	skipUnlessSupported(t)
+	a := newGuestAgent(t)
+	defer a.cleanup()
+
+	a.writeSettings(0, map[string]interface{}{}, nil)
+	a.mustRun("install")
+	a.setAgentService("failed", "failed")
+	code, out := a.run("enable")
+	require.NotEqual(t, 0, code, out)
+	require.Equal(t, "error", a.readStatus(0).Status)
+	require.Contains(t, strings.Join(a.telemetryMessages(), "\n"), "Operation 'enable' failed.")
+}
+
+func TestUpdateFailureIsReportedOnEnable(t *testing.T) {
+	skipUnlessSupported(t)
+	a := newGuestAgent(t)
+	defer a.cleanup()
+
+	a.writeSettings(0, map[string]interface{}{}, nil)
+	a.mustRun("install")
+	a.mustRun("enable")
+
+	// a failed update succeeds, so that the guest agent does not retry it
+	// forever
+	a.failScript("update", true)
+	a.mustRun("update")
+
+	// the next enable uninstalls and reinstalls the agent and reports the
+	// failed update
+	a.writeSettings(1, map[string]interface{}{}, nil)
+	a.mustRun("enable")
+	s := a.readStatus(1)
+	require.Equal(t, "warning", s.Status, s.Message)
+	require.Equal(t, "warning", s.Substatus["UpdateFailure"].Status)
+	require.Contains(t, s.Substatus["UpdateFailure"].Message, "reinstalling the agent")
+	require.Equal(t, []string{"disable 1", "uninstall 1", "install 1", "enable 1"}, a.scriptRuns()[3:])
+}
+
+func statusFiles(t *testing.T, a *guestAgent) string {
+	files, err := filepath.Glob(filepath.Join(a.status, "*.status"))
+	require.Nil(t, err)
+	var b strings.Builder
+	for _, f := range files {
+		b.WriteString(readFile(t, f))
+	}
+	return b.String()
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	return string(b)
+}
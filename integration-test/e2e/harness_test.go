@@ -0,0 +1,391 @@
+package e2e
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/distro"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/pkcs7"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/preflight"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	extensionName = "Microsoft.GuestConfiguration.ConfigurationForLinux"
+	agentVersion  = "1.29.2"
+	binaryName    = "guest-configuration-extension"
+)
+
+// handlerBinary is the handler built by TestMain.
+var handlerBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "e2e-bin")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "e2e:", err)
+		os.Exit(1)
+	}
+	handlerBinary = filepath.Join(dir, binaryName)
+	build := exec.Command("go", "build", "-o", handlerBinary, "../../main")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "e2e: failed to build the handler:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// skipUnlessSupported skips the test on machines where the handler refuses
+// to install the agent or cannot run its scripts.
+func skipUnlessSupported(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("the agent scripts need bash")
+	}
+	info, err := distro.Detect("/")
+	if err != nil {
+		t.Skipf("unknown distribution: %v", err)
+	}
+	if v := distro.DefaultMatrix().Check(info, runtime.GOARCH); !v.Supported {
+		t.Skipf("the agent does not support this machine: %s", v.Reason)
+	}
+	if outcome, msg := preflight.InitSystem().Run(preflight.Root("/")); outcome == preflight.Fail {
+		t.Skipf("the preflight checks fail on this machine: %s", msg)
+	}
+}
+
+// guestAgent emulates the guest agent for a single extension in a temporary
+// directory laid out like /var/lib/waagent.
+type guestAgent struct {
+	t          *testing.T
+	root       string // like /var/lib/waagent, with the certificates
+	extDir     string // the extension directory, the working directory of the handler
+	config     string
+	status     string
+	logs       string
+	stubs      string // put in front of PATH, with a systemctl stand-in
+	telemetry  string // the JSON lines telemetry sink
+	metrics    string // the textfile collector directory
+	thumbprint string
+	cert       *x509.Certificate
+}
+
+// newGuestAgent lays out the extension directory with the handler binary,
+// HandlerEnvironment.json, a throwaway certificate, the agent package with
+// the stub scripts and a healthy agent service.
+func newGuestAgent(t *testing.T) *guestAgent {
+	root, err := ioutil.TempDir("", "e2e-waagent")
+	require.Nil(t, err)
+	a := &guestAgent{
+		t:         t,
+		root:      root,
+		extDir:    filepath.Join(root, extensionName+"-1.26.60"),
+		logs:      filepath.Join(root, "log"),
+		stubs:     filepath.Join(root, "stubs"),
+		telemetry: filepath.Join(root, "telemetry.jsonl"),
+		metrics:   filepath.Join(root, "textfile_collector"),
+	}
+	a.config = filepath.Join(a.extDir, "config")
+	a.status = filepath.Join(a.extDir, "status")
+	for _, d := range []string{a.config, a.status, a.logs, a.stubs, a.metrics,
+		filepath.Join(a.extDir, "bin"), filepath.Join(a.extDir, "agent")} {
+		require.Nil(t, os.MkdirAll(d, 0755))
+	}
+
+	b, err := ioutil.ReadFile(handlerBinary)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(a.extDir, "bin", binaryName), b, 0755))
+
+	he := []map[string]interface{}{{
+		"name":    extensionName,
+		"version": 1,
+		"handlerEnvironment": map[string]string{
+			"logFolder":     a.logs,
+			"configFolder":  a.config,
+			"statusFolder":  a.status,
+			"heartbeatFile": filepath.Join(a.extDir, "heartbeat.log"),
+		},
+	}}
+	a.writeJSON(filepath.Join(a.extDir, "HandlerEnvironment.json"), he)
+
+	a.thumbprint, a.cert = writeCertificate(t, root)
+	a.writeAgentPackage()
+	a.setAgentService("active", "running")
+	return a
+}
+
+// cleanup removes the directory of the guest agent.
+func (a *guestAgent) cleanup() { os.RemoveAll(a.root) }
+
+func (a *guestAgent) writeJSON(path string, v interface{}) {
+	b, err := json.Marshal(v)
+	require.Nil(a.t, err)
+	require.Nil(a.t, ioutil.WriteFile(path, b, 0644))
+}
+
+// writeCertificate generates a self-signed certificate and writes it with its
+// key as <thumbprint>.crt and <thumbprint>.prv into dir, as the guest agent
+// does.
+func writeCertificate(t *testing.T, dir string) (string, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "guest-configuration-e2e"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+
+	thumbprint := fmt.Sprintf("%X", sha1.Sum(der))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, thumbprint+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, thumbprint+".prv"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600))
+	return thumbprint, cert
+}
+
+// stubScript is every agent script. It records its run, fails if a
+// fail-<operation> file exists in the data directory, and reports a result
+// for enable.
+const stubScript = `#!/bin/bash
+echo "$GC_OPERATION $GC_SEQNUM" >> "$GC_DATA_DIR/script-runs.log"
+echo "stub $GC_OPERATION running"
+if [ -f "$GC_DATA_DIR/fail-$GC_OPERATION" ]; then
+	echo "stub $GC_OPERATION failed" >&2
+	exit 1
+fi
+if [ "$GC_OPERATION" = enable ]; then
+	echo '{"status": "success", "message": "stub agent enabled", "metrics": {"policies": 2}}' > "$GC_RESULT_FILE"
+fi
+`
+
+// writeAgentPackage writes the agent package agent/GC_<agentVersion>.zip with
+// the stub scripts.
+func (a *guestAgent) writeAgentPackage() {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, op := range []string{"install", "enable", "update", "disable", "uninstall"} {
+		h := &zip.FileHeader{Name: "GC/" + op + ".sh", Method: zip.Deflate}
+		h.SetMode(0755)
+		w, err := zw.CreateHeader(h)
+		require.Nil(a.t, err)
+		_, err = w.Write([]byte(stubScript))
+		require.Nil(a.t, err)
+	}
+	require.Nil(a.t, zw.Close())
+	require.Nil(a.t, ioutil.WriteFile(filepath.Join(a.extDir, "agent", "GC_"+agentVersion+".zip"), buf.Bytes(), 0644))
+}
+
+// setAgentService makes the systemctl stand-in report the agent service in
+// the given states.
+func (a *guestAgent) setAgentService(activeState, subState string) {
+	stub := fmt.Sprintf(`#!/bin/sh
+printf 'LoadState=loaded\nActiveState=%s\nSubState=%s\nNRestarts=0\nExecMainStatus=0\n'
+`, activeState, subState)
+	require.Nil(a.t, ioutil.WriteFile(filepath.Join(a.stubs, "systemctl"), []byte(stub), 0755))
+}
+
+// failScript makes the stub script of the operation fail, or succeed again.
+func (a *guestAgent) failScript(operation string, fail bool) {
+	marker := filepath.Join(a.extDir, "fail-"+operation)
+	if fail {
+		require.Nil(a.t, ioutil.WriteFile(marker, nil, 0644))
+	} else {
+		require.Nil(a.t, os.Remove(marker))
+	}
+}
+
+// writeSettings writes config/<seqNum>.settings with the public settings
+// and the protected settings encrypted for the certificate.
+func (a *guestAgent) writeSettings(seqNum int, public, protected map[string]interface{}) {
+	hs := map[string]interface{}{"publicSettings": public}
+	if protected != nil {
+		b, err := json.Marshal(protected)
+		require.Nil(a.t, err)
+		enc, err := pkcs7.Encrypt(b, a.cert, pkcs7.AES256CBC)
+		require.Nil(a.t, err)
+		hs["protectedSettings"] = base64.StdEncoding.EncodeToString(enc)
+		hs["protectedSettingsCertThumbprint"] = a.thumbprint
+	}
+	a.writeJSON(filepath.Join(a.config, fmt.Sprintf("%d.settings", seqNum)),
+		map[string]interface{}{"runtimeSettings": []interface{}{map[string]interface{}{"handlerSettings": hs}}})
+}
+
+// run runs the handler command in the extension directory, as the guest
+// agent does, and returns its exit code and output.
+func (a *guestAgent) run(command string) (int, string) {
+	cmd := exec.Command(filepath.Join(a.extDir, "bin", binaryName), command)
+	cmd.Dir = a.extDir
+	cmd.Env = []string{
+		"PATH=" + a.stubs + ":/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=" + a.root,
+		"GC_EXTENSION_TELEMETRY=file=" + a.telemetry,
+		"GC_EXTENSION_METRICS_DIR=" + a.metrics,
+		"GC_EXTENSION_HOOKS_DIR=" + filepath.Join(a.root, "hooks"),
+		"GC_EXTENSION_LEGACY_LOGS=0",
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), string(out)
+		}
+		require.Nil(a.t, err, "failed to run the handler")
+	}
+	return 0, string(out)
+}
+
+// mustRun runs the handler command and requires it to succeed.
+func (a *guestAgent) mustRun(command string) string {
+	code, out := a.run(command)
+	require.Equal(a.t, 0, code, "%s failed:\n%s\nlog:\n%s", command, out, a.handlerLog())
+	return out
+}
+
+// statusReport is the part of a status file the tests check.
+type statusReport struct {
+	Operation string `json:"operation"`
+	Status    string `json:"status"`
+	Code      int    `json:"code"`
+	Message   string
+	Substatus map[string]substatus
+}
+
+type substatus struct {
+	Status  string
+	Code    int
+	Message string
+}
+
+// readStatus returns the status reported for the sequence number.
+func (a *guestAgent) readStatus(seqNum int) statusReport {
+	b, err := ioutil.ReadFile(filepath.Join(a.status, fmt.Sprintf("%d.status", seqNum)))
+	require.Nil(a.t, err, "no status for seqNum %d", seqNum)
+	var f []struct {
+		Status struct {
+			statusReport
+			FormattedMessage struct {
+				Message string `json:"message"`
+			} `json:"formattedMessage"`
+			Substatus []struct {
+				Name             string `json:"name"`
+				Status           string `json:"status"`
+				Code             int    `json:"code"`
+				FormattedMessage struct {
+					Message string `json:"message"`
+				} `json:"formattedMessage"`
+			} `json:"substatus"`
+		} `json:"status"`
+	}
+	require.Nil(a.t, json.Unmarshal(b, &f))
+	require.Len(a.t, f, 1)
+	s := f[0].Status.statusReport
+	s.Message = f[0].Status.FormattedMessage.Message
+	s.Substatus = map[string]substatus{}
+	for _, sub := range f[0].Status.Substatus {
+		s.Substatus[sub.Name] = substatus{sub.Status, sub.Code, sub.FormattedMessage.Message}
+	}
+	return s
+}
+
+// seqNum returns the sequence number the handler recorded as processed, or
+// -1 if there is none.
+func (a *guestAgent) seqNum() int {
+	b, err := ioutil.ReadFile(filepath.Join(a.extDir, "mrseq"))
+	if os.IsNotExist(err) {
+		return -1
+	}
+	require.Nil(a.t, err)
+	var n int
+	_, err = fmt.Sscanf(string(b), "%d", &n)
+	require.Nil(a.t, err)
+	return n
+}
+
+// scriptRuns returns the "<operation> <seqNum>" lines of the stub scripts
+// run so far.
+func (a *guestAgent) scriptRuns() []string {
+	b, err := ioutil.ReadFile(filepath.Join(a.extDir, "script-runs.log"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.Nil(a.t, err)
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// telemetryEvent is a telemetry event with its parameters by name.
+type telemetryEvent map[string]interface{}
+
+// telemetryEvents returns the events sent so far.
+func (a *guestAgent) telemetryEvents() []telemetryEvent {
+	f, err := os.Open(a.telemetry)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.Nil(a.t, err)
+	defer f.Close()
+	var events []telemetryEvent
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		var e struct {
+			Parameters []struct {
+				Name  string      `json:"name"`
+				Value interface{} `json:"value"`
+			} `json:"parameters"`
+		}
+		require.Nil(a.t, json.Unmarshal(s.Bytes(), &e), s.Text())
+		event := telemetryEvent{}
+		for _, p := range e.Parameters {
+			event[p.Name] = p.Value
+		}
+		events = append(events, event)
+	}
+	require.Nil(a.t, s.Err())
+	return events
+}
+
+// telemetryMessages returns the Message parameters of the events sent so far.
+func (a *guestAgent) telemetryMessages() []string {
+	var msgs []string
+	for _, e := range a.telemetryEvents() {
+		msgs = append(msgs, fmt.Sprint(e["Message"]))
+	}
+	return msgs
+}
+
+// handlerLog returns the handler log.
+func (a *guestAgent) handlerLog() string {
+	b, _ := ioutil.ReadFile(filepath.Join(a.logs, "gcextn-handler.log"))
+	return string(b)
+}
+
+// exists returns whether the path relative to the extension directory exists.
+func (a *guestAgent) exists(path string) bool {
+	_, err := os.Stat(filepath.Join(a.extDir, path))
+	return err == nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mcuadros/go-version"
+	"github.com/pkg/errors"
+)
+
+// archAliases maps the architecture names used in agent package names to
+// GOARCH names.
+var archAliases = map[string]string{
+	"amd64":   "amd64",
+	"x86_64":  "amd64",
+	"x64":     "amd64",
+	"arm64":   "arm64",
+	"aarch64": "arm64",
+}
+
+// agentPackage is a candidate agent package, named
+// <prefix>_<version>[_<arch>].zip. Packages without an architecture are
+// amd64 packages, the only architecture built before arm64 support.
+type agentPackage struct {
+	name    string
+	version string
+	arch    string
+}
+
+// parseAgentPackage parses the name of a candidate agent package.
+func parseAgentPackage(name, prefix string) (agentPackage, error) {
+	rx := regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + `_([0-9]+(?:\.[0-9]+)*)(?:_([a-zA-Z0-9_]+))?\.zip$`)
+	m := rx.FindStringSubmatch(name)
+	if m == nil {
+		return agentPackage{}, errors.Errorf("%s is not named %s_<version>[_<arch>].zip", name, prefix)
+	}
+	p := agentPackage{name: name, version: m[1], arch: "amd64"}
+	if m[2] != "" {
+		arch, ok := archAliases[strings.ToLower(m[2])]
+		if !ok {
+			return agentPackage{}, errors.Errorf("%s has unknown architecture %s", name, m[2])
+		}
+		p.arch = arch
+	}
+	return p, nil
+}
+
+// selectAgentPackage returns the name of the agent package to install from the
+// file names: the highest version built for arch. A malformed name starting
+// with the prefix, or two packages with the same version for arch, are
+// rejected.
+func selectAgentPackage(names []string, prefix, arch string) (string, error) {
+	var candidates []agentPackage
+	for _, n := range names {
+		if !strings.HasPrefix(n, prefix) {
+			continue
+		}
+		p, err := parseAgentPackage(n, prefix)
+		if err != nil {
+			return "", errors.Wrap(err, "malformed agent package")
+		}
+		if p.arch == arch {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", errors.Errorf("failed to find zip file %s_<version>[_%s].zip among: %s", prefix, arch, strings.Join(names, ", "))
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return version.Compare(candidates[i].version, candidates[j].version, ">")
+	})
+	if len(candidates) > 1 && version.Compare(candidates[0].version, candidates[1].version, "==") {
+		return "", errors.Errorf("ambiguous agent packages for version %s on %s: %s and %s",
+			candidates[0].version, arch, candidates[0].name, candidates[1].name)
+	}
+	return candidates[0].name, nil
+}
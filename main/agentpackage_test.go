@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseAgentPackage(t *testing.T) {
+	p, err := parseAgentPackage("GC_1.9.0.zip", "GC")
+	require.Nil(t, err)
+	require.Equal(t, agentPackage{"GC_1.9.0.zip", "1.9.0", "amd64"}, p)
+
+	p, err = parseAgentPackage("GC_1.10.2_aarch64.zip", "GC")
+	require.Nil(t, err)
+	require.Equal(t, agentPackage{"GC_1.10.2_aarch64.zip", "1.10.2", "arm64"}, p)
+
+	for _, name := range []string{"GC.zip", "GC_latest.zip", "GC_1.0.0.tar.gz", "GC-test.zip", "GC_1.0.0_.zip"} {
+		_, err = parseAgentPackage(name, "GC")
+		require.NotNil(t, err, name)
+		require.Contains(t, err.Error(), "is not named GC_<version>[_<arch>].zip")
+	}
+	_, err = parseAgentPackage("GC_1.0.0_sparc.zip", "GC")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown architecture sparc")
+}
+
+func Test_selectAgentPackage(t *testing.T) {
+	names := []string{"GC_1.9.0.zip", "GC_1.10.0_x86_64.zip", "GC_1.2.0_arm64.zip", "GC_1.11.0_arm64.zip", "README"}
+
+	name, err := selectAgentPackage(names, "GC", "amd64")
+	require.Nil(t, err)
+	require.Equal(t, "GC_1.10.0_x86_64.zip", name, "versions are compared numerically")
+
+	name, err = selectAgentPackage(names, "GC", "arm64")
+	require.Nil(t, err)
+	require.Equal(t, "GC_1.11.0_arm64.zip", name)
+
+	// the order of the names does not matter
+	name, err = selectAgentPackage([]string{"GC_1.11.0_arm64.zip", "GC_1.2.0_arm64.zip"}, "GC", "arm64")
+	require.Nil(t, err)
+	require.Equal(t, "GC_1.11.0_arm64.zip", name)
+}
+
+func Test_selectAgentPackage_rejects(t *testing.T) {
+	_, err := selectAgentPackage([]string{"GC_1.9.0.zip"}, "GC", "arm64")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to find zip file GC_<version>[_arm64].zip among: GC_1.9.0.zip")
+
+	_, err = selectAgentPackage([]string{"GC_1.9.0.zip", "GC_1.9.0_amd64.zip"}, "GC", "amd64")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "ambiguous agent packages for version 1.9.0 on amd64")
+
+}
+
+func Test_selectAgentPackage_rejectsMalformed(t *testing.T) {
+	for bad, reason := range map[string]string{
+		"GC_new.zip":         "GC_new.zip is not named GC_<version>[_<arch>].zip",
+		"GC.zip":             "GC.zip is not named GC_<version>[_<arch>].zip",
+		"GC_2.0.0_arn64.zip": "GC_2.0.0_arn64.zip has unknown architecture arn64",
+	} {
+		// a mistyped package must not fall back to another build
+		_, err := selectAgentPackage([]string{"GC_1.9.0.zip", bad, "GC_1.9.0_arm64.zip"}, "GC", "arm64")
+		require.NotNil(t, err, bad)
+		require.Contains(t, err.Error(), "malformed agent package: "+reason)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/systemd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// agentServiceName is the systemd unit the agent installs
+	agentServiceName = "gcd.service"
+
+	substatusAgentService = "AgentService"
+)
+
+// systemctlPath is the systemctl binary used to query the agent service;
+// tests replace it with a stand-in.
+var systemctlPath = "systemctl"
+
+// checkAgentService reads the state of the agent service from systemd and
+// reports it as substatus and telemetry. It returns an error with
+// agentHealthCheckFailedCode if the service failed or is crash-looping. If
+// the state cannot be read, or the service is still starting or not found,
+// only a warning is reported.
+func checkAgentService(lg ExtensionLogger) error {
+	if dryRun() {
+		plan.add("check the state of %s with %s show", agentServiceName, systemctlPath)
+		return nil
+	}
+	defer lg.step("agent service check")()
+
+	u, err := systemd.Show(systemctlPath, agentServiceName)
+	if err != nil {
+		lg.eventError("failed to read the agent service state", err)
+		addSubstatus(substatusAgentService, status.Warning, 0, "unknown: "+err.Error())
+		observeAgentHealth(agentHealthUnknown)
+		return nil
+	}
+
+	health := u.Health()
+	observeAgentHealth(string(health))
+	lg.customLog(logEvent, "agent service state", "unit", u.Name, "health", string(health),
+		"activeState", u.ActiveState, "subState", u.SubState, "restarts", u.NRestarts, "lastExitStatus", u.ExecMainStatus)
+	telemetry(TelemetryScenario, "Agent service state: "+u.String(), health == systemd.Healthy, 0)
+
+	switch health {
+	case systemd.Healthy:
+		addSubstatus(substatusAgentService, status.Success, 0, u.String())
+	case systemd.Failed, systemd.CrashLooping:
+		addSubstatus(substatusAgentService, status.Error, agentHealthCheckFailedCode, u.String())
+		return newHandlerError(errors.New(u.String()), categoryAgentScript, agentHealthCheckFailedCode, "The agent service is not running", true)
+	default:
+		addSubstatus(substatusAgentService, status.Warning, 0, u.String())
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/stretchr/testify/require"
+)
+
+// withFakeSystemctl makes checkAgentService query a systemctl stand-in that
+// prints the given properties.
+func withFakeSystemctl(t *testing.T, properties string) func() {
+	dir, err := ioutil.TempDir("", "systemctl")
+	require.Nil(t, err)
+	systemctlPath = filepath.Join(dir, "systemctl")
+	require.Nil(t, ioutil.WriteFile(systemctlPath, []byte("#!/bin/sh\nprintf '"+properties+"'\n"), 0755))
+	return func() {
+		systemctlPath = "systemctl"
+		substatus = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_checkAgentService_healthy(t *testing.T) {
+	defer withFakeSystemctl(t, `ActiveState=active\nSubState=running\nNRestarts=0\n`)()
+
+	require.Nil(t, checkAgentService(noopLogger))
+	require.Len(t, substatus, 1)
+	require.Equal(t, substatusAgentService, substatus[0].Name)
+	require.Equal(t, status.Success, substatus[0].Status)
+}
+
+func Test_checkAgentService_crashLoop(t *testing.T) {
+	defer withFakeSystemctl(t, `ActiveState=activating\nSubState=auto-restart\nNRestarts=4\nExecMainStatus=2\n`)()
+
+	err := checkAgentService(noopLogger)
+	require.NotNil(t, err)
+	require.Equal(t, agentHealthCheckFailedCode, exitCode(err, enableCode))
+	require.Contains(t, err.Error(), "gcd.service is crash-looping")
+	require.Equal(t, status.Error, substatus[0].Status)
+	require.Equal(t, agentHealthCheckFailedCode, substatus[0].Code)
+}
+
+func Test_checkAgentService_unavailableIsWarning(t *testing.T) {
+	defer withFakeSystemctl(t, ``)()
+	systemctlPath = "/non/existing/systemctl"
+
+	require.Nil(t, checkAgentService(noopLogger))
+	require.Equal(t, status.Warning, substatus[0].Status)
+}
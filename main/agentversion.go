@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+const (
+	// agentVersionEntry is the name of the optional file in the agent package
+	// that holds the agent version
+	agentVersionEntry = "version"
+)
+
+// packagedAgentVersion returns the version in the name of the agent package
+// found in zipDir.
+func packagedAgentVersion(zipDir, prefix string) (string, error) {
+	agentZip, err := findAgentZip(zipDir, prefix)
+	if err != nil {
+		return "", err
+	}
+	return versionFromPackageName(agentZip)
+}
+
+// versionFromPackageName parses the version from the name of an agent
+// package, like GC_1.9.0.zip.
+func versionFromPackageName(agentZip string) (string, error) {
+	m := regexp.MustCompile(AgentVersionRegex).FindStringSubmatch(filepath.Base(agentZip))
+	if len(m) != 4 || m[2] == "" {
+		return "", errors.Errorf("no version in package name %s", filepath.Base(agentZip))
+	}
+	return m[2], nil
+}
+
+// verifyAgentPackage returns the version of the agent package, parsed from its
+// name and logged. If the package contains a version file, its content must
+// match that version.
+func verifyAgentPackage(lg ExtensionLogger, agentZip string) (string, error) {
+	version, err := parseAndLogAgentVersion(lg, filepath.Base(agentZip))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse version from %s", agentZip)
+	}
+
+	r, err := zip.OpenReader(agentZip)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open zip: %s", agentZip)
+	}
+	defer r.Close()
+	entry := versionEntry(r.File)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || f.Name != entry {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to open %s", f.Name)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read %s", f.Name)
+		}
+		if v := strings.TrimSpace(string(b)); v != version {
+			return "", errors.Errorf("agent package %s contains version %s in %s", agentZip, v, f.Name)
+		}
+		lg.customLog(logEvent, "agent version verified", logVersion, version, logPath, f.Name)
+	}
+	return version, nil
+}
+
+// versionEntry returns the name of the version file among the files of an
+// agent package: agentVersionEntry at the top level, or in the single
+// top-level folder all files are in. Files of that name deeper in the package,
+// like in vendored trees, are not the version file.
+func versionEntry(files []*zip.File) string {
+	root := ""
+	for _, f := range files {
+		parts := strings.SplitN(f.Name, "/", 2)
+		if parts[0] == "__MACOSX" {
+			continue // resource forks of packages zipped on macOS
+		}
+		if len(parts) == 1 || (root != "" && parts[0] != root) {
+			return agentVersionEntry
+		}
+		root = parts[0]
+	}
+	if root == "" {
+		return agentVersionEntry
+	}
+	return root + "/" + agentVersionEntry
+}
+
+// saveAgentVersion records the version of the installed agent.
+func saveAgentVersion(version string) error {
+	if dryRun() {
+		plan.add("save agent version %s to %s", version, filepath.Join(DataDir, AgentVersionFile))
+		return nil
+	}
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(DataDir, AgentVersionFile), []byte(version), 0644),
+		"failed to save agent version")
+}
+
+// agentVersion returns the version of the installed agent, or of the packaged
+// agent if none was installed yet, and "" if neither is known.
+func agentVersion() string {
+	if b, err := ioutil.ReadFile(filepath.Join(DataDir, AgentVersionFile)); err == nil {
+		if v := strings.TrimSpace(string(b)); v != "" {
+			return v
+		}
+	}
+	v, _ := packagedAgentVersion(AgentZipDir, AgentName)
+	return v
+}
+
+// agentVersionSubstatus returns the agent version as substatus. An unknown
+// version is a warning.
+func agentVersionSubstatus() status.Substatus {
+	if v := agentVersion(); v != "" {
+		return status.NewSubstatus(substatusAgentVersion, status.Success, 0, v)
+	}
+	return status.NewSubstatus(substatusAgentVersion, status.Warning, 0, "unknown")
+}
+
+// printVersion prints the extension and agent versions.
+func printVersion(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int) error {
+	fmt.Println("Extension:", DetailedVersionString())
+	source := "installed"
+	if _, err := os.Stat(filepath.Join(DataDir, AgentVersionFile)); err != nil {
+		source = "packaged"
+	}
+	v := agentVersion()
+	if v == "" {
+		v, source = "unknown", "no agent package found"
+	}
+	fmt.Printf("Agent: %s (%s)\n", v, source)
+	return nil
+}
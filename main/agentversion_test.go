@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeVersionedZip writes an agent package with a version file.
+func writeVersionedZip(t *testing.T, path, version string) {
+	writeZipFiles(t, path, map[string]string{"GC/" + agentVersionEntry: version + "\n"})
+}
+
+// writeZipFiles writes a zip with the files, by name, and their content.
+func writeZipFiles(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	require.Nil(t, err)
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		require.Nil(t, err)
+		fw.Write([]byte(content))
+	}
+	require.Nil(t, w.Close())
+}
+
+// inTempDir runs the test from an empty working directory, which is where
+// DataDir and AgentZipDir point to.
+func inTempDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chdir(dir))
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_versionFromPackageName(t *testing.T) {
+	v, err := versionFromPackageName("agent/GC_1.9.0.zip")
+	require.Nil(t, err)
+	require.Equal(t, "1.9.0", v)
+
+	v, err = versionFromPackageName("agent/GC_1.10.0_x86_64.zip")
+	require.Nil(t, err)
+	require.Equal(t, "1.10.0", v)
+
+	_, err = versionFromPackageName("agent/GC.zip")
+	require.NotNil(t, err)
+}
+
+func Test_verifyAgentPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	withoutFile := filepath.Join(dir, "GC_1.0.0.zip")
+	writeTestZip(t, withoutFile, "GC/install.sh")
+	v, err := verifyAgentPackage(noopLogger, withoutFile)
+	require.Nil(t, err)
+	require.Equal(t, "1.0.0", v)
+
+	matching := filepath.Join(dir, "GC_1.1.0.zip")
+	writeVersionedZip(t, matching, "1.1.0")
+	v, err = verifyAgentPackage(noopLogger, matching)
+	require.Nil(t, err)
+	require.Equal(t, "1.1.0", v)
+
+	mismatch := filepath.Join(dir, "GC_1.2.0.zip")
+	writeVersionedZip(t, mismatch, "1.1.0")
+	_, err = verifyAgentPackage(noopLogger, mismatch)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "contains version 1.1.0 in GC/version")
+}
+
+func Test_verifyAgentPackage_nestedVersionFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	nested := filepath.Join(dir, "GC_1.3.0.zip")
+	writeZipFiles(t, nested, map[string]string{
+		"GC/install.sh":                 "#!/bin/sh\n",
+		"GC/version":                    "1.3.0\n",
+		"GC/lib/vendor/foo/version":     "0.4.2\n",
+		"__MACOSX/GC/lib/._version":     "",
+		"__MACOSX/GC/lib/vendor/foo/._": "",
+	})
+	v, err := verifyAgentPackage(noopLogger, nested)
+	require.Nil(t, err, "only the top-level version file is read")
+	require.Equal(t, "1.3.0", v)
+
+	onlyNested := filepath.Join(dir, "GC_1.4.0.zip")
+	writeZipFiles(t, onlyNested, map[string]string{"GC/install.sh": "", "GC/lib/version": "0.4.2\n"})
+	v, err = verifyAgentPackage(noopLogger, onlyNested)
+	require.Nil(t, err)
+	require.Equal(t, "1.4.0", v)
+
+	topLevel := filepath.Join(dir, "GC_1.5.0.zip")
+	writeZipFiles(t, topLevel, map[string]string{"install.sh": "", "version": "1.4.0\n", "lib/version": "1.5.0\n"})
+	_, err = verifyAgentPackage(noopLogger, topLevel)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "contains version 1.4.0 in version")
+
+	twoRoots := filepath.Join(dir, "GC_1.6.0.zip")
+	writeZipFiles(t, twoRoots, map[string]string{"GC/version": "0.4.2\n", "tools/version": "0.4.2\n"})
+	v, err = verifyAgentPackage(noopLogger, twoRoots)
+	require.Nil(t, err, "no single root folder")
+	require.Equal(t, "1.6.0", v)
+}
+
+func Test_agentVersion_installedBeforePackaged(t *testing.T) {
+	defer inTempDir(t)()
+
+	require.Equal(t, "", agentVersion())
+	require.Equal(t, "unknown", agentVersionSubstatus().FormattedMessage.Message)
+
+	require.Nil(t, os.Mkdir(AgentZipDir, 0755))
+	writeTestZip(t, filepath.Join(AgentZipDir, "GC_2.0.0.zip"))
+	require.Equal(t, "2.0.0", agentVersion())
+
+	require.Nil(t, saveAgentVersion("1.9.0"))
+	require.Equal(t, "1.9.0", agentVersion())
+	require.Equal(t, "1.9.0", agentVersionSubstatus().FormattedMessage.Message)
+}
+
+func Test_sendTelemetry_agentVersion(t *testing.T) {
+	defer inTempDir(t)()
+	require.Nil(t, saveAgentVersion("1.9.0"))
+
+	writeCloser := &mockWriteCloser{buf: new(bytes.Buffer)}
+	send := sendTelemetry(newTelemetryEventSenderWithWriteCloser(writeCloser), "name", "1.0")
+	require.Nil(t, send("op", "msg", true, 0))
+	require.Contains(t, writeCloser.buf.String(), `{"name":"AgentVersion","value":"1.9.0"}`)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// certDirsEnv holds additional, colon separated directories to search for
+	// the protected settings certificates. They are searched first.
+	certDirsEnv = "GC_EXTENSION_CERT_DIRS"
+
+	// certTryAllEnv set to "0" disables trying every available key pair when
+	// the certificate named by the thumbprint is missing.
+	certTryAllEnv = "GC_EXTENSION_CERT_TRY_ALL"
+
+	// waagentDir is where the guest agent keeps the certificates it received
+	waagentDir = "/var/lib/waagent"
+
+	certSuffix = ".crt"
+	keySuffix  = ".prv"
+)
+
+// keyPair is a certificate and the private key file that goes with it.
+type keyPair struct {
+	thumbprint string
+	crt        string
+	prv        string
+}
+
+// certResolver finds the certificate and key to decrypt protected settings
+// with, across several directories.
+type certResolver struct {
+	dirs   []string // searched in order
+	tryAll bool     // fall back to every key pair if the named one is missing
+}
+
+// newCertResolver returns a resolver that searches the directories from
+// certDirsEnv, then the directory two levels above configFolder (where the
+// guest agent places the certificates), then the guest agent directory.
+func newCertResolver(configFolder string) certResolver {
+	var dirs []string
+	for _, d := range strings.Split(os.Getenv(certDirsEnv), ":") {
+		if d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+	dirs = append(dirs, filepath.Join(configFolder, "..", ".."), waagentDir)
+	return certResolver{dirs: dirs, tryAll: os.Getenv(certTryAllEnv) != "0"}
+}
+
+// candidates returns the key pairs to try for thumbprint: first the pairs
+// matching it case-insensitively, then, if enabled and none matched, every
+// other key pair found in the directories.
+func (r certResolver) candidates(thumbprint string) []keyPair {
+	var named, others []keyPair
+	seen := map[string]bool{}
+	for _, dir := range r.dirs {
+		for _, p := range keyPairsIn(dir) {
+			if seen[p.crt] {
+				continue
+			}
+			seen[p.crt] = true
+			if strings.EqualFold(p.thumbprint, thumbprint) {
+				named = append(named, p)
+			} else {
+				others = append(others, p)
+			}
+		}
+	}
+	if len(named) > 0 || !r.tryAll {
+		return named
+	}
+	return others
+}
+
+// keyPairsIn returns the certificates in dir that have a private key file
+// with the same name, matched case-insensitively.
+func keyPairsIn(dir string) []keyPair {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	keys := map[string]string{}
+	for _, f := range files {
+		if strings.EqualFold(filepath.Ext(f.Name()), keySuffix) {
+			keys[strings.ToUpper(strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))] = f.Name()
+		}
+	}
+
+	var pairs []keyPair
+	for _, f := range files {
+		if !strings.EqualFold(filepath.Ext(f.Name()), certSuffix) {
+			continue
+		}
+		thumbprint := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		if key, ok := keys[strings.ToUpper(thumbprint)]; ok {
+			pairs = append(pairs, keyPair{
+				thumbprint: thumbprint,
+				crt:        filepath.Join(dir, f.Name()),
+				prv:        filepath.Join(dir, key),
+			})
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func touchFiles(t *testing.T, dir string, names ...string) {
+	for _, n := range names {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, n), nil, 0600))
+	}
+}
+
+func Test_keyPairsIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	touchFiles(t, dir, "AAAA.crt", "aaaa.prv", "BBBB.crt", "CCCC.prv", "DDDD.CRT", "DDDD.PRV")
+
+	require.Equal(t, []keyPair{
+		{"AAAA", filepath.Join(dir, "AAAA.crt"), filepath.Join(dir, "aaaa.prv")},
+		{"DDDD", filepath.Join(dir, "DDDD.CRT"), filepath.Join(dir, "DDDD.PRV")},
+	}, keyPairsIn(dir))
+	require.Empty(t, keyPairsIn("/non-existing/dir"))
+}
+
+func Test_certResolver_candidates(t *testing.T) {
+	first, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(first)
+	second, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(second)
+	touchFiles(t, first, "OLD.crt", "OLD.prv")
+	touchFiles(t, second, "named.crt", "named.prv", "OTHER.crt", "OTHER.prv")
+
+	r := certResolver{dirs: []string{first, second}, tryAll: true}
+
+	// the named thumbprint matches case-insensitively and only it is tried
+	c := r.candidates("NAMED")
+	require.Len(t, c, 1)
+	require.Equal(t, filepath.Join(second, "named.crt"), c[0].crt)
+
+	// every key pair is tried, in directory order, when the thumbprint is missing
+	c = r.candidates("ROTATED")
+	require.Len(t, c, 3)
+	require.Equal(t, "OLD", c[0].thumbprint)
+
+	r.tryAll = false
+	require.Empty(t, r.candidates("ROTATED"))
+}
+
+func Test_newCertResolver(t *testing.T) {
+	os.Setenv(certDirsEnv, "/first:/second")
+	defer os.Unsetenv(certDirsEnv)
+
+	r := newCertResolver("/var/lib/waagent/ext/config")
+	require.Equal(t, []string{"/first", "/second", "/var/lib/waagent", waagentDir}, r.dirs)
+	require.True(t, r.tryAll)
+
+	os.Setenv(certTryAllEnv, "0")
+	defer os.Unsetenv(certTryAllEnv)
+	require.False(t, newCertResolver("").tryAll)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/output"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+)
+
+const substatusCleanup = "Cleanup"
+
+// cleanupSummary lists what uninstall removed and kept.
+type cleanupSummary struct {
+	Removed        []string
+	Kept           []string
+	Failed         []string
+	UninstallError string // why the agent was kept, if uninstall.sh failed
+}
+
+func (s cleanupSummary) String() string {
+	list := func(l []string) string {
+		if len(l) == 0 {
+			return "nothing"
+		}
+		return strings.Join(l, ", ")
+	}
+	msg := fmt.Sprintf("removed: %s; kept: %s", list(s.Removed), list(s.Kept))
+	if len(s.Failed) > 0 {
+		msg += "; failed to remove: " + list(s.Failed)
+	}
+	if s.UninstallError != "" {
+		msg = "agent uninstall failed, the agent is kept for a retry: " + s.UninstallError + "; " + msg
+	}
+	return msg
+}
+
+// ok returns whether the agent was uninstalled and everything removed.
+func (s cleanupSummary) ok() bool {
+	return s.UninstallError == "" && len(s.Failed) == 0
+}
+
+// agentPaths returns the paths of the installed agent, which uninstall keeps if
+// uninstall.sh failed.
+func agentPaths() []string {
+	unzipDir, _ := getAgentPaths()
+	return []string{unzipDir, filepath.Join(DataDir, AgentVersionFile)}
+}
+
+// cleanupPaths returns the paths uninstall removes besides the agentPaths: the
+// script output, the state files, the metrics and the temporary files the
+// handler leaves behind in the status and log folders. Status and log files
+// are never included.
+func cleanupPaths(hEnv vmextension.HandlerEnvironment) []string {
+	paths := []string{
+		filepath.Join(DataDir, MostRecentSequence),
+		updateFailurePath(),
+		MetricsStateFileName,
+		filepath.Join(metricsDir(), metricsFileName),
+	}
+	globs := []string{
+		filepath.Join(DataDir, ".preflight*"),
+		filepath.Join(handlerLogDir(hEnv), ExtensionHandlerLogFileName+"?*"),
+		filepath.Join(handlerLogDir(hEnv), "*.log.tmp"),
+		filepath.Join(handlerLogDir(hEnv), ".preflight*"),
+	}
+	if hEnv.HandlerEnvironment.StatusFolder != "" {
+		// temporary files of status.Save, like 3.status012345
+		globs = append(globs,
+			filepath.Join(hEnv.HandlerEnvironment.StatusFolder, "[0-9]*.status?*"),
+			filepath.Join(hEnv.HandlerEnvironment.StatusFolder, ".preflight*"))
+	}
+	for _, g := range globs {
+		matches, _ := filepath.Glob(g)
+		paths = append(paths, matches...)
+	}
+	runs, _ := output.Runs(DataDir)
+	for _, n := range runs {
+		paths = append(paths, filepath.Join(DataDir, strconv.Itoa(n)))
+	}
+	return paths
+}
+
+// cleanupExtension removes the paths from cleanupPaths, the agentPaths unless
+// uninstallErr is set, and, if removeLogs is set, the agent logs and reports.
+// Missing paths are skipped.
+func cleanupExtension(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, removeLogs bool, uninstallErr error) cleanupSummary {
+	var s cleanupSummary
+	paths := cleanupPaths(hEnv)
+	if uninstallErr != nil {
+		s.UninstallError = uninstallErr.Error()
+		for _, p := range agentPaths() {
+			if _, err := os.Stat(p); err == nil {
+				s.Kept = append(s.Kept, p)
+			}
+		}
+	} else {
+		paths = append(agentPaths(), paths...)
+	}
+	if removeLogs {
+		paths = append(paths, agentLogDir, agentReportsDir)
+	} else {
+		for _, p := range []string{agentLogDir, agentReportsDir} {
+			if _, err := os.Stat(p); err == nil {
+				s.Kept = append(s.Kept, p)
+			}
+		}
+	}
+
+	for _, p := range paths {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			continue
+		}
+		if dryRun() {
+			plan.add("remove %s", p)
+			s.Removed = append(s.Removed, p)
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			lg.eventError("failed to remove "+p, err)
+			s.Failed = append(s.Failed, p)
+			continue
+		}
+		s.Removed = append(s.Removed, p)
+	}
+	return s
+}
+
+// addCleanupSubstatus reports the summary as substatus, as a warning if
+// anything was kept that uninstall should have removed.
+func addCleanupSubstatus(s cleanupSummary) {
+	t := status.Success
+	if !s.ok() {
+		t = status.Warning
+	}
+	addSubstatus(substatusCleanup, t, 0, s.String())
+}
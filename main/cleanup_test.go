@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/pkg/errors"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cleanupExtension(t *testing.T) {
+	defer inTempDir(t)()
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.StatusFolder = "status"
+	he.HandlerEnvironment.LogFolder = "log"
+	_, agentDir := getAgentPaths()
+	stdout, _ := logPaths(agentDir)
+	for _, d := range []string{agentDir, "status", "log", scriptOutputDir(3, "enable")} {
+		require.Nil(t, os.MkdirAll(d, 0755))
+	}
+	for _, f := range []string{
+		stdout, MostRecentSequence, AgentVersionFile, UpdateFailFileName, MetricsStateFileName,
+		"status/3.status", "status/3.status123456", "status/2.status",
+		"log/" + ExtensionHandlerLogFileName, "log/" + ExtensionHandlerLogFileName + "123456",
+		"log/handler.log", "log/handler.log.tmp",
+	} {
+		require.Nil(t, ioutil.WriteFile(f, nil, 0644))
+	}
+
+	s := cleanupExtension(noopLogger, he, false, nil)
+	require.Empty(t, s.Failed)
+	require.ElementsMatch(t, []string{
+		UnzipAgentDir, MostRecentSequence, AgentVersionFile, UpdateFailFileName, MetricsStateFileName, "3",
+		"status/3.status123456", "log/" + ExtensionHandlerLogFileName + "123456", "log/handler.log.tmp",
+	}, s.Removed)
+
+	for _, kept := range []string{"status/3.status", "status/2.status", "log/" + ExtensionHandlerLogFileName, "log/handler.log"} {
+		require.True(t, fileExists(t, kept), kept)
+	}
+	require.False(t, fileExists(t, UnzipAgentDir))
+
+	// nothing left to remove
+	s = cleanupExtension(noopLogger, he, false, nil)
+	require.Empty(t, s.Removed)
+	require.Equal(t, "removed: nothing; kept: nothing", s.String())
+}
+
+func Test_cleanupExtension_uninstallFailed(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+
+	_, agentDir := getAgentPaths()
+	require.Nil(t, os.MkdirAll(agentDir, 0755))
+	for _, f := range []string{MostRecentSequence, AgentVersionFile} {
+		require.Nil(t, ioutil.WriteFile(f, nil, 0644))
+	}
+
+	s := cleanupExtension(noopLogger, vmextension.HandlerEnvironment{}, false, errors.New("exit status 1"))
+	require.Equal(t, []string{MostRecentSequence}, s.Removed)
+	require.Equal(t, []string{UnzipAgentDir, AgentVersionFile}, s.Kept)
+	require.True(t, fileExists(t, agentDir), "the agent is kept for a retry")
+	require.False(t, s.ok())
+	require.Equal(t, "agent uninstall failed, the agent is kept for a retry: exit status 1; removed: "+
+		MostRecentSequence+"; kept: "+UnzipAgentDir+", "+AgentVersionFile, s.String())
+
+	addCleanupSubstatus(s)
+	require.Len(t, substatus, 1)
+	require.Equal(t, substatusCleanup, substatus[0].Name)
+	require.Equal(t, status.Warning, substatus[0].Status)
+}
+
+func Test_cleanupExtension_dryRun(t *testing.T) {
+	defer inTempDir(t)()
+	require.Nil(t, ioutil.WriteFile(MostRecentSequence, nil, 0644))
+
+	actions := withDryRun(func() {
+		s := cleanupExtension(noopLogger, vmextension.HandlerEnvironment{}, false, nil)
+		require.Equal(t, []string{MostRecentSequence}, s.Removed)
+	})
+	require.Equal(t, []string{"remove " + MostRecentSequence}, actions)
+	require.True(t, fileExists(t, MostRecentSequence))
+}
+
+func Test_cleanupSummary_String(t *testing.T) {
+	s := cleanupSummary{Removed: []string{"a", "b"}, Kept: []string{"c"}, Failed: []string{"d"}}
+	require.Equal(t, "removed: a, b; kept: c; failed to remove: d", s.String())
+}
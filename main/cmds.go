@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 
 	"github.com/pkg/errors"
@@ -18,6 +19,7 @@ type cmd struct {
 	shouldReportStatus bool    // determines if running this should log to a .status file
 	pre                prefunc // executed before any status is reported
 	failExitCode       int     // exitCode to use when commands fail
+	local              bool    // runs without the guest agent: no seqnum, status, telemetry or handler log
 }
 
 const (
@@ -27,19 +29,28 @@ const (
 )
 
 var (
-	telemetry = sendTelemetry(newTelemetryEventSender(), fullName, Version)
+	// telemetry drops the events until main configures the sinks, so tests
+	// send nothing by default
+	telemetry = sendTelemetry(fanOutSink{}, fullName, Version)
 
 	// allowed user inputs
 	cmds = map[string]cmd{
-		"install":   {install, "install", false, nil, installCode},
-		"enable":    {enable, "enable", true, enablePre, enableCode},
-		"update":    {update, "update", true, nil, updateCode},
-		"disable":   {disable, "disable", true, nil, disableCode},
-		"uninstall": {uninstall, "uninstall", false, nil, uninstallCode},
+		"install":      {install, "install", false, nil, installCode, false},
+		"enable":       {enable, "enable", true, enablePre, enableCode, false},
+		"update":       {update, "update", true, nil, updateCode, false},
+		"disable":      {disable, "disable", true, nil, disableCode, false},
+		"uninstall":    {uninstall, "uninstall", false, nil, uninstallCode, false},
+		"diagnose":     {diagnose, "diagnose", false, nil, diagnoseCode, true},
+		"collect-logs": {collectLogs, "collect-logs", false, nil, collectLogsCode, true},
+		"version":      {printVersion, "version", false, nil, versionCode, true},
 	}
 )
 
 func install(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int) error {
+	if err := checkDistro(lg, hEnv, seqNum); err != nil {
+		return err
+	}
+
 	msg := "Extension install succeeded"
 	lg.event(msg)
 	telemetry(TelemetryScenario, msg, true, 0)
@@ -53,7 +64,10 @@ func enablePre(lg ExtensionLogger, seqNum int) error {
 		return errors.Wrap(err, "failed to process seqnum")
 	} else if shouldExit {
 		lg.eventError("exit", errors.New("this sequence number smaller than the currently processed sequence number, will not run again"))
-		os.Exit(successCode)
+		if dryRun() {
+			plan.add("exit: sequence number %d is already processed", seqNum)
+		}
+		exit(successCode)
 	}
 	return nil
 }
@@ -65,12 +79,12 @@ func enable(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int)
 		return errors.Wrap(err, "failed to get configuration")
 	}
 
-	// parse and log the agent version
-	//_, err = parseAndLogAgentVersion(AgentZipDir)
-	//if err != nil {
-	//	lg.customLog(logEvent, "failed to parse version string", logError, err, logAgentName, AgentZipDir)
-	//	return errors.Wrap(err, "failed to parse version string")
-	//}
+	// an earlier update failure is reported and repaired by reinstalling the
+	// agent, the marker is cleared once that succeeds
+	reinstall, err := handleUpdateFailure(lg, hEnv, seqNum, cfg)
+	if err != nil {
+		return err
+	}
 
 	// check to see if agent directory exists
 	unzipDir, agentDirectory := getAgentPaths()
@@ -78,7 +92,13 @@ func enable(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int)
 	if _, err := os.Stat(agentDirectory); err == nil {
 		// directory exists, run enable.sh for agent health check
 		lg.event("agent health check")
-		_, runErr := runCmd(lg, "bash ./enable.sh", agentDirectory, cfg)
+		_, runErr := runCmd(lg, "bash ./enable.sh", agentDirectory, newScriptContext(hEnv, seqNum, "enable"), cfg)
+		if runErr != nil {
+			runErr = newHandlerError(runErr, categoryAgentScript, agentHealthCheckFailedCode, "The agent health check failed", true)
+		} else {
+			runErr = checkAgentService(lg)
+		}
+		addAgentSubstatus(runErr, agentHealthCheckFailedCode)
 		if runErr != nil {
 			lg.eventError("agent health check failed", runErr)
 			return runErr
@@ -87,45 +107,102 @@ func enable(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int)
 		return nil
 	}
 
-	// directory does not exist, unzipAgent agent
-	_, err = unzipAgent(lg, AgentZipDir, AgentName, unzipDir)
+	// directory does not exist, parse and log the version of the agent package
+	// and check the machine before unzipping it
+	agentZip, err := findAgentZip(AgentZipDir, AgentName)
 	if err != nil {
-		lg.eventError("failed to unzipAgent agent dir", err)
-		return errors.Wrap(err, "failed to unzipAgent agent")
+		return invalidAgentPackage(errors.Wrap(err, "failed to find agent package"))
 	}
-	// set permissions for the .sh files
-	err = setPermissions()
+	version, err := verifyAgentPackage(lg, agentZip)
 	if err != nil {
-		lg.eventError("failed to update the permissions for the scripts", err)
-		telemetry(TelemetryScenario, err.Error(), false, 0)
-		return errors.Wrap(err, "failed to update the permissions for the scripts")
+		lg.customLog(logEvent, "failed to verify agent package", logError, err, logAgentName, agentZip)
+		return invalidAgentPackage(errors.Wrap(err, "failed to verify agent package"))
+	}
+	if err := runPreflight(lg, hEnv); err != nil {
+		lg.eventError("preflight checks failed", err)
+		return err
+	}
+	if dryRun() {
+		if err := planAgentInstall(AgentZipDir, AgentName, unzipDir); err != nil {
+			return invalidAgentPackage(errors.Wrap(err, "failed to unzipAgent agent"))
+		}
+	} else if err := installAgentFiles(lg, unzipDir); err != nil {
+		return err
 	}
 
 	// run install.sh and enable.sh
 	lg.event("installing agent")
-	_, runErr = runCmd(lg, "bash ./install.sh", agentDirectory, cfg)
+	sc := newScriptContext(hEnv, seqNum, "install")
+	_, runErr = runCmd(lg, "bash ./install.sh", agentDirectory, sc, cfg)
 	if runErr != nil {
+		runErr = agentScriptFailed(runErr, "The agent installation failed")
 		lg.eventError("agent installation failed", runErr)
 		telemetry(TelemetryScenario, "agent installation failed: "+runErr.Error(), false, 0)
 	} else {
-		lg.customLog(logEvent, "agent installation succeeded", logEvent, "enabling agent")
+		lg.customLog(logEvent, "agent installation succeeded", logEvent, "enabling agent", logVersion, version)
 		telemetry(TelemetryScenario, "agent installation succeeded", true, 0)
-		_, runErr = runCmd(lg, "bash ./enable.sh", agentDirectory, cfg)
+		if err := saveAgentVersion(version); err != nil {
+			lg.eventError("failed to save agent version", err)
+		}
+		sc = newScriptContext(hEnv, seqNum, "enable")
+		_, runErr = runCmd(lg, "bash ./enable.sh", agentDirectory, sc, cfg)
 		if runErr != nil {
+			runErr = agentScriptFailed(runErr, "Enabling the agent failed")
 			lg.eventError("enable agent failed", runErr)
 			telemetry(TelemetryScenario, "agent enable failed: "+runErr.Error(), false, 0)
 		} else {
 			lg.event("enable agent succeeded")
 			telemetry(TelemetryScenario, "agent enable succeeded", true, 0)
+			runErr = checkAgentService(lg)
+		}
+	}
+
+	addAgentSubstatus(runErr, exitCode(runErr, enableCode))
+	if reinstall && runErr == nil {
+		if err := clearUpdateFailure(); err != nil {
+			lg.eventError("failed to clear update failure marker", err)
 		}
 	}
 
 	// collect the logs if available and send telemetry updates
-	getStdPipesAndTelemetry(lg, unzipDir, runErr)
+	getStdPipesAndTelemetry(lg, sc.OutputDir, runErr)
 
 	return runErr
 }
 
+// installAgentFiles unzips the agent package into unzipDir and makes its
+// scripts executable.
+func installAgentFiles(lg ExtensionLogger, unzipDir string) error {
+	_, err := unzipAgent(lg, AgentZipDir, AgentName, unzipDir)
+	if err != nil {
+		lg.eventError("failed to unzipAgent agent dir", err)
+		// a partially extracted agent would be mistaken for an installed one
+		removeTempArtifact(lg, unzipDir)
+		return invalidAgentPackage(errors.Wrap(err, "failed to unzipAgent agent"))
+	}
+	// set permissions for the .sh files
+	endStep := lg.step("set script permissions")
+	err = setPermissions()
+	endStep()
+	if err != nil {
+		lg.eventError("failed to update the permissions for the scripts", err)
+		telemetry(TelemetryScenario, err.Error(), false, 0)
+		return errors.Wrap(err, "failed to update the permissions for the scripts")
+	}
+	return nil
+}
+
+// invalidAgentPackage marks err as a package integrity error.
+func invalidAgentPackage(err error) error {
+	return newHandlerError(err, categoryPackageIntegrity, invalidAgentPackageCode, "The agent package is missing or corrupt", false)
+}
+
+// agentScriptFailed marks the error of an agent script as retryable agent
+// error with the given message.
+func agentScriptFailed(err error, message string) error {
+	return newHandlerError(err, categoryAgentScript, agentScriptFailedCode, message, true)
+}
+
 func update(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int) error {
 	// parse the extension handler settings
 	cfg, err := parseAndValidateSettings(hEnv.HandlerEnvironment.ConfigFolder)
@@ -135,18 +212,25 @@ func update(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int)
 
 	// run update.sh to disable the agent
 	lg.event("updating agent")
-	unzipDir, agentDirectory := getAgentPaths()
-	_, runErr := runCmd(lg, "bash ./update.sh", agentDirectory, cfg)
+	_, agentDirectory := getAgentPaths()
+	sc := newScriptContext(hEnv, seqNum, "update")
+	_, runErr := runCmd(lg, "bash ./update.sh", agentDirectory, sc, cfg)
 	if runErr != nil {
 		lg.eventError("agent update failed", runErr)
 		telemetry(TelemetryScenario, "agent update failed: "+runErr.Error(), false, 0)
+		// returning the error would make the guest agent retry the update
+		// forever, so the next enable reports and repairs it instead
+		addSubstatus(substatusUpdateFailure, status.Error, updateCode, runErr.Error())
+		if err := writeUpdateFailure(seqNum, runErr); err != nil {
+			lg.eventError("failed to write update failure marker", err)
+		}
 	} else {
 		lg.event("agent update succeeded")
 		telemetry(TelemetryScenario, "agent update succeeded", true, 0)
 	}
 
 	// collect the logs if available and send telemetry updates
-	getStdPipesAndTelemetry(lg, unzipDir, runErr)
+	getStdPipesAndTelemetry(lg, sc.OutputDir, runErr)
 	return nil
 }
 
@@ -159,8 +243,9 @@ func disable(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int
 
 	// run disable.sh to disable the agent
 	lg.event("disabling agent")
-	unzipDir, agentDirectory := getAgentPaths()
-	_, runErr := runCmd(lg, "bash ./disable.sh", agentDirectory, cfg)
+	_, agentDirectory := getAgentPaths()
+	sc := newScriptContext(hEnv, seqNum, "disable")
+	_, runErr := runCmd(lg, "bash ./disable.sh", agentDirectory, sc, cfg)
 	if runErr != nil {
 		lg.eventError("agent disable failed", runErr)
 		telemetry(TelemetryScenario, "agent disable failed: "+runErr.Error(), false, 0)
@@ -170,7 +255,7 @@ func disable(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int
 	}
 
 	// collect the logs if available and send telemetry updates
-	getStdPipesAndTelemetry(lg, unzipDir, runErr)
+	getStdPipesAndTelemetry(lg, sc.OutputDir, runErr)
 
 	return nil
 }
@@ -184,8 +269,9 @@ func uninstall(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum i
 
 	// run uninstall.sh to uninstall the agent
 	lg.event("uninstalling agent")
-	unzipDir, agentDirectory := getAgentPaths()
-	_, runErr := runCmd(lg, "bash ./uninstall.sh", agentDirectory, cfg)
+	_, agentDirectory := getAgentPaths()
+	sc := newScriptContext(hEnv, seqNum, "uninstall")
+	_, runErr := runCmd(lg, "bash ./uninstall.sh", agentDirectory, sc, cfg)
 	if runErr != nil {
 		lg.eventError("agent uninstall failed", runErr)
 		telemetry(TelemetryScenario, "agent uninstall failed: "+runErr.Error(), false, 0)
@@ -195,7 +281,17 @@ func uninstall(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum i
 	}
 
 	// collect the logs if available and send telemetry updates
-	getStdPipesAndTelemetry(lg, unzipDir, runErr)
+	getStdPipesAndTelemetry(lg, sc.OutputDir, runErr)
+
+	// remove what the extension left behind, so a reinstall starts clean. A
+	// failed uninstall keeps the agent, so that uninstall can be retried.
+	summary := cleanupExtension(lg, hEnv, cfg.publicSettings.RemoveLogsOnUninstall, runErr)
+	lg.customLog(logEvent, "uninstall cleanup", "summary", summary.String())
+	telemetry(TelemetryScenario, "Uninstall cleanup "+summary.String(), summary.ok(), 0)
+	addCleanupSubstatus(summary)
 
+	if runErr != nil {
+		return agentScriptFailed(runErr, "Uninstalling the agent failed")
+	}
 	return nil
 }
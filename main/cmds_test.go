@@ -35,7 +35,7 @@ func Test_commands_shouldReportStatus(t *testing.T) {
 }
 
 func Test_install(t *testing.T) {
-	err := install(ExtensionLogger{newNoopLogger()},
+	err := install(newNoopLogger(),
 		vmextension.HandlerEnvironment{},
 		0)
 	require.Nil(t, err)
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/output"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/redact"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+const (
+	// shimLogDir is where guest-configuration-shim writes its own log
+	shimLogDir = "/var/log/azure/guest-configuration"
+
+	// agentLogDir is where the GC agent writes its own logs
+	agentLogDir = "/var/lib/GuestConfig/gc_agent_logs"
+
+	// bundleMaxFileSize caps every file in the support bundle; larger files
+	// keep only their last bundleMaxFileSize bytes
+	bundleMaxFileSize int64 = 10 * 1024 * 1024
+
+	// redactedValue replaces protected settings in the bundled settings files
+	redactedValue = redact.Placeholder
+)
+
+// bundleManifest describes the system and every file in the support bundle.
+type bundleManifest struct {
+	CreatedUTC  string            `json:"createdUTC"`
+	Hostname    string            `json:"hostname"`
+	Kernel      string            `json:"kernel"`
+	OSRelease   string            `json:"osRelease"`
+	MaxSize     int64             `json:"maxSize"`
+	Diagnostics diagnosticReport  `json:"diagnostics"`
+	Files       []bundleFileEntry `json:"files"`
+}
+
+type bundleFileEntry struct {
+	Name      string `json:"name"`
+	Source    string `json:"source,omitempty"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Skipped   string `json:"skipped,omitempty"`
+}
+
+// logBundle writes files into a gzipped tar archive while keeping the whole
+// archive content under a size budget.
+type logBundle struct {
+	tw        *tar.Writer
+	remaining int64
+	manifest  bundleManifest
+}
+
+// collectLogs writes a redacted support bundle to the path given by -output.
+// Like diagnose, it does not require the guest agent.
+func collectLogs(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int) error {
+	out := *bundleOutput
+	if out == "" {
+		out = filepath.Join(os.TempDir(), fmt.Sprintf("guest-configuration-logs-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")))
+	}
+
+	if err := writeLogBundle(lg, out, *bundleMaxSize*1024*1024, hEnv, handlerEnvError(hEnv)); err != nil {
+		return err
+	}
+	fmt.Println("Support bundle written to: " + out)
+	return nil
+}
+
+// writeLogBundle collects the handler logs, status and settings files, seqnum
+// state and agent output and logs into a tar.gz at out, which holds at most
+// maxSize bytes of file content besides the manifest. Every file is redacted,
+// with the values of the protected settings read by collectDiagnostics. A
+// partial bundle is removed if writing fails.
+func writeLogBundle(lg ExtensionLogger, out string, maxSize int64, he vmextension.HandlerEnvironment, heErr error) (err error) {
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create support bundle")
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "failed to finish support bundle")
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+	gw := gzip.NewWriter(f)
+	b := &logBundle{
+		tw:        tar.NewWriter(gw),
+		remaining: maxSize,
+		manifest: bundleManifest{
+			CreatedUTC:  time.Now().UTC().Format(time.RFC3339),
+			MaxSize:     maxSize,
+			Diagnostics: collectDiagnostics(lg, he, heErr),
+		},
+	}
+	b.manifest.Hostname, _ = os.Hostname()
+	b.manifest.Kernel = readTrimmed("/proc/version")
+	b.manifest.OSRelease = readTrimmed("/etc/os-release")
+
+	b.addDir(LegacyHandlerLogDir, "handler/legacy")
+	b.addDir(shimLogDir, "shim")
+	b.addFile(filepath.Join(DataDir, MostRecentSequence), "state/"+MostRecentSequence)
+	runs, _ := output.Runs(DataDir)
+	for _, n := range runs {
+		b.addDir(filepath.Join(DataDir, strconv.Itoa(n)), "agent/output/"+strconv.Itoa(n))
+	}
+	b.addDir(agentLogDir, "agent/logs")
+	if heErr == nil {
+		b.addDir(he.HandlerEnvironment.LogFolder, "handler/logFolder")
+		b.addGlob(filepath.Join(he.HandlerEnvironment.StatusFolder, "*.status"), "status")
+		b.addSettings(he.HandlerEnvironment.ConfigFolder)
+	}
+
+	mb, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal bundle manifest")
+	}
+	if err := b.writeEntry("manifest.json", []byte(secrets.String(string(mb)))); err != nil {
+		return err
+	}
+
+	if err := b.tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish support bundle")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish support bundle")
+	}
+	lg.customLog(logEvent, "support bundle written", logPath, out)
+	return nil
+}
+
+// addFile adds the file at src to the bundle as name. Files larger than
+// bundleMaxFileSize, or than the remaining budget once redacted, keep only
+// their tail.
+func (b *logBundle) addFile(src, name string) {
+	e := bundleFileEntry{Name: name, Source: src}
+	defer func() { b.manifest.Files = append(b.manifest.Files, e) }()
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		e.Skipped = err.Error()
+		return
+	}
+	limit := bundleMaxFileSize
+	if b.remaining < limit {
+		limit = b.remaining
+	}
+	if limit <= 0 {
+		e.Skipped = errBundleFull.Error()
+		return
+	}
+	data, err := tailFile(src, limit)
+	if err != nil {
+		e.Skipped = err.Error()
+		return
+	}
+	e.Truncated = fi.Size() > int64(len(data))
+	// redaction can make the tail longer than the limit
+	data = []byte(secrets.String(string(data)))
+	if int64(len(data)) > limit {
+		data, e.Truncated = data[int64(len(data))-limit:], true
+	}
+	if e.Size, err = b.write(name, data); err != nil {
+		e.Skipped = err.Error()
+	}
+}
+
+// addDir adds every regular file under dir to the bundle below prefix.
+func (b *logBundle) addDir(dir, prefix string) {
+	if _, err := os.Stat(dir); err != nil {
+		b.manifest.Files = append(b.manifest.Files, bundleFileEntry{Name: prefix, Source: dir, Skipped: err.Error()})
+		return
+	}
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		b.addFile(path, filepath.ToSlash(filepath.Join(prefix, rel)))
+		return nil
+	})
+}
+
+// addGlob adds every file matching pattern to the bundle below prefix.
+func (b *logBundle) addGlob(pattern, prefix string) {
+	matches, _ := filepath.Glob(pattern)
+	sort.Strings(matches)
+	for _, m := range matches {
+		b.addFile(m, prefix+"/"+filepath.Base(m))
+	}
+}
+
+// addSettings adds the *.settings files in configFolder with their protected
+// settings replaced by redactedValue.
+func (b *logBundle) addSettings(configFolder string) {
+	matches, _ := filepath.Glob(filepath.Join(configFolder, "*.settings"))
+	sort.Strings(matches)
+	for _, m := range matches {
+		name := "config/" + filepath.Base(m)
+		e := bundleFileEntry{Name: name, Source: m}
+		data, err := ioutil.ReadFile(m)
+		if err == nil {
+			data, err = redactSettingsFile(data)
+		}
+		if err != nil {
+			e.Skipped = err.Error()
+		} else if e.Size, err = b.write(name, data); err != nil {
+			e.Skipped = err.Error()
+		}
+		b.manifest.Files = append(b.manifest.Files, e)
+	}
+}
+
+// errBundleFull is returned by write for data that does not fit in the
+// remaining budget of the bundle.
+var errBundleFull = errors.New("bundle size limit reached")
+
+// write adds data to the archive as name with the secrets redacted, charges
+// it to the budget and returns its redacted size. Nothing is written if the
+// redacted data does not fit in the remaining budget.
+func (b *logBundle) write(name string, data []byte) (int64, error) {
+	data = []byte(secrets.String(string(data)))
+	if int64(len(data)) > b.remaining {
+		return 0, errBundleFull
+	}
+	if err := b.writeEntry(name, data); err != nil {
+		return 0, err
+	}
+	b.remaining -= int64(len(data))
+	return int64(len(data)), nil
+}
+
+// writeEntry adds data to the archive as name.
+func (b *logBundle) writeEntry(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "failed to write tar header for "+name)
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		return errors.Wrap(err, "failed to write "+name)
+	}
+	return nil
+}
+
+// redactSettingsFile replaces the protected settings of every runtime setting
+// in a handler settings file. Empty files are returned unchanged.
+func redactSettingsFile(data []byte) ([]byte, error) {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return data, nil
+	}
+	var f map[string]interface{}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errors.Wrap(err, "failed to parse settings file")
+	}
+	rs, _ := f["runtimeSettings"].([]interface{})
+	for _, r := range rs {
+		rm, _ := r.(map[string]interface{})
+		hs, _ := rm["handlerSettings"].(map[string]interface{})
+		if _, ok := hs["protectedSettings"]; ok {
+			hs["protectedSettings"] = redactedValue
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return nil, errors.Wrap(err, "failed to marshal settings file")
+	}
+	return buf.Bytes(), nil
+}
+
+// readTrimmed returns the trimmed content of the file at path, or an empty
+// string if it cannot be read.
+func readTrimmed(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/redact"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+const testSettingsFile = `{"runtimeSettings":[{"handlerSettings":{
+	"protectedSettingsCertThumbprint":"ABCDEF",
+	"protectedSettings":"MIIB-secret-blob",
+	"publicSettings":{"commandToExecute":"date"}}}]}`
+
+// readBundle returns the entries of the tar.gz at path keyed by name.
+func readBundle(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	require.Nil(t, err)
+
+	entries := map[string]string{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.Nil(t, err)
+		entries[hdr.Name] = string(b)
+	}
+	return entries
+}
+
+func Test_writeLogBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.ConfigFolder = filepath.Join(dir, "config")
+	he.HandlerEnvironment.StatusFolder = filepath.Join(dir, "status")
+	he.HandlerEnvironment.LogFolder = filepath.Join(dir, "log")
+	for _, d := range []string{"config", "status", "log"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "config", "0.settings"), []byte(testSettingsFile), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "status", "0.status"), []byte("[]"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "log", "extension.log"), []byte("hello"), 0600))
+	secrets.Add("hunter2-protected")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "log", "agent.log"),
+		[]byte("GET https://a.blob.core.windows.net/gc?sv=2020&sig=abc%2Fdef\npassword hunter2-protected\n"), 0600))
+
+	out := filepath.Join(dir, "bundle.tar.gz")
+	require.Nil(t, writeLogBundle(noopLogger, out, 1024*1024, he, nil))
+
+	entries := readBundle(t, out)
+	require.Equal(t, "[]", entries["status/0.status"])
+	require.Equal(t, "hello", entries["handler/logFolder/extension.log"])
+	require.NotContains(t, entries["config/0.settings"], "MIIB-secret-blob")
+	require.Contains(t, entries["config/0.settings"], redactedValue)
+	require.Contains(t, entries["config/0.settings"], "ABCDEF")
+	require.Equal(t, "GET https://a.blob.core.windows.net/gc?sv=2020&sig=<redacted>\npassword <redacted>\n",
+		entries["handler/logFolder/agent.log"], "every file is redacted")
+
+	var m bundleManifest
+	require.Nil(t, json.Unmarshal([]byte(entries["manifest.json"]), &m))
+	require.Equal(t, int64(1024*1024), m.MaxSize)
+	require.Equal(t, he.HandlerEnvironment.ConfigFolder, m.Diagnostics.HandlerEnvironment.ConfigFolder)
+}
+
+func Test_writeLogBundle_sizeCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.LogFolder = dir
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.log"), []byte(strings.Repeat("a", 50)+"TAIL"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.log"), []byte("bbbb"), 0600))
+
+	out := filepath.Join(os.TempDir(), "bundle-cap.tar.gz")
+	defer os.Remove(out)
+	require.Nil(t, writeLogBundle(noopLogger, out, 20, he, nil))
+
+	entries := readBundle(t, out)
+	require.Len(t, entries["handler/logFolder/a.log"], 20)
+	require.True(t, strings.HasSuffix(entries["handler/logFolder/a.log"], "TAIL"), "keeps the tail")
+	_, ok := entries["handler/logFolder/b.log"]
+	require.False(t, ok, "budget exhausted")
+
+	var m bundleManifest
+	require.Nil(t, json.Unmarshal([]byte(entries["manifest.json"]), &m))
+	for _, f := range m.Files {
+		if f.Name == "handler/logFolder/a.log" {
+			require.True(t, f.Truncated)
+		}
+		if f.Name == "handler/logFolder/b.log" {
+			require.Equal(t, "bundle size limit reached", f.Skipped)
+		}
+	}
+}
+
+func Test_writeLogBundle_redactedSizeCap(t *testing.T) {
+	defer func() { secrets = redact.New() }()
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	secrets.Add("s3cret")
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.LogFolder = dir
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.log"), []byte("s3cret s3cret"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.log"), []byte("b"), 0600))
+
+	out := filepath.Join(dir, "bundle.tar.gz")
+	require.Nil(t, writeLogBundle(noopLogger, out, 20, he, nil))
+
+	entries := readBundle(t, out)
+	require.Len(t, entries["handler/logFolder/a.log"], 20, "the redacted file is cut to the budget")
+	_, ok := entries["handler/logFolder/b.log"]
+	require.False(t, ok, "budget exhausted")
+
+	var m bundleManifest
+	require.Nil(t, json.Unmarshal([]byte(entries["manifest.json"]), &m))
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+	require.Equal(t, int64(20), size)
+}
+
+func Test_writeLogBundle_removesPartialBundle(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("needs /dev/full")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// writes to /dev/full fail, and removing the bundle removes the link
+	out := filepath.Join(dir, "bundle.tar.gz")
+	require.Nil(t, os.Symlink("/dev/full", out))
+	err = writeLogBundle(noopLogger, out, 1024*1024, vmextension.HandlerEnvironment{}, errors.New("no handler env"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no space left on device")
+	_, err = os.Lstat(out)
+	require.True(t, os.IsNotExist(err), "partial bundle is removed")
+	_, err = os.Stat("/dev/full")
+	require.Nil(t, err)
+}
+
+func Test_redactSettingsFile(t *testing.T) {
+	b, err := redactSettingsFile([]byte(""))
+	require.Nil(t, err)
+	require.Empty(t, b)
+
+	_, err = redactSettingsFile([]byte("{"))
+	require.NotNil(t, err)
+
+	b, err = redactSettingsFile([]byte(testSettingsFile))
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "MIIB-secret-blob")
+	require.Contains(t, string(b), `"commandToExecute": "date"`)
+}
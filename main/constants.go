@@ -5,9 +5,23 @@ const (
 	installCode                = 100
 	enableCode                 = 200
 	agentHealthCheckFailedCode = 201
+	preflightFailedCode        = 202
 	updateCode                 = 300
 	disableCode                = 400
 	uninstallCode              = 500
+	diagnoseCode               = 600
+	collectLogsCode            = 700
+	versionCode                = 800
+
+	// unsupportedDistroCode is the install exit code on distributions the agent
+	// does not support, as expected by the guest agent
+	unsupportedDistroCode = 51
+
+	// Error codes shared by the commands
+	invalidSettingsCode     = 52
+	invalidAgentPackageCode = 53
+	hookFailedCode          = 54
+	agentScriptFailedCode   = 203
 
 	// Generic error codes
 	successCode    = 0
@@ -29,6 +43,10 @@ const (
 	// the extension handler52
 	DataDir = "./"
 
+	// AgentVersionFile records the version of the installed agent. Stored
+	// under DataDir.
+	AgentVersionFile = "agentversion"
+
 	// MostRecentSequence (mrseq) holds the processed highest sequence number to make sure
 	// we do not run the command more than once for the same sequence
 	// number. Stored under DataDir. This file is auto-preserved by the agent.
@@ -49,15 +67,26 @@ const (
 	// ExtensionHandlerLogFileName is the log file name.
 	ExtensionHandlerLogFileName = "gcextn-handler.log"
 
+	// LegacyHandlerLogDir is where the handler logged, relative to the extension
+	// directory, before it used the LogFolder of the handler environment
+	LegacyHandlerLogDir = "./path"
+
 	// ExtensionDirRegex Regex for finding only Extension directories.
 	ExtensionDirRegex = "Microsoft.GuestConfiguration.?(Edp)?.ConfigurationForLinux-([0-9.]*)"
 
 	// GCExtensionVersionRegex returns the version of the extension
 	GCExtensionVersionRegex = "^([./a-zA-Z]*)-([0-9.]*)?$"
 
-	// AgentVersionRegex helps return the version of the extension
-	AgentVersionRegex = "^([./a-zA-Z0-9]*)_([0-9.]*)?[.](.*)$"
+	// AgentVersionRegex helps return the version of the agent from a package
+	// name like GC_1.9.0.zip or GC_1.9.0_arm64.zip
+	AgentVersionRegex = "^([./a-zA-Z0-9]*)_([0-9.]*[0-9])(?:_[a-zA-Z0-9_]+)?[.](.*)$"
 
 	// If we return failure from update, the Guest Agent goes into an infinite loop. Fixed in the next GA deployment.
-	UpdateFailFileName = "./update_failed"
+	// update records its failure in this marker instead, for the next enable to report and repair. Stored under
+	// DataDir.
+	UpdateFailFileName = "update_failed"
+
+	// MetricsStateFileName keeps the state the metrics are rendered from
+	// across the handler runs. Stored under DataDir.
+	MetricsStateFileName = "./metrics.json"
 )
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/distro"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+var (
+	// agentScripts are the lifecycle scripts every agent package must contain
+	agentScripts = []string{"install.sh", "enable.sh", "update.sh", "disable.sh", "uninstall.sh"}
+)
+
+// diagnosticReport holds the locally observable state of the extension. It is
+// built without talking to the guest agent, so every section records its own
+// error instead of failing the whole report.
+type diagnosticReport struct {
+	ExtensionVersion   string             `json:"extensionVersion"`
+	Distro             distro.Verdict     `json:"distro"`
+	HandlerEnvironment handlerEnvReport   `json:"handlerEnvironment"`
+	SeqNum             seqNumReport       `json:"seqNum"`
+	Agent              agentReport        `json:"agent"`
+	Status             statusFileReport   `json:"status"`
+	ScriptOutput       scriptOutputReport `json:"scriptOutput"`
+	Telemetry          writeCheckReport   `json:"telemetry"`
+	OpenSSL            binaryReport       `json:"openssl"`
+}
+
+type handlerEnvReport struct {
+	HeartbeatFile string `json:"heartbeatFile,omitempty"`
+	StatusFolder  string `json:"statusFolder,omitempty"`
+	ConfigFolder  string `json:"configFolder,omitempty"`
+	LogFolder     string `json:"logFolder,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+type seqNumReport struct {
+	Current      int    `json:"current"`
+	CurrentError string `json:"currentError,omitempty"`
+	MostRecent   string `json:"mostRecent,omitempty"`
+	MrSeqError   string `json:"mostRecentError,omitempty"`
+}
+
+type agentReport struct {
+	Package          string   `json:"package,omitempty"`
+	Version          string   `json:"version,omitempty"`
+	InstalledVersion string   `json:"installedVersion,omitempty"`
+	Directory        string   `json:"directory"`
+	Installed        bool     `json:"installed"`
+	MissingScripts   []string `json:"missingScripts,omitempty"`
+	NonExecutable    []string `json:"nonExecutableScripts,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+type statusFileReport struct {
+	Path    string `json:"path,omitempty"`
+	Content string `json:"content,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type scriptOutputReport struct {
+	Dir    string `json:"dir"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	Error  string `json:"error,omitempty"`
+}
+
+type writeCheckReport struct {
+	Path     string `json:"path"`
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+}
+
+type binaryReport struct {
+	Path    string `json:"path,omitempty"`
+	Present bool   `json:"present"`
+}
+
+// diagnose reports the full local state of the extension to stdout. It does
+// not require the guest agent and changes nothing, not even the handler log.
+func diagnose(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int) error {
+	r := collectDiagnostics(lg, hEnv, handlerEnvError(hEnv))
+	if *jsonOutput {
+		return writeDiagnosticsJSON(os.Stdout, r)
+	}
+	return writeDiagnosticsText(os.Stdout, r)
+}
+
+// handlerEnvError returns an error if the handler environment runLocal passes
+// to the local commands could not be read, which leaves it empty.
+func handlerEnvError(hEnv vmextension.HandlerEnvironment) error {
+	if hEnv.HandlerEnvironment.ConfigFolder == "" {
+		return errors.New("failed to read the handler environment")
+	}
+	return nil
+}
+
+// collectDiagnostics gathers the diagnostic report for the given handler
+// environment. A non-nil heErr means the environment could not be parsed, in
+// which case only the checks that do not depend on it are run. The protected
+// settings are read first, so that the file contents in the report are
+// redacted.
+func collectDiagnostics(lg ExtensionLogger, he vmextension.HandlerEnvironment, heErr error) diagnosticReport {
+	if heErr == nil {
+		if _, _, err := readSettings(he.HandlerEnvironment.ConfigFolder); err != nil {
+			lg.eventError("failed to read the protected settings, only credentials are redacted", err)
+		}
+	}
+	r := diagnosticReport{ExtensionVersion: DetailedVersionString(), Distro: distroVerdict()}
+
+	if heErr != nil {
+		r.HandlerEnvironment.Error = heErr.Error()
+		r.SeqNum.CurrentError = "handler environment unavailable"
+		r.Status.Error = "handler environment unavailable"
+	} else {
+		r.HandlerEnvironment = handlerEnvReport{
+			HeartbeatFile: he.HandlerEnvironment.HeartbeatFile,
+			StatusFolder:  he.HandlerEnvironment.StatusFolder,
+			ConfigFolder:  he.HandlerEnvironment.ConfigFolder,
+			LogFolder:     he.HandlerEnvironment.LogFolder,
+		}
+		seq, err := vmextension.FindSeqNum(he.HandlerEnvironment.ConfigFolder)
+		if err != nil {
+			r.SeqNum.CurrentError = err.Error()
+		} else {
+			r.SeqNum.Current = seq
+			r.Status = diagnoseStatusFile(he.HandlerEnvironment.StatusFolder, seq)
+		}
+	}
+
+	mrseq, err := ioutil.ReadFile(filepath.Join(DataDir, MostRecentSequence))
+	if err != nil {
+		r.SeqNum.MrSeqError = err.Error()
+	} else {
+		r.SeqNum.MostRecent = strings.TrimSpace(string(mrseq))
+	}
+
+	_, agentDirectory := getAgentPaths()
+	r.Agent = diagnoseAgent(AgentZipDir, agentDirectory)
+	r.ScriptOutput = diagnoseScriptOutput(latestScriptOutputDir())
+	r.Telemetry = checkDirWritable(telemetryEventsPath)
+
+	if p, err := exec.LookPath("openssl"); err == nil {
+		r.OpenSSL = binaryReport{Path: p, Present: true}
+	}
+
+	lg.event("collected diagnostics")
+	return r
+}
+
+// diagnoseAgent reports the packaged agent version and whether the unzipped
+// agent directory contains every lifecycle script with execute permissions.
+func diagnoseAgent(zipDir, agentDirectory string) agentReport {
+	r := agentReport{Directory: agentDirectory}
+
+	if agentZip, err := findAgentZip(zipDir, AgentName); err != nil {
+		r.Error = errors.Wrap(err, "failed to find agent package").Error()
+	} else {
+		r.Package = agentZip
+		r.Version, _ = versionFromPackageName(agentZip)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(DataDir, AgentVersionFile)); err == nil {
+		r.InstalledVersion = strings.TrimSpace(string(b))
+	}
+
+	if fi, err := os.Stat(agentDirectory); err != nil || !fi.IsDir() {
+		return r
+	}
+	r.Installed = true
+	for _, s := range agentScripts {
+		fi, err := os.Stat(filepath.Join(agentDirectory, s))
+		if err != nil {
+			r.MissingScripts = append(r.MissingScripts, s)
+		} else if fi.Mode()&0100 == 0 {
+			r.NonExecutable = append(r.NonExecutable, s)
+		}
+	}
+	return r
+}
+
+// diagnoseStatusFile returns the redacted status file for seqNum, or the most
+// recent status file in statusFolder if that one does not exist.
+func diagnoseStatusFile(statusFolder string, seqNum int) statusFileReport {
+	path := filepath.Join(statusFolder, fmt.Sprintf("%d.status", seqNum))
+	if _, err := os.Stat(path); err != nil {
+		matches, _ := filepath.Glob(filepath.Join(statusFolder, "*.status"))
+		latest := -1
+		for _, m := range matches {
+			n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(m), ".status"))
+			if err == nil && n > latest {
+				latest, path = n, m
+			}
+		}
+		if latest < 0 {
+			return statusFileReport{Error: "no status file found in " + statusFolder}
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return statusFileReport{Path: path, Error: err.Error()}
+	}
+	return statusFileReport{Path: path, Content: secrets.String(string(b))}
+}
+
+// diagnoseScriptOutput returns the redacted tails of the stdout and stderr
+// files an agent script wrote in dir.
+func diagnoseScriptOutput(dir string) scriptOutputReport {
+	r := scriptOutputReport{Dir: dir}
+	if dir == "" {
+		r.Error = "no script output found"
+		return r
+	}
+	stdoutF, stderrF := logPaths(dir)
+	stdout, err := tailFile(stdoutF, maxTailLen)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	stderr, err := tailFile(stderrF, maxTailLen)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Stdout, r.Stderr = secrets.String(string(stdout)), secrets.String(string(stderr))
+	return r
+}
+
+// accessWriteOK is the W_OK mode of access(2).
+const accessWriteOK = 0x2
+
+// checkDirWritable verifies that dir exists and that files can be created in
+// it, by its permissions, without creating any.
+func checkDirWritable(dir string) writeCheckReport {
+	r := writeCheckReport{Path: dir}
+	if fi, err := os.Stat(dir); err != nil {
+		r.Error = err.Error()
+		return r
+	} else if !fi.IsDir() {
+		r.Error = dir + " is not a directory"
+		return r
+	}
+	if err := syscall.Access(dir, accessWriteOK); err != nil {
+		r.Error = "cannot write to " + dir + ": " + err.Error()
+		return r
+	}
+	r.Writable = true
+	return r
+}
+
+func writeDiagnosticsJSON(w io.Writer, r diagnosticReport) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal diagnostics")
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+func writeDiagnosticsText(w io.Writer, r diagnosticReport) error {
+	p := func(format string, a ...interface{}) { fmt.Fprintf(w, format+"\n", a...) }
+	orNone := func(s string) string {
+		if s == "" {
+			return "<none>"
+		}
+		return s
+	}
+
+	p("Extension: %s", r.ExtensionVersion)
+	p("Distribution: %s on %s (supported: %v, %s)", orNone(r.Distro.Distro.String()), r.Distro.Arch, r.Distro.Supported, r.Distro.Reason)
+
+	p("\n[Handler environment]")
+	if r.HandlerEnvironment.Error != "" {
+		p("  error: %s", r.HandlerEnvironment.Error)
+	} else {
+		p("  config folder:  %s", r.HandlerEnvironment.ConfigFolder)
+		p("  status folder:  %s", r.HandlerEnvironment.StatusFolder)
+		p("  log folder:     %s", r.HandlerEnvironment.LogFolder)
+		p("  heartbeat file: %s", orNone(r.HandlerEnvironment.HeartbeatFile))
+	}
+
+	p("\n[Sequence number]")
+	if r.SeqNum.CurrentError != "" {
+		p("  current: error: %s", r.SeqNum.CurrentError)
+	} else {
+		p("  current: %d", r.SeqNum.Current)
+	}
+	if r.SeqNum.MrSeqError != "" {
+		p("  %s: error: %s", MostRecentSequence, r.SeqNum.MrSeqError)
+	} else {
+		p("  %s: %s", MostRecentSequence, r.SeqNum.MostRecent)
+	}
+
+	p("\n[Agent]")
+	p("  package:   %s", orNone(r.Agent.Package))
+	p("  version:   %s (installed: %s)", orNone(r.Agent.Version), orNone(r.Agent.InstalledVersion))
+	p("  directory: %s (installed: %v)", r.Agent.Directory, r.Agent.Installed)
+	if len(r.Agent.MissingScripts) > 0 {
+		p("  missing scripts: %s", strings.Join(r.Agent.MissingScripts, ", "))
+	}
+	if len(r.Agent.NonExecutable) > 0 {
+		p("  non-executable scripts: %s", strings.Join(r.Agent.NonExecutable, ", "))
+	}
+	if r.Agent.Error != "" {
+		p("  error: %s", r.Agent.Error)
+	}
+
+	p("\n[Last status]")
+	if r.Status.Error != "" {
+		p("  error: %s", r.Status.Error)
+	} else {
+		p("  file: %s", r.Status.Path)
+		p("%s", r.Status.Content)
+	}
+
+	p("\n[Script output]")
+	if r.ScriptOutput.Error != "" {
+		p("  error: %s", r.ScriptOutput.Error)
+	}
+	p("  stdout:\n%s", r.ScriptOutput.Stdout)
+	p("  stderr:\n%s", r.ScriptOutput.Stderr)
+
+	p("\n[Telemetry]")
+	p("  events dir: %s (writable: %v)", r.Telemetry.Path, r.Telemetry.Writable)
+	if r.Telemetry.Error != "" {
+		p("  error: %s", r.Telemetry.Error)
+	}
+
+	p("\n[openssl]")
+	if r.OpenSSL.Present {
+		p("  found: %s", r.OpenSSL.Path)
+	} else {
+		p("  not found in PATH")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/redact"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_collectDiagnostics_noHandlerEnv(t *testing.T) {
+	r := collectDiagnostics(noopLogger, vmextension.HandlerEnvironment{}, errors.New("no handler env"))
+	require.Equal(t, "no handler env", r.HandlerEnvironment.Error)
+	require.NotEmpty(t, r.SeqNum.CurrentError)
+	require.NotEmpty(t, r.Status.Error)
+	require.Equal(t, telemetryEventsPath, r.Telemetry.Path)
+}
+
+func Test_collectDiagnostics_handlerEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "3.settings"), []byte{}, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "3.status"), []byte(`[]`), 0600))
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.ConfigFolder = dir
+	he.HandlerEnvironment.StatusFolder = dir
+	r := collectDiagnostics(noopLogger, he, nil)
+	require.Empty(t, r.HandlerEnvironment.Error)
+	require.Equal(t, 3, r.SeqNum.Current)
+	require.Equal(t, filepath.Join(dir, "3.status"), r.Status.Path)
+	require.Equal(t, `[]`, r.Status.Content)
+}
+
+func Test_diagnoseStatusFile_fallsBackToLatest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := diagnoseStatusFile(dir, 5)
+	require.Contains(t, r.Error, "no status file found")
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "2.status"), []byte("two"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "10.status"), []byte("ten"), 0600))
+	r = diagnoseStatusFile(dir, 5)
+	require.Empty(t, r.Error)
+	require.Equal(t, "ten", r.Content)
+}
+
+func Test_diagnoseAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	zipDir := filepath.Join(dir, "agent")
+	agentDir := filepath.Join(dir, "GC")
+	require.Nil(t, os.MkdirAll(zipDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(zipDir, "GC_1.9.0.zip"), []byte{}, 0644))
+
+	r := diagnoseAgent(zipDir, agentDir)
+	require.Equal(t, "1.9.0", r.Version)
+	require.False(t, r.Installed)
+
+	require.Nil(t, os.MkdirAll(agentDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(agentDir, "install.sh"), []byte{}, 0744))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(agentDir, "enable.sh"), []byte{}, 0644))
+	r = diagnoseAgent(zipDir, agentDir)
+	require.True(t, r.Installed)
+	require.Equal(t, []string{"update.sh", "disable.sh", "uninstall.sh"}, r.MissingScripts)
+	require.Equal(t, []string{"enable.sh"}, r.NonExecutable)
+}
+
+func Test_checkDirWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.True(t, checkDirWritable(dir).Writable)
+	files, _ := ioutil.ReadDir(dir)
+	require.Empty(t, files, "no file should be created")
+
+	r := checkDirWritable("/non-existing/dir")
+	require.False(t, r.Writable)
+	require.NotEmpty(t, r.Error)
+
+	file := filepath.Join(dir, "file")
+	require.Nil(t, ioutil.WriteFile(file, []byte{}, 0600))
+	r = checkDirWritable(file)
+	require.False(t, r.Writable)
+	require.Contains(t, r.Error, "is not a directory")
+}
+
+func Test_collectDiagnostics_redacts(t *testing.T) {
+	defer func() { secrets = redact.New() }()
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	secrets.Add("hunter2-protected")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "1.settings"), []byte{}, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "1.status"), []byte("failed with hunter2-protected"), 0600))
+	stdout, stderr := logPaths(dir)
+	require.Nil(t, ioutil.WriteFile(stdout, []byte("token hunter2-protected"), 0600))
+	require.Nil(t, ioutil.WriteFile(stderr, []byte("hunter2-protected"), 0600))
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.ConfigFolder = dir
+	he.HandlerEnvironment.StatusFolder = dir
+	r := collectDiagnostics(noopLogger, he, nil)
+	require.Equal(t, "failed with <redacted>", r.Status.Content)
+	o := diagnoseScriptOutput(dir)
+	require.Equal(t, "token <redacted>", o.Stdout)
+	require.Equal(t, "<redacted>", o.Stderr)
+}
+
+func Test_handlerEnvError(t *testing.T) {
+	require.EqualError(t, handlerEnvError(vmextension.HandlerEnvironment{}), "failed to read the handler environment")
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.ConfigFolder = "/var/lib/waagent/ext/config"
+	require.Nil(t, handlerEnvError(he))
+}
+
+func Test_writeDiagnostics(t *testing.T) {
+	r := collectDiagnostics(noopLogger, vmextension.HandlerEnvironment{}, errors.New("no handler env"))
+
+	var b bytes.Buffer
+	require.Nil(t, writeDiagnosticsJSON(&b, r))
+	var parsed diagnosticReport
+	require.Nil(t, json.Unmarshal(b.Bytes(), &parsed))
+	require.Equal(t, r, parsed)
+
+	b.Reset()
+	require.Nil(t, writeDiagnosticsText(&b, r))
+	require.Contains(t, b.String(), "[Handler environment]")
+	require.Contains(t, b.String(), "error: no handler env")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/distro"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+// osRoot is the root of the filesystem the distribution detection and the
+// preflight checks look at.
+var osRoot = "/"
+
+// machineArch is the architecture of the machine in GOARCH names, which the
+// handler binary is built for, as the shim picks the binary by `uname -m`.
+var machineArch = runtime.GOARCH
+
+// distroVerdict checks the distribution and architecture of the machine
+// against the support matrix of the agent. A distribution that cannot be
+// identified is not supported.
+func distroVerdict() distro.Verdict {
+	info, err := distro.Detect(osRoot)
+	if err != nil {
+		return distro.Verdict{Arch: machineArch, Reason: err.Error()}
+	}
+	return distro.DefaultMatrix().Check(info, machineArch)
+}
+
+// checkDistro returns an error with unsupportedDistroCode if the agent does
+// not support the machine. As install reports no status otherwise, the
+// "unsupported" error status is saved here.
+func checkDistro(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int) error {
+	v := distroVerdict()
+	lg.customLog(logEvent, "distribution check", "distro", v.Distro.String(), "arch", v.Arch,
+		"supported", v.Supported, "reason", v.Reason)
+	if v.Supported {
+		return nil
+	}
+
+	telemetry(TelemetryScenario, "Unsupported distribution: "+v.Reason, false, 0)
+	saveStatus(lg, hEnv, seqNum, status.Error, "install", unsupportedDistroCode, "install failed: "+v.Reason, agentVersionSubstatus())
+	return newHandlerError(errors.New(v.Reason), categoryEnvironment, unsupportedDistroCode, "The Guest Configuration agent does not support this VM", false)
+}
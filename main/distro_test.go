@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+// withOSRelease points the distribution detection at a root containing the
+// given /etc/os-release content.
+func withOSRelease(t *testing.T, content string) func() {
+	root, err := ioutil.TempDir("", "root")
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "etc", "os-release"), []byte(content), 0644))
+	osRoot = root
+	return func() {
+		osRoot = "/"
+		os.RemoveAll(root)
+	}
+}
+
+func Test_checkDistro_supported(t *testing.T) {
+	defer withOSRelease(t, "ID=ubuntu\nVERSION_ID=\"18.04\"\n")()
+	defer func() { machineArch = runtime.GOARCH }()
+
+	// the bundle has handler binaries and agent packages for both
+	for _, arch := range []string{"amd64", "arm64"} {
+		machineArch = arch
+		require.Equal(t, arch, distroVerdict().Arch)
+		require.Nil(t, checkDistro(noopLogger, vmextension.HandlerEnvironment{}, 0), arch)
+	}
+}
+
+func Test_checkDistro_unsupportedArch(t *testing.T) {
+	defer withOSRelease(t, "ID=ubuntu\nVERSION_ID=\"18.04\"\n")()
+	defer func() { machineArch = runtime.GOARCH }()
+	machineArch = "s390x"
+
+	v := distroVerdict()
+	require.False(t, v.Supported)
+	require.Contains(t, v.Reason, "unsupported architecture s390x")
+}
+
+func Test_checkDistro_unsupportedWritesStatus(t *testing.T) {
+	defer withOSRelease(t, "ID=ubuntu\nVERSION_ID=\"12.04\"\n")()
+	statusDir, err := ioutil.TempDir("", "status")
+	require.Nil(t, err)
+	defer os.RemoveAll(statusDir)
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.StatusFolder = statusDir
+	err = checkDistro(noopLogger, he, 4)
+	require.NotNil(t, err)
+	require.Equal(t, unsupportedDistroCode, exitCode(err, installCode))
+
+	b, err := ioutil.ReadFile(filepath.Join(statusDir, "4.status"))
+	require.Nil(t, err)
+	var r status.Report
+	require.Nil(t, json.Unmarshal(b, &r))
+	require.Equal(t, "install", r[0].Status.Operation)
+	require.Equal(t, status.Error, r[0].Status.Status)
+	require.Equal(t, unsupportedDistroCode, r[0].Status.Code)
+	require.Contains(t, r[0].Status.FormattedMessage.Message, "install failed: unsupported ubuntu version 12.04")
+}
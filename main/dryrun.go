@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// plan holds the actions of the current command when running with -dry-run,
+// and is nil otherwise.
+var plan *actionPlan
+
+// actionPlan collects, in order, the actions a command would take instead of
+// taking them.
+type actionPlan struct {
+	actions []string
+}
+
+// dryRun returns true if the handler runs with -dry-run, in which case it must
+// not change the filesystem, seqnum files, status or telemetry.
+func dryRun() bool {
+	return plan != nil
+}
+
+// add records a planned action.
+func (p *actionPlan) add(format string, a ...interface{}) {
+	p.actions = append(p.actions, fmt.Sprintf(format, a...))
+}
+
+// print writes the numbered list of planned actions to w.
+func (p *actionPlan) print(w io.Writer) {
+	fmt.Fprintln(w, "Dry run, planned actions:")
+	if len(p.actions) == 0 {
+		fmt.Fprintln(w, "  (none)")
+	}
+	for i, a := range p.actions {
+		fmt.Fprintf(w, "  %d. %s\n", i+1, a)
+	}
+}
+
+// planAgentInstall records the extraction of the agent package found in
+// source into dest and the permission changes on its scripts, without
+// extracting anything.
+func planAgentInstall(source, prefix, dest string) error {
+	agentZip, err := findAgentZip(source, prefix)
+	if err != nil {
+		return err
+	}
+	r, err := zip.OpenReader(agentZip)
+	if err != nil {
+		return errors.New("failed to open zip: " + agentZip)
+	}
+	defer r.Close()
+
+	_, agentDir := getAgentPaths()
+	var scripts []string
+	rx := regexp.MustCompile(".*\\.sh")
+	for _, f := range r.File {
+		fpath := filepath.Join(dest, f.Name)
+		if filepath.Dir(fpath) == filepath.Clean(agentDir) && rx.MatchString(f.Name) {
+			scripts = append(scripts, fpath)
+		}
+	}
+
+	plan.add("extract %s (%d entries) to %s", agentZip, len(r.File), dest)
+	plan.add("chmod 0744 %s", strings.Join(scripts, " "))
+	return nil
+}
+
+// planScript records running cmd in dir with the environment the script gets.
+func planScript(cmd, dir string, sc scriptContext) {
+	plan.add("run %q in %s with %s and env:\n      %s", cmd, dir, sc.Limits, strings.Join(scriptEnv(sc), "\n      "))
+}
+
+// planStatus records writing a status file.
+func planStatus(statusFolder string, seqNum int, t string, code int, msg string) {
+	plan.add("write %s status to %s: %q (code %d)", t, filepath.Join(statusFolder, fmt.Sprintf("%d.status", seqNum)), msg, code)
+}
+
+// printPlan prints the planned actions to stdout when running with -dry-run.
+func printPlan() {
+	if dryRun() {
+		plan.print(secrets.Writer(os.Stdout))
+	}
+}
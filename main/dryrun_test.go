@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+// withDryRun runs f with a fresh plan and returns the planned actions.
+func withDryRun(f func()) []string {
+	plan = &actionPlan{}
+	defer func() { plan = nil }()
+	f()
+	return plan.actions
+}
+
+// writeTestZip creates a zip archive at path with the given file names.
+func writeTestZip(t *testing.T, path string, names ...string) {
+	f, err := os.Create(path)
+	require.Nil(t, err)
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, n := range names {
+		fw, err := w.Create(n)
+		require.Nil(t, err)
+		fw.Write([]byte("#!/bin/sh\n"))
+	}
+	require.Nil(t, w.Close())
+}
+
+func Test_dryRun_doesNotSaveSeqNum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "mrseq")
+
+	actions := withDryRun(func() {
+		shouldExit, err := checkAndSaveSeqNum(noopLogger, 3, fp)
+		require.Nil(t, err)
+		require.False(t, shouldExit)
+	})
+	require.Equal(t, []string{"save sequence number 3 to " + fp}, actions)
+	require.False(t, fileExists(t, fp), "seqnum file must not be written")
+}
+
+func Test_dryRun_doesNotWriteStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeEnv := vmextension.HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = dir
+	actions := withDryRun(func() {
+		require.Nil(t, reportStatus(noopLogger, fakeEnv, 1, status.Success, cmdEnable, 0, ""))
+	})
+	require.Len(t, actions, 1)
+	require.Contains(t, actions[0], "write success status to "+filepath.Join(dir, "1.status"))
+	require.False(t, fileExists(t, filepath.Join(dir, "1.status")), "status file must not be written")
+}
+
+func Test_dryRun_doesNotRunScripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	actions := withDryRun(func() {
+		_, err := runCmd(noopLogger, "touch ran", dir, scriptContext{OutputDir: dir}, handlerSettings{})
+		require.Nil(t, err)
+	})
+	require.Len(t, actions, 1)
+	require.Contains(t, actions[0], `run "touch ran" in `+dir)
+	require.False(t, fileExists(t, filepath.Join(dir, "ran")), "script must not run")
+	require.False(t, fileExists(t, filepath.Join(dir, "stdout")), "output files must not be created")
+}
+
+func Test_planAgentInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTestZip(t, filepath.Join(dir, "GC_1.0.0.zip"), "GC/install.sh", "GC/enable.sh", "GC/lib/helper.sh", "GC/README")
+
+	unzipDir, agentDir := getAgentPaths()
+	actions := withDryRun(func() {
+		require.Nil(t, planAgentInstall(dir, AgentName, unzipDir))
+	})
+	require.Equal(t, []string{
+		"extract " + filepath.Join(dir, "GC_1.0.0.zip") + " (4 entries) to " + unzipDir,
+		"chmod 0744 " + filepath.Join(agentDir, "install.sh") + " " + filepath.Join(agentDir, "enable.sh"),
+	}, actions)
+	require.False(t, fileExists(t, unzipDir), "agent must not be extracted")
+
+	withDryRun(func() {
+		require.NotNil(t, planAgentInstall(dir, "missing", unzipDir))
+	})
+}
+
+func Test_actionPlan_print(t *testing.T) {
+	var b bytes.Buffer
+	(&actionPlan{}).print(&b)
+	require.Equal(t, "Dry run, planned actions:\n  (none)\n", b.String())
+
+	b.Reset()
+	p := &actionPlan{}
+	p.add("first %d", 1)
+	p.add("second")
+	p.print(&b)
+	require.Equal(t, "Dry run, planned actions:\n  1. first 1\n  2. second\n", b.String())
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// errorCategory tells who has to act on an error, which separates customer
+// misconfiguration from failures of the extension itself.
+type errorCategory string
+
+const (
+	// categoryUserConfig errors are caused by invalid extension settings.
+	categoryUserConfig errorCategory = "UserConfiguration"
+	// categoryPlatform errors are failures of the extension handler or the
+	// guest agent. Errors without a category are platform errors.
+	categoryPlatform errorCategory = "Platform"
+	// categoryAgentScript errors are failures of the scripts or the service of
+	// the Guest Configuration agent.
+	categoryAgentScript errorCategory = "AgentScript"
+	// categoryPackageIntegrity errors are caused by a missing, malformed or
+	// corrupt agent package.
+	categoryPackageIntegrity errorCategory = "PackageIntegrity"
+	// categoryEnvironment errors are caused by a VM that does not meet the
+	// requirements of the agent.
+	categoryEnvironment errorCategory = "Environment"
+)
+
+// handlerError is an error that ends the operation with a specific code, which
+// is used as exit code and status code, and a message for the user.
+type handlerError struct {
+	error
+	category  errorCategory
+	code      int
+	message   string // user facing description, the error has the details
+	retryable bool   // whether retrying may succeed without changes by the user
+}
+
+// newHandlerError attaches the category, code, user facing message and
+// retryable flag to err.
+func newHandlerError(err error, category errorCategory, code int, message string, retryable bool) error {
+	return handlerError{err, category, code, message, retryable}
+}
+
+// errorReport is how an error is reported in exit code, status and telemetry.
+type errorReport struct {
+	Category  errorCategory
+	Code      int
+	Message   string
+	Retryable bool
+}
+
+// describeError returns the report for err. Errors without a category are
+// reported as retryable platform errors with the fallback code.
+func describeError(err error, fallback int) errorReport {
+	e, ok := errors.Cause(err).(handlerError)
+	if !ok {
+		return errorReport{categoryPlatform, fallback, err.Error(), true}
+	}
+	msg := err.Error()
+	if e.message != "" {
+		msg = e.message + ": " + msg
+	}
+	return errorReport{e.category, e.code, msg, e.retryable}
+}
+
+// telemetryParameters returns the error report as telemetry event parameters.
+func (r errorReport) telemetryParameters() []interface{} {
+	return []interface{}{
+		telemetryParameterString{Name: "ErrorCategory", Value: string(r.Category)},
+		telemetryParameterLong{Name: "ErrorCode", Value: int64(r.Code)},
+		telemetryParameterBool{Name: "Retryable", Value: r.Retryable},
+	}
+}
+
+// exitCode returns the code of the handler error in err, or fallback. No
+// error is successCode.
+func exitCode(err error, fallback int) int {
+	if err == nil {
+		return successCode
+	}
+	return describeError(err, fallback).Code
+}
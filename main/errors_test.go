@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_exitCode(t *testing.T) {
+	require.Equal(t, successCode, exitCode(nil, enableCode))
+	require.Equal(t, enableCode, exitCode(errors.New("plain"), enableCode))
+
+	err := errors.Wrap(newHandlerError(errors.New("crashed"), categoryAgentScript, agentHealthCheckFailedCode, "", true), "enable")
+	require.Equal(t, agentHealthCheckFailedCode, exitCode(err, enableCode))
+	require.Equal(t, "enable: crashed", err.Error())
+}
+
+func Test_describeError(t *testing.T) {
+	r := describeError(errors.New("disk full"), enableCode)
+	require.Equal(t, errorReport{categoryPlatform, enableCode, "disk full", true}, r, "unclassified errors are ours")
+
+	err := errors.Wrap(invalidSettings(errors.New("additionalProperty foo not allowed")), "failed to get configuration")
+	r = describeError(err, enableCode)
+	require.Equal(t, errorReport{
+		Category:  categoryUserConfig,
+		Code:      invalidSettingsCode,
+		Message:   "The extension settings are invalid: failed to get configuration: additionalProperty foo not allowed",
+		Retryable: false,
+	}, r)
+
+	r = describeError(agentScriptFailed(errors.New("exit status 1"), "Enabling the agent failed"), enableCode)
+	require.Equal(t, categoryAgentScript, r.Category)
+	require.Equal(t, agentScriptFailedCode, r.Code)
+	require.True(t, r.Retryable)
+
+	r = describeError(invalidAgentPackage(errors.New("no zip")), enableCode)
+	require.Equal(t, categoryPackageIntegrity, r.Category)
+	require.Equal(t, invalidAgentPackageCode, r.Code)
+}
+
+func Test_errorReport_telemetryParameters(t *testing.T) {
+	r := errorReport{categoryEnvironment, unsupportedDistroCode, "unsupported", false}
+	b, err := json.Marshal(r.telemetryParameters())
+	require.Nil(t, err)
+	require.JSONEq(t, `[
+		{"name": "ErrorCategory", "value": "Environment"},
+		{"name": "ErrorCode", "value": 51},
+		{"name": "Retryable", "value": false}
+	]`, string(b))
+}
@@ -6,31 +6,75 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/Azure/Guest-Configuration-Extension/pkg/output"
 	"github.com/pkg/errors"
-	"strconv"
 )
 
-// Exec runs the given cmd in /bin/sh, saves its stdout/stderr streams to
-// the specified files. It waits until the execution terminates.
+const (
+	// scriptOutputHeadSize and scriptOutputTailSize cap the stdout and stderr
+	// files of a script run to their first and last bytes
+	scriptOutputHeadSize = 512 * 1024
+	scriptOutputTailSize = 512 * 1024
+
+	// keptScriptRuns is the number of sequence numbers whose script output is
+	// kept under DataDir
+	keptScriptRuns = 10
+)
+
+// Exec runs the given cmd in /bin/sh with the environment and the limits of
+// the script context, saves its stdout/stderr streams to the specified files.
+// It waits until the execution terminates, or kills it with all its child
+// processes when the timeout of the script context expires.
 //
 // On error, an exit code may be returned if it is an exit code error.
 // Given stdout and stderr will be closed upon returning.
-func Exec(lg ExtensionLogger, cmd, workdir string, stdout, stderr io.WriteCloser) (int, error) {
+func Exec(lg ExtensionLogger, cmd, workdir string, sc scriptContext, stdout, stderr io.WriteCloser) (int, error) {
 	defer stdout.Close()
 	defer stderr.Close()
 
-	c := exec.Command("/bin/sh", "-c", cmd)
+	cred, err := scriptCredential(sc.Limits.User)
+	if err != nil {
+		return 0, newHandlerError(err, categoryUserConfig, invalidSettingsCode, "The script user is not available", false)
+	}
+	m := detectLimitMethod(sc.Limits.User)
+	lg.customLog(logEvent, "script limits", "operation", sc.Operation, "limits", sc.Limits.String(), "method", m.String())
+
+	c := exec.Command("/bin/sh", "-c", limitedCommand(cmd, sc.Limits, m))
 	c.Dir = workdir
+	c.Env = scriptEnv(sc) // never the environment of the handler
 	c.Stdout = stdout
 	c.Stderr = stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Credential: cred, Setpgid: sc.Timeout > 0}
 
-	err := c.Run()
+	var timedOut int32
+	if err = c.Start(); err == nil {
+		if sc.Timeout > 0 {
+			timer := time.AfterFunc(sc.Timeout, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+			})
+			defer timer.Stop()
+		}
+		err = c.Wait()
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		lg.event("command timed out after " + sc.Timeout.String())
+		return -1, fmt.Errorf("command timed out after %s", sc.Timeout)
+	}
 
 	exitErr, ok := err.(*exec.ExitError)
 	if ok {
 		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				// like a CPU time limit exceeded
+				lg.event("command killed by signal: " + status.Signal().String())
+				return -1, fmt.Errorf("command terminated by signal %s", status.Signal())
+			}
 			code := status.ExitStatus()
 			telemetry(TelemetryScenario, "command exit code: "+strconv.Itoa(code), ok, 0)
 			lg.event("command exited with: " + strconv.Itoa(code))
@@ -40,29 +84,103 @@ func Exec(lg ExtensionLogger, cmd, workdir string, stdout, stderr io.WriteCloser
 	return 0, errors.Wrapf(err, "failed to execute command")
 }
 
-// ExecCmdInDir executes the given command in given directory and saves output
-// to ./stdout and ./stderr files (truncates files if exists, creates them if not
-// with 0600/-rw------- permissions).
-//
-// Ideally, we execute commands only once per sequence number in custom-script-extension,
-// and save their output under /var/lib/waagent/<dir>/download/<seqnum>/*.
-func ExecCmdInDir(lg ExtensionLogger, cmd, workdir string) (int, error) {
-	outFn, errFn := logPaths(workdir)
+// ExecCmdInDir executes the given command in given directory with the
+// environment of the script context and saves output to stdout and stderr
+// files in its OutputDir (truncates files if exists, creates them if not with
+// 0600/-rw------- permissions). The command writes to the files directly, so
+// that processes it leaves running in the background, like a daemon, do not
+// keep it from returning. After the command exits, each file keeps only the
+// head and the tail of a large output, and every line is mirrored into the
+// handler log, which echoes it to the console with -verbose.
+func ExecCmdInDir(lg ExtensionLogger, cmd, workdir string, sc scriptContext) (int, error) {
+	outDir := sc.OutputDir
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return 0, errors.Wrap(err, "failed to create output dir")
+	}
+	outFn, errFn := logPaths(outDir)
 
-	outF, err := os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	outF, err := output.Create(outFn)
 	if err != nil {
 		return 0, errors.Wrapf(err, "failed to open stdout file")
 	}
-	errF, err := os.OpenFile(errFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	errF, err := output.Create(errFn)
 	if err != nil {
+		outF.Close()
 		return 0, errors.Wrapf(err, "failed to open stderr file")
 	}
 
-	code, execErr := Exec(lg, cmd, workdir, outF, errF)
+	code, execErr := Exec(lg, cmd, workdir, sc, outF, errF)
 
+	run := filepath.Join(filepath.Base(filepath.Dir(outDir)), filepath.Base(outDir))
+	mirrorOutput(lg, outFn, run+" stdout")
+	mirrorOutput(lg, errFn, run+" stderr")
 	return code, execErr
 }
 
+// mirrorOutput caps the script output file at path to its head and tail, and
+// logs each of its lines with the prefix.
+func mirrorOutput(lg ExtensionLogger, path, prefix string) {
+	if _, err := output.Cap(path, scriptOutputHeadSize, scriptOutputTailSize); err != nil {
+		lg.eventError("failed to cap script output", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		lg.eventError("failed to mirror script output", err)
+		return
+	}
+	defer f.Close()
+	w := output.NewLineWriter(logLine(lg, prefix), scriptOutputHeadSize)
+	io.Copy(w, f)
+	w.Close()
+}
+
+// logLine returns a function logging a line of script output with the prefix.
+func logLine(lg ExtensionLogger, prefix string) func(string) {
+	return func(line string) {
+		lg.event("[" + prefix + "] " + line)
+	}
+}
+
+// scriptOutputDir returns the directory for the output of the script of the
+// operation run for the sequence number.
+func scriptOutputDir(seqNum int, operation string) string {
+	return filepath.Join(DataDir, strconv.Itoa(seqNum), operation)
+}
+
+// pruneScriptOutput removes the script output of all but the keptScriptRuns
+// most recent sequence numbers.
+func pruneScriptOutput(lg ExtensionLogger) {
+	removed, err := output.Prune(DataDir, keptScriptRuns)
+	if err != nil {
+		lg.eventError("failed to prune script output", err)
+	}
+	for _, r := range removed {
+		lg.customLog(logEvent, "pruned script output", logOutput, r)
+	}
+}
+
+// latestScriptOutputDir returns the output directory of the most recent
+// script run, or "" if there is none.
+func latestScriptOutputDir() string {
+	runs, err := output.Runs(DataDir)
+	if err != nil || len(runs) == 0 {
+		return ""
+	}
+	dirs, _ := filepath.Glob(filepath.Join(DataDir, strconv.Itoa(runs[len(runs)-1]), "*"))
+	var latest string
+	var latestTime int64
+	for _, d := range dirs {
+		stdout, _ := logPaths(d)
+		if _, err := os.Stat(stdout); err != nil {
+			continue // hook directories have a directory per hook
+		}
+		if fi, err := os.Stat(d); err == nil && fi.ModTime().UnixNano() >= latestTime {
+			latest, latestTime = d, fi.ModTime().UnixNano()
+		}
+	}
+	return latest
+}
+
 // logPaths returns stdout and stderr file paths for the specified output
 // directory. It does not create the files.
 func logPaths(dir string) (stdout string, stderr string) {
@@ -6,14 +6,18 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestExec_success(t *testing.T) {
 	v := new(mockFile)
-	ec, err := Exec(noopLogger, "date", "/", v, v)
+	ec, err := Exec(noopLogger, "date", "/", scriptContext{}, v, v)
 	require.Nil(t, err, "err: %v -- out: %s", err, v.b.Bytes())
 	require.EqualValues(t, 0, ec)
 }
@@ -23,7 +27,7 @@ func TestExec_success_redirectsStdStreams_closesFds(t *testing.T) {
 	require.False(t, o.closed, "stdout open")
 	require.False(t, e.closed, "stderr open")
 
-	_, err := Exec(noopLogger, "/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2", "/", o, e)
+	_, err := Exec(noopLogger, "/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2", "/", scriptContext{}, o, e)
 	require.Nil(t, err, "err: %v -- stderr: %s", err, e.b.Bytes())
 	require.Equal(t, "I am stdout!\n", string(o.b.Bytes()))
 	require.Equal(t, "I am stderr!\n", string(e.b.Bytes()))
@@ -32,14 +36,14 @@ func TestExec_success_redirectsStdStreams_closesFds(t *testing.T) {
 }
 
 func TestExec_failure_exitError(t *testing.T) {
-	ec, err := Exec(noopLogger, "exit 12", "/", new(mockFile), new(mockFile))
+	ec, err := Exec(noopLogger, "exit 12", "/", scriptContext{}, new(mockFile), new(mockFile))
 	require.NotNil(t, err)
 	require.EqualError(t, err, "command terminated with exit status=12") // error is customized
 	require.EqualValues(t, 12, ec)
 }
 
 func TestExec_failure_genericError(t *testing.T) {
-	_, err := Exec(noopLogger, "date", "/non-existing-path", new(mockFile), new(mockFile))
+	_, err := Exec(noopLogger, "date", "/non-existing-path", scriptContext{}, new(mockFile), new(mockFile))
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "failed to execute command:") // error is wrapped
 }
@@ -48,7 +52,7 @@ func TestExec_failure_fdClosed(t *testing.T) {
 	out := new(mockFile)
 	require.Nil(t, out.Close())
 
-	_, err := Exec(noopLogger, "date", "/", out, out)
+	_, err := Exec(noopLogger, "date", "/", scriptContext{}, out, out)
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "file closed") // error is wrapped
 }
@@ -58,7 +62,7 @@ func TestExec_failure_redirectsStdStreams_closesFds(t *testing.T) {
 	require.False(t, o.closed, "stdout open")
 	require.False(t, e.closed, "stderr open")
 
-	_, err := Exec(noopLogger, `/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2; exit 12`, "/", o, e)
+	_, err := Exec(noopLogger, `/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2; exit 12`, "/", scriptContext{}, o, e)
 	require.NotNil(t, err)
 	require.Equal(t, "I am stdout!\n", string(o.b.Bytes()))
 	require.Equal(t, "I am stderr!\n", string(e.b.Bytes()))
@@ -71,7 +75,7 @@ func TestExecCmdInDir(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	_, err = ExecCmdInDir(noopLogger, "/bin/echo 'Hello world'", dir)
+	_, err = ExecCmdInDir(noopLogger, "/bin/echo 'Hello world'", dir, scriptContext{OutputDir: dir})
 	require.Nil(t, err)
 	require.True(t, fileExists(t, filepath.Join(dir, "stdout")), "stdout file should be created")
 	require.True(t, fileExists(t, filepath.Join(dir, "stderr")), "stderr file should be created")
@@ -86,8 +90,59 @@ func TestExecCmdInDir(t *testing.T) {
 }
 
 func TestExecCmdInDir_cantOpenError(t *testing.T) {
-	_, err := ExecCmdInDir(noopLogger, "/bin/echo 'Hello world'", "/non-existing-dir")
-	require.Contains(t, err.Error(), "failed to open stdout file")
+	_, err := ExecCmdInDir(noopLogger, "/bin/echo 'Hello world'", "/", scriptContext{OutputDir: "/dev/null/out"})
+	require.Contains(t, err.Error(), "failed to create output dir")
+}
+
+func TestExecCmdInDir_outputPerRun(t *testing.T) {
+	defer inTempDir(t)()
+	_, agentDir := getAgentPaths()
+	require.Nil(t, os.MkdirAll(agentDir, 0755))
+
+	_, err := ExecCmdInDir(noopLogger, "/bin/echo installed", agentDir, scriptContext{OutputDir: scriptOutputDir(3, "install")})
+	require.Nil(t, err)
+	_, err = ExecCmdInDir(noopLogger, "/bin/echo enabled; /bin/echo oops >&2", agentDir, scriptContext{OutputDir: scriptOutputDir(3, "enable")})
+	require.Nil(t, err)
+
+	for f, want := range map[string]string{
+		"3/install/stdout": "installed\n",
+		"3/install/stderr": "",
+		"3/enable/stdout":  "enabled\n",
+		"3/enable/stderr":  "oops\n",
+	} {
+		b, err := ioutil.ReadFile(f)
+		require.Nil(t, err)
+		require.Equal(t, want, string(b), f)
+	}
+	require.Equal(t, scriptOutputDir(3, "enable"), latestScriptOutputDir())
+}
+
+func TestExecCmdInDir_capsOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// 2 MB of output keeps the head and the tail
+	_, err = ExecCmdInDir(noopLogger, "/bin/echo first; head -c 2097152 /dev/zero | tr '\\0' x; /bin/echo; /bin/echo last", dir, scriptContext{OutputDir: dir})
+	require.Nil(t, err)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.True(t, len(b) < scriptOutputHeadSize+scriptOutputTailSize+100, "size %d", len(b))
+	require.True(t, strings.HasPrefix(string(b), "first\n"))
+	require.True(t, strings.HasSuffix(string(b), "x\nlast\n"))
+	require.Contains(t, string(b), "bytes omitted ...]")
+}
+
+func Test_pruneScriptOutput(t *testing.T) {
+	defer inTempDir(t)()
+	for i := 1; i <= keptScriptRuns+2; i++ {
+		require.Nil(t, os.MkdirAll(scriptOutputDir(i, "enable"), 0700))
+	}
+	pruneScriptOutput(noopLogger)
+	require.False(t, fileExists(t, "1"))
+	require.False(t, fileExists(t, "2"))
+	require.True(t, fileExists(t, "3"))
+	require.True(t, fileExists(t, scriptOutputDir(keptScriptRuns+2, "enable")))
 }
 
 func TestExecCmdInDir_truncates(t *testing.T) {
@@ -95,9 +150,9 @@ func TestExecCmdInDir_truncates(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	_, err = ExecCmdInDir(noopLogger, "/bin/echo '1:out'; /bin/echo '1:err'>&2", dir)
+	_, err = ExecCmdInDir(noopLogger, "/bin/echo '1:out'; /bin/echo '1:err'>&2", dir, scriptContext{OutputDir: dir})
 	require.Nil(t, err)
-	_, err = ExecCmdInDir(noopLogger, "/bin/echo '2:out'; /bin/echo '2:err'>&2", dir)
+	_, err = ExecCmdInDir(noopLogger, "/bin/echo '2:out'; /bin/echo '2:err'>&2", dir, scriptContext{OutputDir: dir})
 	require.Nil(t, err)
 
 	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
@@ -109,6 +164,52 @@ func TestExecCmdInDir_truncates(t *testing.T) {
 	require.Equal(t, "2:err\n", string(b), "stderr did not truncate")
 }
 
+func TestExecCmdInDir_backgroundProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// like a script starting a daemon, which inherits stdout and stderr
+	begin := time.Now()
+	_, err = ExecCmdInDir(noopLogger, "/bin/echo started; sleep 30 & /bin/echo $! > pid", dir, scriptContext{OutputDir: dir})
+	require.Nil(t, err)
+	require.True(t, time.Since(begin) < 10*time.Second, "the background process does not block")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pid"))
+	require.Nil(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	require.Nil(t, err)
+	syscall.Kill(pid, syscall.SIGKILL)
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "started\n", string(b))
+}
+
+func Test_mirrorOutput(t *testing.T) {
+	out := captureLog()
+	defer resetLog()
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stdout")
+	require.Nil(t, ioutil.WriteFile(path, []byte("hello\nworld"), 0600))
+
+	mirrorOutput(noopLogger, path, "3/enable stdout")
+	require.Contains(t, out.String(), "[3/enable stdout] hello\n")
+	require.Contains(t, out.String(), "[3/enable stdout] world\n")
+
+	mirrorOutput(noopLogger, filepath.Join(dir, "missing"), "3/enable stderr")
+	require.Contains(t, out.String(), "failed to mirror script output")
+}
+
+func Test_logLine(t *testing.T) {
+	out := captureLog()
+	defer resetLog()
+	logLine(noopLogger, "3/enable stdout")("hello")
+	require.Contains(t, out.String(), "[3/enable stdout] hello\n")
+}
+
 func Test_logPaths(t *testing.T) {
 	stdout, stderr := logPaths("/tmp")
 	require.Equal(t, "/tmp/stdout", stdout)
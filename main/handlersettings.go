@@ -70,10 +70,13 @@ func (s handlerSettings) validate() error {
 // publicSettings is the type deserialized from public configuration section of
 // the extension handler. This should be in sync with publicSettingsSchema.
 type publicSettings struct {
-	SkipDos2Unix     bool     `json:"skipDos2Unix"`
-	CommandToExecute string   `json:"commandToExecute"`
-	Script           string   `json:"script"`
-	FileURLs         []string `json:"fileUris"`
+	SkipDos2Unix          bool     `json:"skipDos2Unix"`
+	CommandToExecute      string   `json:"commandToExecute"`
+	Script                string   `json:"script"`
+	FileURLs              []string `json:"fileUris"`
+	RemoveLogsOnUninstall bool     `json:"removeLogsOnUninstall"`
+
+	ScriptLimits map[string]scriptLimits `json:"scriptLimits"`
 }
 
 // protectedSettings is the type decoded and deserialized from protected
@@ -89,6 +92,7 @@ type protectedSettings struct {
 // parseAndValidateSettings reads configuration from configFolder, decrypts it,
 // runs JSON-schema and logical validation on it and returns it back.
 func parseAndValidateSettings(configFolder string) (h handlerSettings, _ error) {
+	defer lg.step("parse settings")()
 	lg.event("reading configuration")
 	pubJSON, protJSON, err := readSettings(configFolder)
 	if err != nil {
@@ -98,29 +102,35 @@ func parseAndValidateSettings(configFolder string) (h handlerSettings, _ error)
 
 	lg.event("validating json schema")
 	if err := validateSettingsSchema(pubJSON, protJSON); err != nil {
-		return h, errors.Wrap(err, "json validation error")
+		return h, invalidSettings(errors.Wrap(err, "json validation error"))
 	}
 	lg.event("json schema valid")
 
 	lg.event("parsing configuration json")
 	if err := vmextension.UnmarshalHandlerSettings(pubJSON, protJSON, &h.publicSettings, &h.protectedSettings); err != nil {
-		return h, errors.Wrap(err, "json parsing error")
+		return h, invalidSettings(errors.Wrap(err, "json parsing error"))
 	}
 	lg.event("parsed configuration json")
 
 	lg.event("validating configuration logically")
 	if err := h.validate(); err != nil {
-		return h, errors.Wrap(err, "invalid configuration")
+		return h, invalidSettings(errors.Wrap(err, "invalid configuration"))
 	}
 	lg.event("validated configuration")
 	return h, nil
 }
 
+// invalidSettings marks err as a user configuration error.
+func invalidSettings(err error) error {
+	return newHandlerError(err, categoryUserConfig, invalidSettingsCode, "The extension settings are invalid", false)
+}
+
 // readSettings uses specified configFolder (comes from HandlerEnvironment) to
 // decrypt and parse the public/protected settings of the extension handler into
 // JSON objects.
 func readSettings(configFolder string) (pubSettingsJSON, protSettingsJSON map[string]interface{}, err error) {
-	pubSettingsJSON, protSettingsJSON, err = vmextension.ReadSettings(configFolder)
+	pubSettingsJSON, protSettingsJSON, err = readSettingsFile(configFolder)
+	secrets.AddValues(protSettingsJSON)
 	err = errors.Wrapf(err, "error reading extension configuration")
 	return
 }
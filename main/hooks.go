@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+const (
+	// hooksConfigFileName is the optional configuration of the hooks, in
+	// JSON, in the hooks config dir: defaultHooksDir, or hooksDirEnv if set.
+	// The guest agent does not pass its environment on to the handler, so
+	// hooksDirEnv is meant for tests.
+	hooksConfigFileName = "hooks.json"
+	hooksDirEnv         = "GC_EXTENSION_HOOKS_DIR"
+	defaultHooksDir     = "/etc/azure/guest-configuration-extension"
+
+	// defaultHookTimeout is how long a hook may run unless configured.
+	defaultHookTimeout = 5 * time.Minute
+
+	hookPre  = "pre"
+	hookPost = "post"
+
+	substatusPreHooks  = "PreHooks"
+	substatusPostHooks = "PostHooks"
+)
+
+// hookNameRegex matches the hooks the timeouts of the hooks configuration are
+// set for, like enable.pre.d/10-cmdb.
+var hookNameRegex = regexp.MustCompile(`^[a-z]+\.(pre|post)\.d/[^/]+$`)
+
+// hooksConfig is the configuration of the hooks in hooksConfigFileName.
+type hooksConfig struct {
+	// Dir is the directory of the hooks/<operation>.<phase>.d directories,
+	// the hooks config dir if not set.
+	Dir string `json:"dir,omitempty"`
+
+	// TimeoutSeconds is how long every hook may run, defaultHookTimeout if
+	// not set.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+
+	// HookTimeoutSeconds replaces TimeoutSeconds for single hooks, by
+	// "<operation>.<phase>.d/<hook>".
+	HookTimeoutSeconds map[string]int `json:"hookTimeoutSeconds,omitempty"`
+}
+
+// hooksConfigDir returns the directory of the hooks configuration.
+func hooksConfigDir() string {
+	if d := os.Getenv(hooksDirEnv); d != "" {
+		return d
+	}
+	return defaultHooksDir
+}
+
+// readHooksConfig reads the hooks configuration from dir. Without a
+// configuration file the defaults apply. Like the hooks, the file and dir must
+// pass checkHookOwner.
+func readHooksConfig(dir string) (hooksConfig, error) {
+	c := hooksConfig{Dir: dir}
+	path := filepath.Join(dir, hooksConfigFileName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return c, errors.Wrap(err, "failed to open the hooks configuration")
+	}
+	defer f.Close()
+	for _, p := range []string{dir, path} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return c, errors.Wrap(err, "failed to check the hooks configuration")
+		}
+		if err := checkHookOwner(p, fi); err != nil {
+			return c, errors.Wrap(err, "refusing the hooks configuration")
+		}
+	}
+
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return c, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	if c.Dir == "" {
+		c.Dir = dir
+	} else if !filepath.IsAbs(c.Dir) {
+		return c, errors.Errorf("%s: dir %q is not an absolute path", path, c.Dir)
+	}
+	if c.TimeoutSeconds < 0 {
+		return c, errors.Errorf("%s: timeoutSeconds %d is negative", path, c.TimeoutSeconds)
+	}
+	for h, sec := range c.HookTimeoutSeconds {
+		if !hookNameRegex.MatchString(h) {
+			return c, errors.Errorf("%s: hookTimeoutSeconds has %q, not <operation>.<pre|post>.d/<hook>", path, h)
+		}
+		if sec <= 0 {
+			return c, errors.Errorf("%s: hookTimeoutSeconds of %s is not positive", path, h)
+		}
+	}
+	return c, nil
+}
+
+// timeout returns how long the hook in phaseDir may run.
+func (c hooksConfig) timeout(phaseDir, hook string) time.Duration {
+	if s, ok := c.HookTimeoutSeconds[phaseDir+"/"+hook]; ok {
+		return time.Duration(s) * time.Second
+	}
+	if c.TimeoutSeconds > 0 {
+		return time.Duration(c.TimeoutSeconds) * time.Second
+	}
+	return defaultHookTimeout
+}
+
+// checkHookOwner returns an error unless the file or directory path, with
+// the file info fi, is owned by root and not writable by group or others, as
+// hooks run as root.
+func checkHookOwner(path string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 {
+		return errors.Errorf("%s is not owned by root", path)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return errors.Errorf("%s is writable by group or others", path)
+	}
+	return nil
+}
+
+// findHooks returns the names of the executable files in
+// <base>/hooks/<phaseDir>, in lexical order, and why the other files that
+// would be hooks were refused. Hidden files are skipped, and a missing
+// directory has no hooks. The directories and hooks must pass
+// checkHookOwner; an error is returned if a directory does not.
+func findHooks(base, phaseDir string) (hooks, refused []string, err error) {
+	dir := base
+	for _, d := range []string{"", "hooks", phaseDir} {
+		dir = filepath.Join(dir, d)
+		fi, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		} else if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to check the hooks directory")
+		}
+		if err := checkHookOwner(dir, fi); err != nil {
+			return nil, nil, errors.Wrap(err, "refusing to run hooks")
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list hooks")
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		fi, err := os.Stat(path) // follows symlinks
+		if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		if err := checkHookOwner(path, fi); err != nil {
+			refused = append(refused, err.Error())
+			continue
+		}
+		hooks = append(hooks, f.Name())
+	}
+	return hooks, refused, nil
+}
+
+// runHooks runs the hooks of the phase of the operation, found in
+// hooks/<operation>.<phase>.d of the configured dir, with the environment of
+// the agent scripts, their configured timeout and their output saved to
+// <seqnum>/<operation>.<phase>.d/<hook>. Hooks refused by findHooks, or all
+// hooks if the configuration is refused or invalid, do not run and are
+// reported as a warning. Pre hooks stop at the
+// first failure, which is returned to abort the operation. All post hooks
+// run, and their failures are returned too, but post hooks cannot fail the
+// operation: the caller only logs the error, which is reported as a warning.
+func runHooks(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int, operation, phase string) error {
+	phaseDir := operation + "." + phase + ".d"
+	name, failType := substatusPreHooks, status.Error
+	if phase == hookPost {
+		name, failType = substatusPostHooks, status.Warning
+	}
+
+	conf, err := readHooksConfig(hooksConfigDir())
+	dir := filepath.Join(conf.Dir, "hooks", phaseDir)
+	var hooks, refused []string
+	if err == nil {
+		hooks, refused, err = findHooks(conf.Dir, phaseDir)
+	}
+	if err != nil {
+		refused = append(refused, err.Error())
+	}
+	refusedMsg := ""
+	if len(refused) > 0 {
+		refusedMsg = "refused " + strings.Join(refused, "; ")
+		lg.customLog(logEvent, "refused hooks", logError, strings.Join(refused, "; "))
+	}
+	// withRefused appends the refused hooks to the substatus message msg.
+	withRefused := func(msg string) string {
+		if refusedMsg == "" {
+			return msg
+		}
+		return msg + "; " + refusedMsg
+	}
+	if len(hooks) == 0 {
+		if refusedMsg != "" {
+			addSubstatus(name, status.Warning, hookFailedCode, refusedMsg)
+		}
+		return nil
+	}
+	defer lg.step(phase + " hooks")()
+
+	var ran, failed []string
+	for _, h := range hooks {
+		sc := newScriptContext(hEnv, seqNum, operation)
+		sc.OutputDir = filepath.Join(DataDir, strconv.Itoa(seqNum), phaseDir, h)
+		sc.Timeout = conf.timeout(phaseDir, h)
+		path := filepath.Join(dir, h)
+
+		lg.customLog(logEvent, "running hook", "hook", path, "timeout", sc.Timeout)
+		if dryRun() {
+			planScript(shellQuote(path), dir, sc)
+			continue
+		}
+		_, err := ExecCmdInDir(lg, shellQuote(path), dir, sc)
+		if err == nil {
+			ran = append(ran, h)
+			continue
+		}
+		lg.customLog(logEvent, "hook failed", "hook", path, logError, err)
+		telemetry(TelemetryScenario, phase+" hook "+h+" failed: "+err.Error(), false, 0)
+		failed = append(failed, h+": "+err.Error())
+		if phase == hookPre {
+			addSubstatus(name, failType, hookFailedCode, withRefused("failed "+strings.Join(failed, "; ")))
+			return newHandlerError(errors.Wrapf(err, "pre hook %s", path), categoryUserConfig, hookFailedCode,
+				"A pre hook of the "+operation+" operation failed", true)
+		}
+	}
+
+	if len(failed) > 0 {
+		addSubstatus(name, failType, hookFailedCode, withRefused("failed "+strings.Join(failed, "; ")))
+		return errors.Errorf("%s hooks of the %s operation failed: %s", phase, operation, strings.Join(failed, "; "))
+	}
+	if refusedMsg != "" {
+		addSubstatus(name, status.Warning, hookFailedCode, withRefused("ran "+strings.Join(ran, ", ")))
+	} else if len(ran) > 0 {
+		addSubstatus(name, status.Success, 0, "ran "+strings.Join(ran, ", "))
+	}
+	return nil
+}
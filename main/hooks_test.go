@@ -0,0 +1,305 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+// withHooks points the hooks directory at a temp dir and writes the hook
+// scripts, by "<operation>.<phase>.d/<name>", to it.
+func withHooks(t *testing.T, hooks map[string]string) func() {
+	skipUnlessRoot(t)
+	dir, err := ioutil.TempDir("", "hooks")
+	require.Nil(t, err)
+	for name, script := range hooks {
+		p := filepath.Join(dir, "hooks", name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.Nil(t, ioutil.WriteFile(p, []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	}
+	os.Setenv(hooksDirEnv, dir)
+	return func() {
+		os.Unsetenv(hooksDirEnv)
+		os.RemoveAll(dir)
+		substatus = nil
+	}
+}
+
+// skipUnlessRoot skips the test unless it runs as root, which must own the
+// hooks.
+func skipUnlessRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("hooks must be owned by root")
+	}
+}
+
+func Test_findHooks(t *testing.T) {
+	skipUnlessRoot(t)
+	base, err := ioutil.TempDir("", "hooks")
+	require.Nil(t, err)
+	defer os.RemoveAll(base)
+
+	hooks, refused, err := findHooks(base, "enable.pre.d")
+	require.Nil(t, err)
+	require.Empty(t, hooks)
+	require.Empty(t, refused)
+
+	dir := filepath.Join(base, "hooks", "enable.pre.d")
+	require.Nil(t, os.MkdirAll(dir, 0755))
+
+	for name, mode := range map[string]os.FileMode{"20-selinux": 0755, "10-cmdb": 0700, "README": 0644, ".hidden": 0755} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), nil, mode))
+	}
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "30-dir"), 0755))
+	require.Nil(t, os.Symlink(filepath.Join(dir, "10-cmdb"), filepath.Join(dir, "15-link")))
+
+	hooks, refused, err = findHooks(base, "enable.pre.d")
+	require.Nil(t, err)
+	require.Equal(t, []string{"10-cmdb", "15-link", "20-selinux"}, hooks)
+	require.Empty(t, refused)
+}
+
+func Test_findHooks_refusesWritableByOthers(t *testing.T) {
+	skipUnlessRoot(t)
+	base, err := ioutil.TempDir("", "hooks")
+	require.Nil(t, err)
+	defer os.RemoveAll(base)
+	dir := filepath.Join(base, "hooks", "enable.pre.d")
+	require.Nil(t, os.MkdirAll(dir, 0755))
+
+	for name, mode := range map[string]os.FileMode{"10-ok": 0755, "20-world": 0757, "30-group": 0775} {
+		p := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(p, nil, 0700))
+		require.Nil(t, os.Chmod(p, mode)) // not masked by the umask
+	}
+	require.Nil(t, os.Symlink(filepath.Join(dir, "20-world"), filepath.Join(dir, "40-link")))
+
+	hooks, refused, err := findHooks(base, "enable.pre.d")
+	require.Nil(t, err)
+	require.Equal(t, []string{"10-ok"}, hooks)
+	require.Len(t, refused, 3)
+	require.Contains(t, refused[0], "20-world is writable by group or others")
+	require.Contains(t, refused[1], "30-group is writable by group or others")
+	require.Contains(t, refused[2], "40-link is writable by group or others", "the symlink target is checked")
+
+	for _, d := range []string{base, filepath.Join(base, "hooks"), dir} {
+		require.Nil(t, os.Chmod(d, 0777))
+		hooks, _, err = findHooks(base, "enable.pre.d")
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "refusing to run hooks: "+d+" is writable by group or others")
+		require.Empty(t, hooks)
+		require.Nil(t, os.Chmod(d, 0755))
+	}
+}
+
+func Test_findHooks_refusesNotOwnedByRoot(t *testing.T) {
+	skipUnlessRoot(t)
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	require.Nil(t, err)
+
+	base, err := ioutil.TempDir("", "hooks")
+	require.Nil(t, err)
+	defer os.RemoveAll(base)
+	dir := filepath.Join(base, "hooks", "enable.pre.d")
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "10-nobody"), nil, 0755))
+	require.Nil(t, os.Chown(filepath.Join(dir, "10-nobody"), uid, -1))
+
+	hooks, refused, err := findHooks(base, "enable.pre.d")
+	require.Nil(t, err)
+	require.Empty(t, hooks)
+	require.Equal(t, []string{filepath.Join(dir, "10-nobody") + " is not owned by root"}, refused)
+
+	require.Nil(t, os.Chown(dir, uid, -1))
+	_, _, err = findHooks(base, "enable.pre.d")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), dir+" is not owned by root")
+}
+
+func Test_runHooks_refusedHooksWarn(t *testing.T) {
+	defer inTempDir(t)()
+	defer withHooks(t, map[string]string{
+		"enable.pre.d/10-ok":       `echo ok >> "$GC_DATA_DIR/ran"`,
+		"enable.pre.d/20-writable": `echo writable >> "$GC_DATA_DIR/ran"`,
+	})()
+	require.Nil(t, os.Chmod(filepath.Join(os.Getenv(hooksDirEnv), "hooks", "enable.pre.d", "20-writable"), 0777))
+
+	require.Nil(t, runHooks(noopLogger, vmextension.HandlerEnvironment{}, 1, "enable", hookPre))
+	b, err := ioutil.ReadFile("ran")
+	require.Nil(t, err)
+	require.Equal(t, "ok\n", string(b), "a refused hook does not run")
+	require.Len(t, substatus, 1)
+	require.Equal(t, status.Warning, substatus[0].Status)
+	require.Contains(t, substatus[0].FormattedMessage.Message, "ran 10-ok; refused ")
+	require.Contains(t, substatus[0].FormattedMessage.Message, "20-writable is writable by group or others")
+}
+
+func Test_runHooks_preFailureAborts(t *testing.T) {
+	defer inTempDir(t)()
+	defer withHooks(t, map[string]string{
+		"enable.pre.d/10-first":  `echo "$GC_OPERATION $GC_SEQNUM"; echo first >> "$GC_DATA_DIR/ran"`,
+		"enable.pre.d/20-fails":  `echo broken >&2; exit 3`,
+		"enable.pre.d/30-never":  `echo never >> "$GC_DATA_DIR/ran"`,
+		"disable.pre.d/10-other": `echo other >> "$GC_DATA_DIR/ran"`,
+	})()
+
+	err := runHooks(noopLogger, vmextension.HandlerEnvironment{}, 5, "enable", hookPre)
+	require.NotNil(t, err)
+	require.Equal(t, hookFailedCode, exitCode(err, enableCode))
+	require.Contains(t, describeError(err, enableCode).Message, "A pre hook of the enable operation failed")
+	require.Contains(t, err.Error(), "20-fails")
+
+	b, err := ioutil.ReadFile("ran")
+	require.Nil(t, err)
+	require.Equal(t, "first\n", string(b), "hooks run in order and stop at the failure")
+
+	b, err = ioutil.ReadFile("5/enable.pre.d/10-first/stdout")
+	require.Nil(t, err)
+	require.Equal(t, "enable 5\n", string(b), "same environment as the agent scripts")
+	b, err = ioutil.ReadFile("5/enable.pre.d/20-fails/stderr")
+	require.Nil(t, err)
+	require.Equal(t, "broken\n", string(b))
+
+	require.Len(t, substatus, 1)
+	require.Equal(t, substatusPreHooks, substatus[0].Name)
+	require.Equal(t, status.Error, substatus[0].Status)
+	require.Contains(t, substatus[0].FormattedMessage.Message, "20-fails: command terminated with exit status=3")
+}
+
+func Test_runHooks_postFailureWarns(t *testing.T) {
+	defer inTempDir(t)()
+	defer withHooks(t, map[string]string{
+		"enable.post.d/10-fails": `exit 1`,
+		"enable.post.d/20-runs":  `echo runs > "$GC_DATA_DIR/ran"`,
+	})()
+
+	err := runHooks(noopLogger, vmextension.HandlerEnvironment{}, 1, "enable", hookPost)
+	require.NotNil(t, err, "returned to be logged")
+	require.Contains(t, err.Error(), "post hooks of the enable operation failed: 10-fails")
+	require.True(t, fileExists(t, "ran"), "all post hooks run")
+	require.Len(t, substatus, 1)
+	require.Equal(t, substatusPostHooks, substatus[0].Name)
+	require.Equal(t, status.Warning, substatus[0].Status)
+}
+
+func Test_runHooks_success(t *testing.T) {
+	defer inTempDir(t)()
+	defer withHooks(t, map[string]string{"install.pre.d/10-ok": "true", "install.pre.d/20-ok": "true"})()
+
+	require.Nil(t, runHooks(noopLogger, vmextension.HandlerEnvironment{}, 0, "install", hookPre))
+	require.Nil(t, runHooks(noopLogger, vmextension.HandlerEnvironment{}, 0, "install", hookPost), "no post hooks")
+	require.Len(t, substatus, 1)
+	require.Equal(t, "ran 10-ok, 20-ok", substatus[0].FormattedMessage.Message)
+}
+
+func Test_runHooks_timeout(t *testing.T) {
+	defer inTempDir(t)()
+	defer withHooks(t, map[string]string{
+		"enable.pre.d/10-hangs": "sleep 30 & sleep 30",
+		"enable.pre.d/20-never": `touch "$GC_DATA_DIR/ran"`,
+	})()
+	writeHooksConfig(t, `{"timeoutSeconds": 60, "hookTimeoutSeconds": {"enable.pre.d/10-hangs": 1}}`)
+
+	begin := time.Now()
+	err := runHooks(noopLogger, vmextension.HandlerEnvironment{}, 1, "enable", hookPre)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "command timed out after 1s")
+	require.True(t, time.Since(begin) < 10*time.Second, "the hook and its children are killed")
+	require.False(t, fileExists(t, "ran"))
+}
+
+func Test_runHooks_dryRun(t *testing.T) {
+	defer inTempDir(t)()
+	defer withHooks(t, map[string]string{"enable.pre.d/10-hook": `touch "$GC_DATA_DIR/ran"`})()
+
+	actions := withDryRun(func() {
+		require.Nil(t, runHooks(noopLogger, vmextension.HandlerEnvironment{}, 1, "enable", hookPre))
+	})
+	require.Len(t, actions, 1)
+	require.Contains(t, actions[0], "10-hook")
+	require.False(t, fileExists(t, "ran"))
+}
+
+// writeHooksConfig writes the hooks configuration to the hooks dir of
+// withHooks.
+func writeHooksConfig(t *testing.T, config string) string {
+	path := filepath.Join(os.Getenv(hooksDirEnv), hooksConfigFileName)
+	require.Nil(t, ioutil.WriteFile(path, []byte(config), 0644))
+	return path
+}
+
+func Test_readHooksConfig(t *testing.T) {
+	defer withHooks(t, nil)()
+	dir := os.Getenv(hooksDirEnv)
+
+	c, err := readHooksConfig(dir)
+	require.Nil(t, err, "no configuration")
+	require.Equal(t, hooksConfig{Dir: dir}, c)
+	require.Equal(t, defaultHookTimeout, c.timeout("enable.pre.d", "10-cmdb"))
+
+	writeHooksConfig(t, `{"dir": "/opt/hooks", "timeoutSeconds": 60, "hookTimeoutSeconds": {"enable.pre.d/10-cmdb": 600}}`)
+	c, err = readHooksConfig(dir)
+	require.Nil(t, err)
+	require.Equal(t, "/opt/hooks", c.Dir)
+	require.Equal(t, 600*time.Second, c.timeout("enable.pre.d", "10-cmdb"), "per hook")
+	require.Equal(t, 60*time.Second, c.timeout("enable.post.d", "10-cmdb"))
+
+	for config, msg := range map[string]string{
+		`{"dir": "hooks"}`:                                    `dir "hooks" is not an absolute path`,
+		`{"timeoutSeconds": -1}`:                              "timeoutSeconds -1 is negative",
+		`{"hookTimeoutSeconds": {"10-cmdb": 60}}`:             `hookTimeoutSeconds has "10-cmdb"`,
+		`{"hookTimeoutSeconds": {"enable.pre.d/10-cmdb": 0}}`: "hookTimeoutSeconds of enable.pre.d/10-cmdb is not positive",
+		`{"timeout": 60}`:                                     `unknown field "timeout"`,
+		`not json`:                                            "failed to parse",
+	} {
+		writeHooksConfig(t, config)
+		_, err = readHooksConfig(dir)
+		require.NotNil(t, err, config)
+		require.Contains(t, err.Error(), msg)
+	}
+
+	path := writeHooksConfig(t, `{}`)
+	require.Nil(t, os.Chmod(path, 0666))
+	_, err = readHooksConfig(dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "refusing the hooks configuration: "+path+" is writable by group or others")
+}
+
+func Test_runHooks_configuredDir(t *testing.T) {
+	defer inTempDir(t)()
+	other, err := ioutil.TempDir("", "hooks")
+	require.Nil(t, err)
+	defer os.RemoveAll(other)
+	p := filepath.Join(other, "hooks", "enable.pre.d", "10-ok")
+	require.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+	require.Nil(t, ioutil.WriteFile(p, []byte("#!/bin/sh\ntouch \"$GC_DATA_DIR/ran\"\n"), 0755))
+
+	defer withHooks(t, nil)()
+	writeHooksConfig(t, `{"dir": "`+other+`"}`)
+	require.Nil(t, runHooks(noopLogger, vmextension.HandlerEnvironment{}, 1, "enable", hookPre))
+	require.True(t, fileExists(t, "ran"))
+}
+
+func Test_runHooks_invalidConfigRunsNoHooks(t *testing.T) {
+	defer inTempDir(t)()
+	defer withHooks(t, map[string]string{"enable.pre.d/10-hook": `touch "$GC_DATA_DIR/ran"`})()
+	writeHooksConfig(t, `{"timeoutSeconds": "60"}`)
+
+	require.Nil(t, runHooks(noopLogger, vmextension.HandlerEnvironment{}, 1, "enable", hookPre))
+	require.False(t, fileExists(t, "ran"))
+	require.Len(t, substatus, 1)
+	require.Equal(t, status.Warning, substatus[0].Status)
+	require.Contains(t, substatus[0].FormattedMessage.Message, "refused failed to parse")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// scriptLimits are the resource limits and the user an agent script runs
+// with. Zero values mean no limit, normal priority and root.
+type scriptLimits struct {
+	MaxMemoryMB   int    `json:"maxMemoryMB"`
+	MaxOpenFiles  int    `json:"maxOpenFiles"`
+	MaxCPUSeconds int    `json:"maxCpuSeconds"`
+	Nice          int    `json:"nice"`
+	IOClass       string `json:"ioClass"` // "best-effort" (lowest priority), "idle" or "" for the default
+	User          string `json:"user"`
+}
+
+const (
+	ioClassBestEffort = "best-effort"
+	ioClassIdle       = "idle"
+)
+
+// limitsFor returns the limits of the scripts of the operation in the
+// settings. Without settings, scripts run without limits as root: an address
+// space limit in particular kills runtimes that reserve a lot of virtual
+// memory, so limits are only applied when asked for.
+func (s publicSettings) limitsFor(operation string) scriptLimits {
+	return s.ScriptLimits[operation]
+}
+
+func (l scriptLimits) String() string {
+	limit := func(v int, unit string) string {
+		if v == 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(v) + unit
+	}
+	io := l.IOClass
+	if io == "" {
+		io = "default"
+	}
+	u := l.User
+	if u == "" {
+		u = "root"
+	}
+	return fmt.Sprintf("memory %s, open files %s, cpu time %s, nice %d, io class %s, user %s",
+		limit(l.MaxMemoryMB, " MB"), limit(l.MaxOpenFiles, ""), limit(l.MaxCPUSeconds, " s"), l.Nice, io, u)
+}
+
+// systemdRunPath is systemd-run, used to limit the memory of scripts run as
+// root in a scope.
+var systemdRunPath = "systemd-run"
+
+// limitMethod is how the limits are applied on the machine.
+type limitMethod struct {
+	scope  bool // limit memory with a systemd-run scope instead of an address space rlimit
+	ionice bool // ionice is available
+}
+
+func (m limitMethod) String() string {
+	if m.scope {
+		return "rlimits and systemd-run scope"
+	}
+	return "rlimits"
+}
+
+// detectLimitMethod returns how limits can be applied to scripts run as the
+// user. Only root can create scopes.
+func detectLimitMethod(user string) limitMethod {
+	var m limitMethod
+	if _, err := exec.LookPath("ionice"); err == nil {
+		m.ionice = true
+	}
+	if user != "" {
+		return m
+	}
+	if _, err := os.Stat(filepath.Join(osRoot, "run/systemd/system")); err != nil {
+		return m
+	}
+	if _, err := exec.LookPath(systemdRunPath); err == nil {
+		m.scope = true
+	}
+	return m
+}
+
+// limitedCommand returns the shell command running cmd with the limits: open
+// files, CPU time and, without scope, the address space are limited with
+// ulimit, the memory of a scope with MemoryMax. nice and ionice lower the
+// priority. Without limits, cmd is returned as is.
+func limitedCommand(cmd string, l scriptLimits, m limitMethod) string {
+	var pre, wrap []string
+	if l.MaxOpenFiles > 0 {
+		pre = append(pre, fmt.Sprintf("ulimit -n %d", l.MaxOpenFiles))
+	}
+	if l.MaxCPUSeconds > 0 {
+		pre = append(pre, fmt.Sprintf("ulimit -t %d", l.MaxCPUSeconds))
+	}
+	if l.MaxMemoryMB > 0 {
+		if m.scope {
+			wrap = append(wrap, fmt.Sprintf("%s --scope --quiet -p MemoryMax=%dM", systemdRunPath, l.MaxMemoryMB))
+		} else {
+			pre = append(pre, fmt.Sprintf("ulimit -v %d", l.MaxMemoryMB*1024))
+		}
+	}
+	if l.Nice > 0 {
+		wrap = append(wrap, fmt.Sprintf("nice -n %d", l.Nice))
+	}
+	if m.ionice {
+		switch l.IOClass {
+		case ioClassBestEffort:
+			wrap = append(wrap, "ionice -c 2 -n 7")
+		case ioClassIdle:
+			wrap = append(wrap, "ionice -c 3")
+		}
+	}
+	if len(pre) == 0 && len(wrap) == 0 {
+		return cmd
+	}
+	s := ""
+	for _, p := range pre {
+		s += p + "; "
+	}
+	return s + "exec " + strings.Join(append(wrap, "/bin/sh -c "+shellQuote(cmd)), " ")
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// scriptCredential returns the credential to run scripts as the user, or nil
+// for root.
+func scriptCredential(name string) (*syscall.Credential, error) {
+	if name == "" || name == "root" {
+		return nil, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up script user %s", name)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid uid of script user %s", name)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid gid of script user %s", name)
+	}
+	c := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, _ := u.GroupIds()
+	for _, g := range groups {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			c.Groups = append(c.Groups, uint32(id))
+		}
+	}
+	return c, nil
+}
+
+// scriptUserEnv returns the HOME, USER and LOGNAME variables of the script
+// user from its passwd entry, which replace those of root passed on from the
+// handler environment. It returns nil for root, or if the user cannot be
+// looked up, which scriptCredential reports.
+func scriptUserEnv(name string) map[string]string {
+	if name == "" || name == "root" {
+		return nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil
+	}
+	return map[string]string{"HOME": u.HomeDir, "USER": u.Username, "LOGNAME": u.Username}
+}
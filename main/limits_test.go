@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"os/user"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_limitsFor(t *testing.T) {
+	var s publicSettings
+	require.Equal(t, scriptLimits{}, s.limitsFor("install"), "no limits by default")
+
+	require.Nil(t, json.Unmarshal([]byte(`{"scriptLimits": {"enable": {"maxMemoryMB": 256, "user": "gcagent"}}}`), &s))
+	require.Equal(t, scriptLimits{MaxMemoryMB: 256, User: "gcagent"}, s.limitsFor("enable"))
+	require.Equal(t, scriptLimits{}, s.limitsFor("install"))
+}
+
+func Test_scriptLimits_String(t *testing.T) {
+	require.Equal(t, "memory unlimited, open files unlimited, cpu time unlimited, nice 0, io class default, user root",
+		scriptLimits{}.String())
+	require.Equal(t, "memory 2048 MB, open files 4096, cpu time 1800 s, nice 10, io class best-effort, user root",
+		scriptLimits{MaxMemoryMB: 2048, MaxOpenFiles: 4096, MaxCPUSeconds: 1800, Nice: 10, IOClass: ioClassBestEffort}.String())
+}
+
+func Test_limitedCommand(t *testing.T) {
+	l := scriptLimits{MaxMemoryMB: 512, MaxOpenFiles: 1024, MaxCPUSeconds: 60, Nice: 5, IOClass: ioClassIdle}
+
+	require.Equal(t, "bash ./enable.sh", limitedCommand("bash ./enable.sh", scriptLimits{}, limitMethod{scope: true}))
+	require.Equal(t, "ulimit -n 1024; ulimit -t 60; ulimit -v 524288; exec nice -n 5 /bin/sh -c 'bash ./enable.sh'",
+		limitedCommand("bash ./enable.sh", l, limitMethod{}))
+	require.Equal(t, "ulimit -n 1024; ulimit -t 60; exec systemd-run --scope --quiet -p MemoryMax=512M nice -n 5 ionice -c 3 /bin/sh -c 'bash ./enable.sh'",
+		limitedCommand("bash ./enable.sh", l, limitMethod{scope: true, ionice: true}))
+	require.Equal(t, "exec ionice -c 2 -n 7 /bin/sh -c 'echo '\\''quoted'\\'''",
+		limitedCommand("echo 'quoted'", scriptLimits{IOClass: ioClassBestEffort}, limitMethod{ionice: true}))
+}
+
+func Test_Exec_appliesLimits(t *testing.T) {
+	systemdRunPath = "/non-existing/systemd-run"
+	defer func() { systemdRunPath = "systemd-run" }()
+
+	o, e := new(mockFile), new(mockFile)
+	sc := scriptContext{Limits: scriptLimits{MaxMemoryMB: 512, MaxOpenFiles: 256, MaxCPUSeconds: 30, Nice: 7}}
+	_, err := Exec(noopLogger, "ulimit -n; ulimit -t; ulimit -v; nice", "/", sc, o, e)
+	require.Nil(t, err, "stderr: %s", e.b.String())
+	require.Equal(t, []string{"256", "30", "524288", "7"}, strings.Fields(o.b.String()))
+}
+
+func Test_Exec_cpuLimitKills(t *testing.T) {
+	sc := scriptContext{Limits: scriptLimits{MaxCPUSeconds: 1}}
+	code, err := Exec(noopLogger, "while :; do :; done", "/", sc, new(mockFile), new(mockFile))
+	require.NotNil(t, err)
+	require.Equal(t, -1, code)
+	require.Contains(t, err.Error(), "command terminated by signal")
+}
+
+func Test_scriptCredential(t *testing.T) {
+	c, err := scriptCredential("")
+	require.Nil(t, err)
+	require.Nil(t, c)
+	c, err = scriptCredential("root")
+	require.Nil(t, err)
+	require.Nil(t, c)
+
+	_, err = scriptCredential("no-such-user-gc")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to look up script user no-such-user-gc")
+}
+
+func Test_Exec_asUser(t *testing.T) {
+	if u, err := user.Current(); err != nil || u.Uid != "0" {
+		t.Skip("running scripts as another user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	o := new(mockFile)
+	_, err = Exec(noopLogger, "id -u", "/", scriptContext{Limits: scriptLimits{User: "nobody"}}, o, new(mockFile))
+	require.Nil(t, err)
+	require.Equal(t, nobody.Uid, strings.TrimSpace(o.b.String()))
+
+	_, err = Exec(noopLogger, "id -u", "/", scriptContext{Limits: scriptLimits{User: "no-such-user-gc"}}, o, new(mockFile))
+	require.NotNil(t, err)
+	require.Equal(t, invalidSettingsCode, exitCode(err, enableCode))
+}
+
+func TestValidatePublicSettings_scriptLimits(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"scriptLimits": {"enable": {"maxMemoryMB": 256, "nice": 19, "ioClass": "idle", "user": "gcagent"}}}`))
+
+	err := validatePublicSettings(`{"scriptLimits": {"diagnose": {}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Additional property diagnose is not allowed")
+
+	err = validatePublicSettings(`{"scriptLimits": {"enable": {"nice": -5}}}`)
+	require.NotNil(t, err)
+
+	err = validatePublicSettings(`{"scriptLimits": {"enable": {"ioClass": "realtime"}}}`)
+	require.NotNil(t, err)
+}
@@ -1,83 +1,183 @@
 package main
 
 import (
-    "os"
-    "path"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
 
-    golog "log"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/redact"
+
+	golog "log"
 )
 
+// secrets redacts the protected settings and credentials from every log line,
+// status message and telemetry event. It learns the protected settings when
+// they are read.
+var secrets = redact.New()
+
 // ExtensionLogger for all the extension-related events
 type ExtensionLogger struct {
-    //logger      *logrus.Logger
-    logFilePath string
+	//logger      *logrus.Logger
+	logFilePath string
+	flags       flags
+	timings     *stepTimings
 }
 
 type NoopWriter struct{}
 
 func (n *NoopWriter) Write(p []byte) (int, error) {
-    return len(p), nil
+	return len(p), nil
 }
 
-// create a new ExtensionLogger
-func newLogger(logDir string) ExtensionLogger {
-        if err := os.MkdirAll(logDir, 0755); err != nil {
-        golog.Printf("ERROR: Cannot create log folder %s: %v \r\n", logDir, err)
-    }
-
-    extensionLogPath := path.Join(logDir, ExtensionHandlerLogFileName)
-    golog.Printf("Logging in file %s: in directory %s: .\r\n", ExtensionHandlerLogFileName, logDir)
-
-    fileHandle, err := os.OpenFile(extensionLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-    if err != nil {
-        golog.Fatalf("ERROR: Cannot open log file: %v \r\n", err)
-    }
+// stepTimings records how long each step of a command took, for the report
+// printed at the end of the command with -verbose.
+type stepTimings struct {
+	mu    sync.Mutex
+	start time.Time
+	steps []stepTiming
+}
 
-    // Create a new Logrus logger
-    // logger := logrus.New()
-    // logger.SetOutput(fileHandle) // Log to the file
-    // logger.SetLevel(logrus.InfoLevel)
+type stepTiming struct {
+	name    string
+	elapsed time.Duration
+}
 
-    // Redirect standard output and error to the log file
-    golog.SetOutput(fileHandle)
+// create a new ExtensionLogger
+func newLogger(logDir string, f flags) ExtensionLogger {
+	// a dry run must not change the filesystem, so it only logs to the console
+	if f.dryRun {
+		return newConsoleLogger(f, os.Stdout)
+	}
+
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		golog.Printf("ERROR: Cannot create log folder %s: %v \r\n", logDir, err)
+	}
+
+	extensionLogPath := path.Join(logDir, ExtensionHandlerLogFileName)
+	golog.Printf("Logging in file %s: in directory %s: .\r\n", ExtensionHandlerLogFileName, logDir)
+
+	fileHandle, err := os.OpenFile(extensionLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		golog.Fatalf("ERROR: Cannot open log file: %v \r\n", err)
+	}
+
+	// Create a new Logrus logger
+	// logger := logrus.New()
+	// logger.SetOutput(fileHandle) // Log to the file
+	// logger.SetLevel(logrus.InfoLevel)
+
+	// Redirect standard output and error to the log file, and echo to the
+	// console as well in verbose mode
+	var out io.Writer = fileHandle
+	if f.verbose {
+		out = io.MultiWriter(fileHandle, os.Stdout)
+	}
+	golog.SetOutput(secrets.Writer(out))
+	if f.debug {
+		golog.SetFlags(golog.LstdFlags | golog.Lmicroseconds | golog.Lshortfile)
+	}
+
+	// Return the ExtensionLogger
+	return ExtensionLogger{
+		logFilePath: extensionLogPath,
+		flags:       f,
+		timings:     &stepTimings{start: time.Now()},
+	}
+}
 
-    // Return the ExtensionLogger
-    return ExtensionLogger{logFilePath: extensionLogPath}
+// newConsoleLogger returns a logger that does not change the filesystem: it
+// logs to w with -verbose, and nowhere otherwise.
+func newConsoleLogger(f flags, w io.Writer) ExtensionLogger {
+	golog.SetOutput(ioutil.Discard)
+	if f.verbose {
+		golog.SetOutput(secrets.Writer(w))
+	}
+	return ExtensionLogger{flags: f, timings: &stepTimings{start: time.Now()}}
 }
 
 func newNoopLogger() ExtensionLogger {
-    return ExtensionLogger{logFilePath: ""}
+	return ExtensionLogger{logFilePath: ""}
 }
 
 // Add a key-value pair to the logger
 func (lg ExtensionLogger) with(key string, value string) {
-    //lg.logger.WithField(key, value).Info("")
-    golog.Printf("Added context: %s=%s\n", key, value)
+	//lg.logger.WithField(key, value).Info("")
+	golog.Printf("Added context: %s=%s\n", key, value)
 }
 
 // Log an event
 func (lg ExtensionLogger) event(event string) {
-    //lg.logger.Info(event)
-    golog.Println(event)
+	//lg.logger.Info(event)
+	golog.Println(event)
+}
+
+// Log a debug event, only when running with -debug
+func (lg ExtensionLogger) debugf(format string, args ...interface{}) {
+	if !lg.flags.debug {
+		return
+	}
+	golog.Printf("DEBUG: "+format+"\n", args...)
 }
 
-// Log an error event
+// Log an error event. With -debug, errors created or wrapped by pkg/errors
+// are logged with their stack trace.
 func (lg ExtensionLogger) eventError(event string, err error) {
-    //lg.logger.WithError(err).Error(event)
-    golog.Println("ERROR: %s: %v \r\n", event, err)
+	//lg.logger.WithError(err).Error(event)
+	if lg.flags.debug {
+		golog.Printf("ERROR: %s: %+v \r\n", event, err)
+		return
+	}
+	golog.Printf("ERROR: %s: %v \r\n", event, err)
 }
 
 // Log custom key-value pairs
 func (lg ExtensionLogger) customLog(keyvals ...interface{}) {
-    //fields := logrus.Fields{}
-    for i := 0; i < len(keyvals)-1; i += 2 {
-        key, ok := keyvals[i].(string)
-        if !ok {
-            continue
-        }
-        //fields[key] = keyvals[i+1]
-        golog.Printf("%s=%v ", key, keyvals[i+1])
-    }
-    //lg.logger.WithFields(fields).Info("Custom log")
-    golog.Println()
+	//fields := logrus.Fields{}
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			continue
+		}
+		//fields[key] = keyvals[i+1]
+		golog.Printf("%s=%v ", key, keyvals[i+1])
+	}
+	//lg.logger.WithFields(fields).Info("Custom log")
+	golog.Println()
+}
+
+// step starts timing the named step and returns the function that ends it:
+//
+//	defer lg.step("unzip agent")()
+func (lg ExtensionLogger) step(name string) func() {
+	begin := time.Now()
+	lg.debugf("step started: %s", name)
+	return func() {
+		elapsed := time.Since(begin)
+		lg.debugf("step finished: %s (%v)", name, elapsed)
+		if lg.timings == nil {
+			return
+		}
+		lg.timings.mu.Lock()
+		lg.timings.steps = append(lg.timings.steps, stepTiming{name, elapsed})
+		lg.timings.mu.Unlock()
+	}
+}
+
+// reportTimings logs the time taken by every recorded step when running with
+// -verbose.
+func (lg ExtensionLogger) reportTimings() {
+	if !lg.flags.verbose || lg.timings == nil {
+		return
+	}
+	lg.timings.mu.Lock()
+	defer lg.timings.mu.Unlock()
+
+	golog.Println("Timing report:")
+	for _, s := range lg.timings.steps {
+		golog.Printf("  %-40s %v\n", s.name, s.elapsed)
+	}
+	golog.Printf("  %-40s %v\n", "total", time.Since(lg.timings.start))
 }
@@ -1 +1,139 @@
 package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	golog "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/redact"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLog redirects the standard logger into a buffer for the duration of
+// the test.
+func captureLog() *bytes.Buffer {
+	var b bytes.Buffer
+	golog.SetOutput(&b)
+	return &b
+}
+
+func resetLog() { golog.SetOutput(os.Stderr) }
+
+func Test_debugf_onlyWithDebugFlag(t *testing.T) {
+	b := captureLog()
+	defer resetLog()
+
+	ExtensionLogger{}.debugf("hidden %d", 1)
+	require.NotContains(t, b.String(), "hidden")
+
+	ExtensionLogger{flags: flags{debug: true}}.debugf("shown %d", 2)
+	require.Contains(t, b.String(), "DEBUG: shown 2")
+}
+
+func Test_eventError_stackTraceWithDebugFlag(t *testing.T) {
+	b := captureLog()
+	defer resetLog()
+
+	err := errors.New("boom")
+	ExtensionLogger{}.eventError("failed", err)
+	require.Contains(t, b.String(), "ERROR: failed: boom")
+	require.NotContains(t, b.String(), "logger_test.go")
+
+	b.Reset()
+	ExtensionLogger{flags: flags{debug: true}}.eventError("failed", err)
+	require.Contains(t, b.String(), "ERROR: failed: boom")
+	require.Contains(t, b.String(), "logger_test.go", "stack trace is logged")
+}
+
+func Test_reportTimings(t *testing.T) {
+	b := captureLog()
+	defer resetLog()
+
+	lg := ExtensionLogger{timings: &stepTimings{}}
+	lg.step("quiet step")()
+	lg.reportTimings()
+	require.Empty(t, b.String(), "no report without -verbose")
+
+	lg.flags.verbose = true
+	lg.step("second step")()
+	lg.reportTimings()
+	require.Contains(t, b.String(), "Timing report:")
+	require.Contains(t, b.String(), "quiet step")
+	require.Contains(t, b.String(), "second step")
+	require.Contains(t, b.String(), "total")
+
+	// the noop logger does not record timings
+	noopLogger.step("noop")()
+	noopLogger.reportTimings()
+}
+
+func Test_secretsRedactedFromAllOutput(t *testing.T) {
+	defer inTempDir(t)()
+	defer resetLog()
+	defer func() { substatus = nil }()
+	defer func() { secrets = redact.New() }()
+
+	dir, configFolder := newTestExtensionDir(t)
+	defer os.RemoveAll(dir)
+	accountKey := strings.Repeat("k3Y/", 21) + "ab=="
+	command := "./install.sh --password Sup3r-S3cret"
+	sasURL := "https://a.blob.core.windows.net/c/agent.zip?sv=2020-08-04&sig=0a1B2c3D%3D"
+	protected := map[string]interface{}{
+		"commandToExecute":   command,
+		"fileUris":           []interface{}{sasURL},
+		"storageAccountName": "gcstorage",
+		"storageAccountKey":  accountKey,
+	}
+	thumbprint, cert := writeTestCert(t, dir)
+	writeTestSettings(t, configFolder, 0, thumbprint, cert, nil, protected)
+	_, _, err := readSettings(configFolder)
+	require.Nil(t, err)
+
+	logDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(logDir)
+	lg := newLogger(logDir, flags{})
+
+	events := &mockWriteCloser{buf: new(bytes.Buffer)}
+	oldTelemetry := telemetry
+	defer func() { telemetry = oldTelemetry }()
+	telemetry = sendTelemetry(newTelemetryEventSenderWithWriteCloser(events), "name", "1.0")
+
+	// a script printing the secrets is mirrored into the log and its output
+	// is sent to telemetry when it fails
+	require.NotNil(t, runResultScript(t, "echo '"+command+"'; echo "+accountKey+" >&2; exit 1"))
+	lg.eventError("download failed", errors.Errorf("GET %s: 403", sasURL))
+	lg.customLog("command", command, "key", "AccountName=x;AccountKey=another-key")
+	telemetry("enable", "failed with key "+accountKey, false, 0,
+		telemetryParameterString{Name: "Command", Value: command})
+
+	statusDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(statusDir)
+	var hEnv vmextension.HandlerEnvironment
+	hEnv.HandlerEnvironment.StatusFolder = statusDir
+	addSubstatus("Download", status.Error, 1, "GET "+sasURL)
+	require.Nil(t, saveStatus(lg, hEnv, 0, status.Error, "enable", 1, command+" failed"))
+
+	logged, err := ioutil.ReadFile(filepath.Join(logDir, ExtensionHandlerLogFileName))
+	require.Nil(t, err)
+	reported, err := ioutil.ReadFile(filepath.Join(statusDir, "0.status"))
+	require.Nil(t, err)
+	outputs := map[string]string{"log": string(logged), "status": string(reported), "telemetry": events.buf.String()}
+	unescape := strings.NewReplacer(`\u003c`, "<", `\u003e`, ">", `\u0026`, "&") // as escaped in JSON
+	for name, out := range outputs {
+		out = unescape.Replace(out)
+		require.Contains(t, out, redact.Placeholder, name)
+		for _, secret := range []string{"Sup3r-S3cret", accountKey, sasURL, "0a1B2c3D", "another-key"} {
+			require.NotContains(t, out, secret, name)
+		}
+	}
+	require.Contains(t, outputs["log"], "AccountKey=<redacted>")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+const (
+	// legacyLogsEnv set to "0" turns off the compatibility mode, in which the
+	// legacy log locations are kept as symlinks to the logs in LogFolder.
+	legacyLogsEnv = "GC_EXTENSION_LEGACY_LOGS"
+)
+
+// handlerLogDir returns the directory the handler logs to, which is the
+// LogFolder of the handler environment, or the legacy directory within the
+// extension directory if the handler environment has none.
+func handlerLogDir(hEnv vmextension.HandlerEnvironment) string {
+	if hEnv.HandlerEnvironment.LogFolder != "" {
+		return hEnv.HandlerEnvironment.LogFolder
+	}
+	return LegacyHandlerLogDir
+}
+
+// legacyLogCompat returns true if the legacy log locations should be kept as
+// symlinks to the logs in LogFolder.
+func legacyLogCompat() bool {
+	return os.Getenv(legacyLogsEnv) != "0"
+}
+
+// setupHandlerLog moves the handler log from the legacy directory into logDir
+// (only once, as the legacy file is replaced or removed afterwards) and, in
+// compatibility mode, links the legacy location to the new log file.
+func setupHandlerLog(legacyDir, logDir string) error {
+	if filepath.Clean(legacyDir) == filepath.Clean(logDir) {
+		return nil
+	}
+	legacy := filepath.Join(legacyDir, ExtensionHandlerLogFileName)
+	current := filepath.Join(logDir, ExtensionHandlerLogFileName)
+	if err := migrateLegacyLog(legacy, current); err != nil {
+		return err
+	}
+	if !legacyLogCompat() {
+		return nil
+	}
+	return linkLegacyLog(legacy, current)
+}
+
+// migrateLegacyLog moves the regular file at legacy to current. If current
+// already exists, the legacy content is put in front of it so the log stays in
+// chronological order. Symlinks and missing files are left alone.
+func migrateLegacyLog(legacy, current string) error {
+	fi, err := os.Lstat(legacy)
+	if os.IsNotExist(err) || (err == nil && !fi.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to check legacy log")
+	}
+	if err := os.MkdirAll(filepath.Dir(current), 0755); err != nil {
+		return errors.Wrap(err, "failed to create log folder")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(current), filepath.Base(current))
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary log file")
+	}
+	defer os.Remove(tmp.Name())
+	for _, src := range []string{legacy, current} {
+		if err := appendFile(tmp, src); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write temporary log file")
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrap(err, "failed to set log file permissions")
+	}
+	if err := os.Rename(tmp.Name(), current); err != nil {
+		return errors.Wrap(err, "failed to move legacy log")
+	}
+	return errors.Wrap(os.Remove(legacy), "failed to remove legacy log")
+}
+
+// appendFile copies the content of the file at src, if it exists, to w.
+func appendFile(w io.Writer, src string) error {
+	f, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to open log file")
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return errors.Wrap(err, "failed to copy log file")
+}
+
+// linkLegacyLog makes legacy a symlink to current, unless something other
+// than a symlink is already there.
+func linkLegacyLog(legacy, current string) error {
+	target, err := filepath.Abs(current)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve log path")
+	}
+	if fi, err := os.Lstat(legacy); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if t, _ := os.Readlink(legacy); t == target {
+			return nil
+		}
+		os.Remove(legacy)
+	}
+	if err := os.MkdirAll(filepath.Dir(legacy), 0755); err != nil {
+		return errors.Wrap(err, "failed to create legacy log folder")
+	}
+	return errors.Wrap(os.Symlink(target, legacy), "failed to link legacy log")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_handlerLogDir(t *testing.T) {
+	require.Equal(t, LegacyHandlerLogDir, handlerLogDir(vmextension.HandlerEnvironment{}))
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.LogFolder = "/var/log/azure/ext"
+	require.Equal(t, "/var/log/azure/ext", handlerLogDir(he))
+}
+
+func Test_setupHandlerLog_movesLegacyLogAndLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	legacyDir, logDir := filepath.Join(dir, "path"), filepath.Join(dir, "logs")
+	legacy := filepath.Join(legacyDir, ExtensionHandlerLogFileName)
+	current := filepath.Join(logDir, ExtensionHandlerLogFileName)
+	require.Nil(t, os.MkdirAll(legacyDir, 0755))
+	require.Nil(t, os.MkdirAll(logDir, 0755))
+	require.Nil(t, ioutil.WriteFile(legacy, []byte("old\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(current, []byte("new\n"), 0644))
+
+	require.Nil(t, setupHandlerLog(legacyDir, logDir))
+	b, err := ioutil.ReadFile(current)
+	require.Nil(t, err)
+	require.Equal(t, "old\nnew\n", string(b))
+
+	fi, err := os.Lstat(legacy)
+	require.Nil(t, err)
+	require.True(t, fi.Mode()&os.ModeSymlink != 0, "legacy log should be a symlink")
+
+	// writes through the legacy path end up in the new log, and running again
+	// does not migrate anything
+	f, err := os.OpenFile(legacy, os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, err)
+	_, err = f.WriteString("more\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	require.Nil(t, setupHandlerLog(legacyDir, logDir))
+	b, err = ioutil.ReadFile(current)
+	require.Nil(t, err)
+	require.Equal(t, "old\nnew\nmore\n", string(b))
+}
+
+func Test_setupHandlerLog_withoutCompat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv(legacyLogsEnv, "0")
+	defer os.Unsetenv(legacyLogsEnv)
+
+	legacyDir, logDir := filepath.Join(dir, "path"), filepath.Join(dir, "logs")
+	legacy := filepath.Join(legacyDir, ExtensionHandlerLogFileName)
+	require.Nil(t, os.MkdirAll(legacyDir, 0755))
+	require.Nil(t, ioutil.WriteFile(legacy, []byte("old\n"), 0644))
+
+	require.Nil(t, setupHandlerLog(legacyDir, logDir))
+	b, err := ioutil.ReadFile(filepath.Join(logDir, ExtensionHandlerLogFileName))
+	require.Nil(t, err)
+	require.Equal(t, "old\n", string(b))
+	_, err = os.Lstat(legacy)
+	require.True(t, os.IsNotExist(err), "legacy log should be removed")
+}
+
+func Test_setupHandlerLog_sameDir(t *testing.T) {
+	require.Nil(t, setupHandlerLog("./path", "path"))
+}
@@ -6,8 +6,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 )
 
@@ -15,11 +16,17 @@ import (
 type flags struct {
 	verbose bool
 	debug   bool
+	dryRun  bool
 }
 
 var (
-	verbose = flag.Bool("verbose", false, "Return a detailed report")
-	debug   = flag.Bool("debug", false, "Return a debug report")
+	verbose    = flag.Bool("verbose", false, "Echo logs and script output to the console and print a timing report")
+	debug      = flag.Bool("debug", false, "Log debug messages and error stack traces, and keep temporary artifacts")
+	dryRunFlag = flag.Bool("dry-run", false, "Print the actions a command would take without changing the VM")
+	jsonOutput = flag.Bool("json", false, "Print the diagnose report as JSON")
+
+	bundleOutput  = flag.String("output", "", "Path of the collect-logs bundle (default: a timestamped file in the temp dir)")
+	bundleMaxSize = flag.Int64("max-size", 50, "Maximum size in MB of the file content in the collect-logs bundle")
 
 	// the logger that will be used throughout
 	lg ExtensionLogger
@@ -30,6 +37,16 @@ var (
 
 func main() {
 
+	// parse the command line arguments
+	flag.Parse()
+	cmd := parseCmd(flag.Args())
+	opts := flags{verbose: *verbose, debug: *debug, dryRun: *dryRunFlag}
+
+	// local commands only inspect the extension and do not need the guest agent
+	if cmd.local {
+		runLocal(cmd, opts)
+	}
+
 	// parse extension environment
 	hEnv, handlerErr := vmextension.GetHandlerEnv()
 	if handlerErr != nil {
@@ -37,24 +54,38 @@ func main() {
 		os.Exit(failureCode)
 	}
 
-	// Note that this should be logging to: hEnv.HandlerEnvironment.LogFolder, but
-	// The original functionality had this logging at "./path" within the extension
-	// directory, and we don't want to break this.
-	lg = newLogger(logPath)
+	// log to the LogFolder of the handler environment; logs from the legacy
+	// "./path" directory are moved there first
+	logDir := handlerLogDir(hEnv)
+	var logSetupErr error
+	if !opts.dryRun {
+		logSetupErr = setupHandlerLog(LegacyHandlerLogDir, logDir)
+	}
+	lg = newLogger(logDir, opts)
 	noopLogger = newNoopLogger()
-	
-	// parse the command line arguments
-	flag.Parse()
-	cmd := parseCmd(flag.Args())
+	if logSetupErr != nil {
+		lg.eventError("failed to migrate the legacy handler log", logSetupErr)
+	}
+	configureTelemetry(lg)
+	if opts.dryRun {
+		plan = &actionPlan{}
+		telemetry = func(string, string, bool, time.Duration, ...interface{}) error { return nil }
+	}
+
 	lg.with("Operation: ", cmd.name)
 	lg.customLog("Command: ", cmd.name)
 
 	seqNum, seqErr := vmextension.FindSeqNum(hEnv.HandlerEnvironment.ConfigFolder)
+	// finish records the result of the command in the metrics and exits
+	finish := func(code int) {
+		recordOperation(lg, cmd.name, seqNum, code)
+		exit(code)
+	}
 	if seqErr != nil {
 		lg.eventError("failed to find sequence number", seqErr)
 		// only throw a fatal error if the command is not "install"
 		if cmd.name != "install" {
-			os.Exit(cmd.failExitCode)
+			finish(cmd.failExitCode)
 		}
 	}
 	lg.event("seqNum: " + strconv.Itoa(seqNum))
@@ -64,33 +95,79 @@ func main() {
 	if cmd.pre != nil {
 		lg.event("pre-check")
 		if preErr := cmd.pre(lg, seqNum); preErr != nil {
+			report := describeError(preErr, cmd.failExitCode)
 			lg.eventError("pre-check failed", preErr)
-			telemetry(TelemetryScenario, "enable pre-check failed: "+preErr.Error(), false, 0)
-			os.Exit(cmd.failExitCode)
+			telemetry(TelemetryScenario, "enable pre-check failed: "+preErr.Error(), false, 0, report.telemetryParameters()...)
+			finish(report.Code)
 		}
 	}
 
 	// execute the command
 	lg.event("Reporting transitioning status...")
-	reportStatus(lg, hEnv, seqNum, status.StatusTransitioning, cmd, "Transitioning")
+	reportStatus(lg, hEnv, seqNum, status.Transitioning, cmd, successCode, "Transitioning")
 
-	if cmdErr := cmd.f(lg, hEnv, seqNum); cmdErr != nil {
+	endStep := lg.step("operation " + cmd.name)
+	cmdErr := runHooks(lg, hEnv, seqNum, cmd.name, hookPre)
+	if cmdErr == nil {
+		cmdErr = cmd.f(lg, hEnv, seqNum)
+	}
+	if cmdErr == nil {
+		// post hooks cannot fail the operation
+		if err := runHooks(lg, hEnv, seqNum, cmd.name, hookPost); err != nil {
+			lg.eventError("post hooks failed, the operation still succeeds", err)
+		}
+	}
+	endStep()
+	result := successCode
+	if cmdErr != nil {
 		message := "Operation '" + cmd.name + "' failed."
+		report := describeError(cmdErr, cmd.failExitCode)
 		lg.eventError(message, cmdErr)
-		telemetry(TelemetryScenario, message+" Error: '"+cmdErr.Error()+"'.", false, 0)
+		lg.customLog(logEvent, "error report", "category", string(report.Category), "code", report.Code,
+			"retryable", report.Retryable)
+		telemetry(TelemetryScenario, message+" Error: '"+cmdErr.Error()+"'.", false, 0, report.telemetryParameters()...)
 		// Never fail on disable due to a current bug in the Guest Agent
 		if cmd.name != "disable" {
-			reportStatus(lg, hEnv, seqNum, status.StatusError, cmd, cmdErr.Error())
-			os.Exit(cmd.failExitCode)
+			reportStatus(lg, hEnv, seqNum, status.Error, cmd, report.Code, report.Message)
+			finish(report.Code)
 		}
+		result = report.Code
 	} else {
 		message := "Operation '" + cmd.name + "' succeeded."
 		lg.event(message)
 		telemetry(TelemetryScenario, message, false, 0)
 	}
 
-	reportStatus(lg, hEnv, seqNum, status.StatusSuccess, cmd, "")
-	os.Exit(successCode)
+	reportStatus(lg, hEnv, seqNum, status.Success, cmd, successCode, "")
+	// the metrics show a failed disable, although it exits with success
+	recordOperation(lg, cmd.name, seqNum, result)
+	exit(successCode)
+}
+
+// exit prints the timing report (with -verbose) and terminates the handler
+// with the given exit code.
+func exit(code int) {
+	lg.reportTimings()
+	printPlan()
+	os.Exit(code)
+}
+
+// runLocal executes a command that does not interact with the guest agent, so
+// no sequence number is processed and no status or telemetry is reported. It
+// does not write the handler log either, and logs to stderr with -verbose, as
+// stdout has the output of the command.
+func runLocal(c cmd, opts flags) {
+	hEnv, _ := vmextension.GetHandlerEnv()
+	lg = newConsoleLogger(opts, os.Stderr)
+	noopLogger = newNoopLogger()
+	lg.customLog("Command: ", c.name)
+
+	if err := c.f(lg, hEnv, 0); err != nil {
+		lg.eventError("Operation '"+c.name+"' failed.", err)
+		fmt.Println("Error:", err)
+		exit(c.failExitCode)
+	}
+	exit(successCode)
 }
 
 // parseCmd looks at the input array and parses the subcommand. If it is invalid,
@@ -132,5 +209,6 @@ func printUsage(args []string) {
 	}
 	fmt.Println()
 
-	fmt.Println("Optional flags: verbose | debug")
+	fmt.Println("Optional flags: verbose | debug | dry-run | json (diagnose only) | output, max-size (collect-logs only)")
+	fmt.Println("Extension:", DetailedVersionString())
 }
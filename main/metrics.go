@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/metrics"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/systemd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// metricsDirEnv is the directory of the node_exporter textfile collector,
+	// defaultMetricsDir if not set. The metrics are only written if the
+	// directory exists.
+	metricsDirEnv     = "GC_EXTENSION_METRICS_DIR"
+	defaultMetricsDir = "/var/lib/prometheus/node-exporter"
+	metricsFileName   = "guest_configuration_extension.prom"
+
+	// agentHealthUnknown is the heartbeat state if the agent service has not
+	// been checked or its state could not be read.
+	agentHealthUnknown = "unknown"
+)
+
+// agentHealthStates are the heartbeat states, each exported as a sample that
+// is 1 for the current state.
+var agentHealthStates = []string{
+	string(systemd.Healthy), string(systemd.Starting), string(systemd.NotFound),
+	string(systemd.Failed), string(systemd.CrashLooping), agentHealthUnknown,
+}
+
+// metricsState is what the metrics are rendered from. It is kept in
+// MetricsStateFileName across the handler runs, as every run executes a
+// single command.
+type metricsState struct {
+	Operations       map[string]operationRecord `json:"operations,omitempty"` // by command
+	Scripts          map[string]scriptRecord    `json:"scripts,omitempty"`    // by operation
+	AgentHealth      string                     `json:"agentHealth,omitempty"`
+	AgentHealthTime  int64                      `json:"agentHealthTime,omitempty"`
+	DroppedTelemetry int64                      `json:"droppedTelemetry"`
+}
+
+// operationRecord is the last run of a command.
+type operationRecord struct {
+	SeqNum   int   `json:"seqNum"`
+	ExitCode int   `json:"exitCode"`
+	Time     int64 `json:"time"`    // unix seconds
+	Retries  int   `json:"retries"` // failed runs for the same seqNum before this one
+}
+
+// scriptRecord is the last run of an agent script.
+type scriptRecord struct {
+	Seconds float64 `json:"seconds"`
+	Success bool    `json:"success"`
+	Time    int64   `json:"time"`
+}
+
+// observed collects the observations of the current handler run, which are
+// merged into the kept state when the command finishes.
+var observed metricsState
+
+// observeScript records the run of the agent script of an operation.
+func observeScript(operation string, elapsed time.Duration, success bool) {
+	if observed.Scripts == nil {
+		observed.Scripts = map[string]scriptRecord{}
+	}
+	observed.Scripts[operation] = scriptRecord{Seconds: elapsed.Seconds(), Success: success, Time: time.Now().Unix()}
+}
+
+// observeAgentHealth records the health of the agent service.
+func observeAgentHealth(health string) {
+	observed.AgentHealth, observed.AgentHealthTime = health, time.Now().Unix()
+}
+
+// observeDroppedTelemetry records a telemetry event that could not be sent.
+func observeDroppedTelemetry() {
+	observed.DroppedTelemetry++
+}
+
+// metricsDir returns the directory of the textfile collector.
+func metricsDir() string {
+	if d := os.Getenv(metricsDirEnv); d != "" {
+		return d
+	}
+	return defaultMetricsDir
+}
+
+// recordOperation merges the result of the command and the observations of
+// the run into the kept state and writes the metrics for the textfile
+// collector, if its directory exists. Failures are only logged. A successful
+// uninstall is not recorded, as it removed the metrics.
+func recordOperation(lg ExtensionLogger, command string, seqNum, code int) {
+	if command == "uninstall" && code == successCode {
+		return
+	}
+	dir := metricsDir()
+	if dryRun() {
+		plan.add("update %s and write metrics to %s", MetricsStateFileName, filepath.Join(dir, metricsFileName))
+		return
+	}
+	s, err := readMetricsState()
+	if err != nil {
+		lg.eventError("failed to read the metrics state, starting over", err)
+	}
+	s.merge(observed, command, seqNum, code, time.Now())
+	observed = metricsState{}
+	if err := s.save(); err != nil {
+		lg.eventError("failed to save the metrics state", err)
+	}
+
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		lg.debugf("no metrics written, %s is not a directory", dir)
+		return
+	}
+	if err := metrics.WriteFile(dir, metricsFileName, s.families(agentVersion(), Version)); err != nil {
+		lg.eventError("failed to write metrics", err)
+		return
+	}
+	lg.customLog(logEvent, "metrics written", logPath, filepath.Join(dir, metricsFileName))
+}
+
+// readMetricsState returns the kept state, which is empty at first and if it
+// cannot be read.
+func readMetricsState() (metricsState, error) {
+	var s metricsState
+	b, err := ioutil.ReadFile(MetricsStateFileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, errors.Wrap(err, "failed to read metrics state")
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return metricsState{}, errors.Wrap(err, "failed to parse metrics state")
+	}
+	return s, nil
+}
+
+func (s metricsState) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal metrics state")
+	}
+	return errors.Wrap(ioutil.WriteFile(MetricsStateFileName, b, 0644), "failed to write metrics state")
+}
+
+// merge adds the observations o of a run of command to s. A run for the same
+// sequence number as a failed one counts as a retry.
+func (s *metricsState) merge(o metricsState, command string, seqNum, code int, now time.Time) {
+	if s.Operations == nil {
+		s.Operations = map[string]operationRecord{}
+	}
+	retries := 0
+	if prev, ok := s.Operations[command]; ok && prev.SeqNum == seqNum && prev.ExitCode != successCode {
+		retries = prev.Retries + 1
+	}
+	s.Operations[command] = operationRecord{SeqNum: seqNum, ExitCode: code, Time: now.Unix(), Retries: retries}
+
+	for op, r := range o.Scripts {
+		if s.Scripts == nil {
+			s.Scripts = map[string]scriptRecord{}
+		}
+		s.Scripts[op] = r
+	}
+	if o.AgentHealth != "" {
+		s.AgentHealth, s.AgentHealthTime = o.AgentHealth, o.AgentHealthTime
+	}
+	s.DroppedTelemetry += o.DroppedTelemetry
+}
+
+// families renders the state as metric families.
+func (s metricsState) families(agentVersion, extensionVersion string) []metrics.Family {
+	var (
+		success   = metrics.Family{Name: "gc_extension_operation_success", Help: "Whether the last run of the command succeeded.", Type: metrics.Gauge}
+		exitCode  = metrics.Family{Name: "gc_extension_operation_exit_code", Help: "Exit code of the last run of the command.", Type: metrics.Gauge}
+		timestamp = metrics.Family{Name: "gc_extension_operation_timestamp_seconds", Help: "Unix time the last run of the command finished.", Type: metrics.Gauge}
+		retries   = metrics.Family{Name: "gc_extension_operation_retries", Help: "Failed runs of the command for the same sequence number before the last run.", Type: metrics.Gauge}
+	)
+	commands := make([]string, 0, len(s.Operations))
+	for c := range s.Operations {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+	for _, c := range commands {
+		r, labels := s.Operations[c], map[string]string{"command": c}
+		success.Samples = append(success.Samples, metrics.Sample{Labels: labels, Value: boolValue(r.ExitCode == successCode)})
+		exitCode.Samples = append(exitCode.Samples, metrics.Sample{Labels: labels, Value: float64(r.ExitCode)})
+		timestamp.Samples = append(timestamp.Samples, metrics.Sample{Labels: labels, Value: float64(r.Time)})
+		retries.Samples = append(retries.Samples, metrics.Sample{Labels: labels, Value: float64(r.Retries)})
+	}
+
+	var (
+		duration        = metrics.Family{Name: "gc_extension_script_duration_seconds", Help: "Duration of the last run of the agent script of the operation.", Type: metrics.Gauge}
+		scriptSuccess   = metrics.Family{Name: "gc_extension_script_success", Help: "Whether the last run of the agent script of the operation succeeded.", Type: metrics.Gauge}
+		scriptTimestamp = metrics.Family{Name: "gc_extension_script_timestamp_seconds", Help: "Unix time the agent script of the operation last ran.", Type: metrics.Gauge}
+	)
+	operations := make([]string, 0, len(s.Scripts))
+	for op := range s.Scripts {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+	for _, op := range operations {
+		r, labels := s.Scripts[op], map[string]string{"operation": op}
+		duration.Samples = append(duration.Samples, metrics.Sample{Labels: labels, Value: r.Seconds})
+		scriptSuccess.Samples = append(scriptSuccess.Samples, metrics.Sample{Labels: labels, Value: boolValue(r.Success)})
+		scriptTimestamp.Samples = append(scriptTimestamp.Samples, metrics.Sample{Labels: labels, Value: float64(r.Time)})
+	}
+
+	info := metrics.Family{Name: "gc_extension_agent_info", Help: "Versions of the installed agent and the extension.", Type: metrics.Gauge,
+		Samples: []metrics.Sample{{Labels: map[string]string{"agent_version": agentVersion, "extension_version": extensionVersion}, Value: 1}}}
+
+	health := s.AgentHealth
+	if health == "" {
+		health = agentHealthUnknown
+	}
+	heartbeat := metrics.Family{Name: "gc_extension_agent_heartbeat", Help: "State of the agent service at its last check, 1 for the current state.", Type: metrics.Gauge}
+	for _, state := range agentHealthStates {
+		heartbeat.Samples = append(heartbeat.Samples, metrics.Sample{Labels: map[string]string{"state": state}, Value: boolValue(state == health)})
+	}
+	heartbeatTimestamp := metrics.Family{Name: "gc_extension_agent_heartbeat_timestamp_seconds", Help: "Unix time the agent service was last checked.", Type: metrics.Gauge}
+	if s.AgentHealthTime != 0 {
+		heartbeatTimestamp.Samples = []metrics.Sample{{Value: float64(s.AgentHealthTime)}}
+	}
+
+	dropped := metrics.Family{Name: "gc_extension_telemetry_dropped_total", Help: "Telemetry events that could not be sent to every sink.", Type: metrics.Counter,
+		Samples: []metrics.Sample{{Value: float64(s.DroppedTelemetry)}}}
+
+	return []metrics.Family{success, exitCode, timestamp, retries, duration, scriptSuccess, scriptTimestamp,
+		info, heartbeat, heartbeatTimestamp, dropped}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
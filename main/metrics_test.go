@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// requireGoldenMetrics compares the rendered state with testdata/<name>.golden.
+func requireGoldenMetrics(t *testing.T, s metricsState, name string) {
+	var b bytes.Buffer
+	require.Nil(t, metrics.Write(&b, s.families("1.29.2", "1.26.60")))
+	golden := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		require.Nil(t, os.MkdirAll("testdata", 0755))
+		require.Nil(t, ioutil.WriteFile(golden, b.Bytes(), 0644))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	require.Nil(t, err)
+	require.Equal(t, string(expected), b.String())
+}
+
+func Test_metricsState_golden(t *testing.T) {
+	first := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+
+	var s metricsState
+	s.merge(metricsState{}, "install", 0, successCode, first)
+	requireGoldenMetrics(t, s, "metrics_install")
+
+	s.merge(metricsState{
+		Scripts: map[string]scriptRecord{"install": {Seconds: 12.5, Success: true, Time: first.Unix()}},
+	}, "install", 0, successCode, first.Add(time.Minute))
+	s.merge(metricsState{
+		Scripts:          map[string]scriptRecord{"enable": {Seconds: 3.25, Success: false, Time: first.Unix() + 120}},
+		AgentHealth:      "crash-looping",
+		AgentHealthTime:  first.Unix() + 130,
+		DroppedTelemetry: 2,
+	}, "enable", 1, agentHealthCheckFailedCode, first.Add(2*time.Minute))
+	s.merge(metricsState{
+		Scripts:          map[string]scriptRecord{"enable": {Seconds: 4, Success: true, Time: first.Unix() + 180}},
+		AgentHealth:      "healthy",
+		AgentHealthTime:  first.Unix() + 190,
+		DroppedTelemetry: 1,
+	}, "enable", 1, agentHealthCheckFailedCode, first.Add(3*time.Minute))
+	requireGoldenMetrics(t, s, "metrics")
+}
+
+func Test_metricsState_retries(t *testing.T) {
+	now := time.Now()
+	var s metricsState
+	s.merge(metricsState{}, "enable", 1, enableCode, now)
+	require.Equal(t, 0, s.Operations["enable"].Retries)
+	s.merge(metricsState{}, "enable", 1, enableCode, now)
+	s.merge(metricsState{}, "enable", 1, successCode, now)
+	require.Equal(t, 2, s.Operations["enable"].Retries, "failed runs for the same seqNum")
+	s.merge(metricsState{}, "enable", 1, successCode, now)
+	require.Equal(t, 0, s.Operations["enable"].Retries, "the run before succeeded")
+	s.merge(metricsState{}, "enable", 2, enableCode, now)
+	s.merge(metricsState{}, "enable", 3, successCode, now)
+	require.Equal(t, 0, s.Operations["enable"].Retries, "another seqNum")
+}
+
+func Test_recordOperation(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { observed = metricsState{} }()
+	oldTelemetry := telemetry
+	defer func() { telemetry = oldTelemetry }()
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv(metricsDirEnv, dir)
+	defer os.Unsetenv(metricsDirEnv)
+
+	telemetry = sendTelemetry(failingSink{}, "name", "1.0")
+	telemetry(TelemetryScenario, "dropped", true, 0)
+	observeScript("enable", 2*time.Second, true)
+	observeAgentHealth("healthy")
+	recordOperation(noopLogger, "enable", 4, enableCode)
+	require.Equal(t, metricsState{}, observed, "observations are merged once")
+
+	telemetry(TelemetryScenario, "dropped", true, 0)
+	recordOperation(noopLogger, "enable", 4, successCode)
+
+	s, err := readMetricsState()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), s.DroppedTelemetry)
+	require.Equal(t, 1, s.Operations["enable"].Retries)
+	require.Equal(t, "healthy", s.AgentHealth)
+	require.Equal(t, 2.0, s.Scripts["enable"].Seconds)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, metricsFileName))
+	require.Nil(t, err)
+	require.Contains(t, string(b), `gc_extension_operation_success{command="enable"} 1`)
+	require.Contains(t, string(b), `gc_extension_operation_retries{command="enable"} 1`)
+	require.Contains(t, string(b), "gc_extension_telemetry_dropped_total 2")
+
+	// a missing collector directory only keeps the state
+	os.Setenv(metricsDirEnv, filepath.Join(dir, "missing"))
+	recordOperation(noopLogger, "disable", 4, successCode)
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+	s, _ = readMetricsState()
+	require.Contains(t, s.Operations, "disable")
+
+	// an unreadable state starts over
+	require.Nil(t, ioutil.WriteFile(MetricsStateFileName, []byte("{"), 0644))
+	_, err = readMetricsState()
+	require.NotNil(t, err)
+	recordOperation(noopLogger, "enable", 5, successCode)
+	s, err = readMetricsState()
+	require.Nil(t, err)
+	require.Len(t, s.Operations, 1)
+
+	require.Nil(t, os.Remove(MetricsStateFileName))
+	recordOperation(noopLogger, "uninstall", 5, successCode)
+	require.False(t, fileExists(t, MetricsStateFileName), "uninstall leaves no metrics behind")
+}
+
+func Test_sendTelemetry_countsDropped(t *testing.T) {
+	defer func() { observed = metricsState{} }()
+	send := sendTelemetry(fanOutSink{failingSink{}}, "name", "1.0")
+	require.NotNil(t, send(TelemetryScenario, "dropped", true, 0))
+	require.Nil(t, sendTelemetry(fanOutSink{}, "name", "1.0")(TelemetryScenario, "sent", true, 0))
+	require.Equal(t, int64(1), observed.DroppedTelemetry)
+}
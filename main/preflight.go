@@ -0,0 +1,79 @@
+package main
+
+import (
+	"archive/zip"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/preflight"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+const substatusPreflight = "Preflight"
+
+// preflightChecks returns the checks to run before the agent is extracted. A
+// dry run only checks the permissions of the directories, without creating
+// them or writing probe files.
+func preflightChecks(hEnv vmextension.HandlerEnvironment) []preflight.Check {
+	writable := preflight.Writable
+	if dryRun() {
+		writable = preflight.WritableStat
+	}
+	var checks []preflight.Check
+	if size, err := agentPackageSize(AgentZipDir, AgentName); err == nil {
+		checks = append(checks, preflight.FreeDisk(DataDir, size))
+	}
+	checks = append(checks,
+		writable("data", DataDir),
+		writable("status", hEnv.HandlerEnvironment.StatusFolder),
+		writable("log", handlerLogDir(hEnv)),
+		preflight.Binary("bash", true, "the agent scripts need it"),
+		preflight.Binary("openssl", false, "protected settings can only be decrypted natively"),
+		preflight.InitSystem(),
+	)
+	return checks
+}
+
+// runPreflight runs the preflight checks and returns an error with
+// preflightFailedCode listing the failed checks, if any. Warnings are
+// reported as substatus.
+func runPreflight(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment) error {
+	defer lg.step("preflight checks")()
+	report := preflight.Run(preflight.Root(osRoot), preflightChecks(hEnv))
+	for _, r := range report {
+		lg.customLog(logEvent, "preflight check", "check", r.Name, "outcome", string(r.Outcome), "message", r.Message)
+		if dryRun() {
+			plan.add("preflight check %s: %s", r.Outcome, r)
+		}
+	}
+
+	if warnings := report.With(preflight.Warn); len(warnings) > 0 {
+		addSubstatus(substatusPreflight, status.Warning, 0, preflight.Summary(warnings))
+	}
+	if !report.Failed() {
+		return nil
+	}
+	msg := preflight.Summary(report.With(preflight.Fail))
+	telemetry(TelemetryScenario, "Preflight checks failed: "+msg, false, 0)
+	return newHandlerError(errors.New("preflight checks failed: "+msg), categoryEnvironment, preflightFailedCode,
+		"The VM does not meet the requirements of the Guest Configuration agent", true)
+}
+
+// agentPackageSize returns the size of the agent package found in zipDir once
+// extracted.
+func agentPackageSize(zipDir, prefix string) (uint64, error) {
+	agentZip, err := findAgentZip(zipDir, prefix)
+	if err != nil {
+		return 0, err
+	}
+	r, err := zip.OpenReader(agentZip)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open zip: %s", agentZip)
+	}
+	defer r.Close()
+	var size uint64
+	for _, f := range r.File {
+		size += f.UncompressedSize64
+	}
+	return size, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runPreflight_failureHasCode(t *testing.T) {
+	root, err := ioutil.TempDir("", "root")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	osRoot = root
+	defer func() { osRoot = "/" }()
+	defer func() { substatus = nil }()
+
+	// an empty root has no bash and no init system
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.StatusFolder = "/status"
+	he.HandlerEnvironment.LogFolder = "/log"
+	err = runPreflight(noopLogger, he)
+	require.NotNil(t, err)
+	require.Equal(t, preflightFailedCode, exitCode(err, enableCode))
+	require.Contains(t, err.Error(), "preflight checks failed: bash binary: bash not found")
+	require.Contains(t, err.Error(), "init system: no init system found")
+	require.NotContains(t, err.Error(), "writable")
+
+	// openssl is only a warning
+	require.Len(t, substatus, 1)
+	require.Equal(t, substatusPreflight, substatus[0].Name)
+	require.Contains(t, substatus[0].FormattedMessage.Message, "openssl binary")
+	require.True(t, fileExists(t, filepath.Join(root, "status")))
+}
+
+func Test_runPreflight_dryRunCreatesNothing(t *testing.T) {
+	root, err := ioutil.TempDir("", "root")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	osRoot = root
+	defer func() { osRoot = "/" }()
+	defer func() { substatus = nil }()
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.StatusFolder = "/status"
+	he.HandlerEnvironment.LogFolder = "/log"
+	actions := withDryRun(func() {
+		err = runPreflight(noopLogger, he)
+	})
+	require.NotNil(t, err, "an empty root has no bash")
+	require.NotEmpty(t, actions)
+	files, err := ioutil.ReadDir(root)
+	require.Nil(t, err)
+	require.Empty(t, files, "a dry run creates no directories or probe files")
+}
+
+func Test_agentPackageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = agentPackageSize(dir, AgentName)
+	require.NotNil(t, err)
+
+	writeTestZip(t, filepath.Join(dir, "GC_1.0.0.zip"), "GC/install.sh", "GC/enable.sh")
+	size, err := agentPackageSize(dir, AgentName)
+	require.Nil(t, err)
+	require.NotZero(t, size)
+}
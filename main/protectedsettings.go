@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/pkcs7"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+const (
+	settingsFileSuffix = ".settings"
+)
+
+// handlerSettingsFile is the N.settings file the guest agent writes into the
+// config folder.
+type handlerSettingsFile struct {
+	RuntimeSettings []struct {
+		HandlerSettings runtimeSettings `json:"handlerSettings"`
+	} `json:"runtimeSettings"`
+}
+
+type runtimeSettings struct {
+	PublicSettings          map[string]interface{} `json:"publicSettings"`
+	ProtectedSettingsBase64 string                 `json:"protectedSettings"`
+	SettingsCertThumbprint  string                 `json:"protectedSettingsCertThumbprint"`
+}
+
+// readSettingsFile reads the settings file of the current sequence number in
+// configFolder and decrypts its protected settings.
+func readSettingsFile(configFolder string) (public, protected map[string]interface{}, _ error) {
+	seq, err := vmextension.FindSeqNum(configFolder)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot locate settings file")
+	}
+	rs, err := parseHandlerSettingsFile(filepath.Join(configFolder, fmt.Sprintf("%d%s", seq, settingsFileSuffix)))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error parsing settings file")
+	}
+
+	protected, err = decryptProtectedSettings(configFolder, rs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse protected settings")
+	}
+	return rs.PublicSettings, protected, nil
+}
+
+// parseHandlerSettingsFile returns the single runtime settings entry of the
+// settings file at path. An empty file means no settings.
+func parseHandlerSettingsFile(path string) (rs runtimeSettings, _ error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rs, errors.Wrapf(err, "error reading %s", path)
+	}
+	if len(b) == 0 { // if no config is specified, we get an empty file
+		return rs, nil
+	}
+
+	var f handlerSettingsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return rs, errors.Wrap(err, "error parsing json")
+	}
+	if len(f.RuntimeSettings) != 1 {
+		return rs, errors.Errorf("wrong runtimeSettings count. expected:1, got:%d", len(f.RuntimeSettings))
+	}
+	return f.RuntimeSettings[0].HandlerSettings, nil
+}
+
+// decryptProtectedSettings decrypts the protected settings with the
+// certificate and key named after the thumbprint, as found by the
+// certResolver. Each key pair is tried natively, and only if that fails with
+// openssl. The error lists every certificate that was tried.
+func decryptProtectedSettings(configFolder string, rs runtimeSettings) (map[string]interface{}, error) {
+	if rs.ProtectedSettingsBase64 == "" {
+		return nil, nil
+	}
+	if rs.SettingsCertThumbprint == "" {
+		return nil, errors.New("HandlerSettings has protected settings but no cert thumbprint")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(rs.ProtectedSettingsBase64)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode base64")
+	}
+
+	resolver := newCertResolver(configFolder)
+	candidates := resolver.candidates(rs.SettingsCertThumbprint)
+	if len(candidates) == 0 {
+		return nil, errors.Errorf("no certificate found for thumbprint %s in: %s",
+			rs.SettingsCertThumbprint, strings.Join(resolver.dirs, ", "))
+	}
+
+	var tried []string
+	for _, p := range candidates {
+		plaintext, err := decryptWithKeyPair(decoded, p)
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s: %v", p.crt, err))
+			continue
+		}
+		if !strings.EqualFold(p.thumbprint, rs.SettingsCertThumbprint) {
+			lg.customLog(logEvent, "protected settings decrypted with another certificate than named",
+				"thumbprint", rs.SettingsCertThumbprint, "certificate", p.crt)
+		}
+
+		var v map[string]interface{}
+		if err := json.Unmarshal(plaintext, &v); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal decrypted settings json")
+		}
+		return v, nil
+	}
+	return nil, errors.Errorf("decrypting protected settings with certificate %s failed, tried: %s",
+		rs.SettingsCertThumbprint, strings.Join(tried, "; "))
+}
+
+// decryptWithKeyPair decrypts the enveloped data natively with the key pair,
+// and falls back to openssl if that fails.
+func decryptWithKeyPair(data []byte, p keyPair) ([]byte, error) {
+	plaintext, err := decryptNative(data, p.crt, p.prv)
+	if err == nil {
+		return plaintext, nil
+	}
+	lg.eventError("native decryption of protected settings failed, falling back to openssl", err)
+	plaintext, opensslErr := decryptOpenSSL(data, p.crt, p.prv)
+	if opensslErr != nil {
+		return nil, errors.Errorf("%v (openssl fallback: %v)", err, opensslErr)
+	}
+	return plaintext, nil
+}
+
+// decryptNative decrypts the enveloped data with the certificate and private
+// key files without external tools.
+func decryptNative(data []byte, crt, prv string) ([]byte, error) {
+	cert, err := loadCertificate(crt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadPrivateKey(prv)
+	if err != nil {
+		return nil, err
+	}
+	return pkcs7.Decrypt(data, cert, key)
+}
+
+// decryptOpenSSL decrypts the enveloped data by running openssl.
+func decryptOpenSSL(data []byte, crt, prv string) ([]byte, error) {
+	cmd := exec.Command("openssl", "smime", "-inform", "DER", "-decrypt", "-recip", crt, "-inkey", prv)
+	var bOut, bErr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &bOut
+	cmd.Stderr = &bErr
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Errorf("error=%v stderr=%s", err, bErr.String())
+	}
+	return bOut.Bytes(), nil
+}
+
+// loadCertificate reads a PEM or DER encoded certificate.
+func loadCertificate(path string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read certificate")
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(b)
+	return cert, errors.Wrapf(err, "failed to parse certificate %s", path)
+}
+
+// loadPrivateKey reads a PEM encoded PKCS#1 or PKCS#8 private key.
+func loadPrivateKey(path string) (crypto.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read private key")
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data found in private key %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	return key, errors.Wrapf(err, "failed to parse private key %s", path)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/pkcs7"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert generates a self-signed certificate and writes it with its
+// key as <thumbprint>.crt and <thumbprint>.prv into dir, the way the guest
+// agent does. It returns the thumbprint.
+func writeTestCert(t *testing.T, dir string) (string, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "guest-configuration-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	thumbprint := fmt.Sprintf("%X", sha1.Sum(der))
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, thumbprint+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, thumbprint+".prv"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600))
+	return thumbprint, cert
+}
+
+// writeTestSettings writes configFolder/<seqNum>.settings with the public
+// settings and the protected settings encrypted for cert.
+func writeTestSettings(t *testing.T, configFolder string, seqNum int, thumbprint string, cert *x509.Certificate, public, protected map[string]interface{}) {
+	hs := map[string]interface{}{"publicSettings": public}
+	if protected != nil {
+		b, err := json.Marshal(protected)
+		require.Nil(t, err)
+		enc, err := pkcs7.Encrypt(b, cert, pkcs7.AES256CBC)
+		require.Nil(t, err)
+		hs["protectedSettings"] = base64.StdEncoding.EncodeToString(enc)
+		hs["protectedSettingsCertThumbprint"] = thumbprint
+	}
+	f := map[string]interface{}{"runtimeSettings": []interface{}{map[string]interface{}{"handlerSettings": hs}}}
+	b, err := json.Marshal(f)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(configFolder, fmt.Sprintf("%d.settings", seqNum)), b, 0600))
+}
+
+// newTestExtensionDir creates <dir>/<ext>/config and returns dir and the
+// config folder. The guest agent keeps certificates in dir.
+func newTestExtensionDir(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	configFolder := filepath.Join(dir, "ext", "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0755))
+	return dir, configFolder
+}
+
+func Test_readSettingsFile_decryptsNatively(t *testing.T) {
+	dir, configFolder := newTestExtensionDir(t)
+	defer os.RemoveAll(dir)
+	thumbprint, cert := writeTestCert(t, dir)
+	writeTestSettings(t, configFolder, 2, thumbprint, cert,
+		map[string]interface{}{"commandToExecute": "date"},
+		map[string]interface{}{"storageAccountKey": "c2VjcmV0"})
+
+	pub, prot, err := readSettingsFile(configFolder)
+	require.Nil(t, err)
+	require.Equal(t, "date", pub["commandToExecute"])
+	require.Equal(t, "c2VjcmV0", prot["storageAccountKey"])
+}
+
+func Test_readSettingsFile_certificateLookup(t *testing.T) {
+	dir, configFolder := newTestExtensionDir(t)
+	defer os.RemoveAll(dir)
+	certDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(certDir)
+	os.Setenv(certDirsEnv, certDir)
+	defer os.Unsetenv(certDirsEnv)
+
+	// the thumbprint matches case-insensitively in a configured directory
+	thumbprint, cert := writeTestCert(t, certDir)
+	writeTestSettings(t, configFolder, 0, strings.ToLower(thumbprint), cert, nil, map[string]interface{}{"script": "ZGF0ZQ=="})
+	_, prot, err := readSettingsFile(configFolder)
+	require.Nil(t, err)
+	require.Equal(t, "ZGF0ZQ==", prot["script"])
+
+	// after rotation the named certificate is gone, the other key pairs are tried
+	writeTestCert(t, dir)
+	writeTestSettings(t, configFolder, 0, "ROTATED", cert, nil, map[string]interface{}{"script": "ZGF0ZQ=="})
+	_, prot, err = readSettingsFile(configFolder)
+	require.Nil(t, err)
+	require.Equal(t, "ZGF0ZQ==", prot["script"])
+}
+
+func Test_readSettingsFile_noProtectedSettings(t *testing.T) {
+	dir, configFolder := newTestExtensionDir(t)
+	defer os.RemoveAll(dir)
+	writeTestSettings(t, configFolder, 0, "", nil, map[string]interface{}{"commandToExecute": "date"}, nil)
+
+	pub, prot, err := readSettingsFile(configFolder)
+	require.Nil(t, err)
+	require.Equal(t, "date", pub["commandToExecute"])
+	require.Nil(t, prot)
+}
+
+func Test_readSettingsFile_emptyFile(t *testing.T) {
+	dir, configFolder := newTestExtensionDir(t)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(configFolder, "0.settings"), nil, 0600))
+
+	pub, prot, err := readSettingsFile(configFolder)
+	require.Nil(t, err)
+	require.Nil(t, pub)
+	require.Nil(t, prot)
+}
+
+func Test_decryptProtectedSettings_failures(t *testing.T) {
+	dir, configFolder := newTestExtensionDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := decryptProtectedSettings(configFolder, runtimeSettings{ProtectedSettingsBase64: "abc"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no cert thumbprint")
+
+	_, err = decryptProtectedSettings(configFolder, runtimeSettings{ProtectedSettingsBase64: "!!", SettingsCertThumbprint: "ABC"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to decode base64")
+
+	os.Setenv(certTryAllEnv, "0")
+	defer os.Unsetenv(certTryAllEnv)
+	_, err = decryptProtectedSettings(configFolder, runtimeSettings{ProtectedSettingsBase64: "YWJj", SettingsCertThumbprint: "ABC"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no certificate found for thumbprint ABC")
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ABC.crt"), []byte("junk"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ABC.prv"), []byte("junk"), 0600))
+	_, err = decryptProtectedSettings(configFolder, runtimeSettings{ProtectedSettingsBase64: "YWJj", SettingsCertThumbprint: "ABC"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "decrypting protected settings with certificate ABC failed, tried: "+filepath.Join(dir, "ABC.crt"))
+	require.Contains(t, err.Error(), "openssl fallback")
+}
+
+func Test_decryptOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	thumbprint, cert := writeTestCert(t, dir)
+
+	enc, err := pkcs7.Encrypt([]byte(`{"a":"b"}`), cert, pkcs7.DESEDE3CBC)
+	require.Nil(t, err)
+	out, err := decryptOpenSSL(enc, filepath.Join(dir, thumbprint+".crt"), filepath.Join(dir, thumbprint+".prv"))
+	require.Nil(t, err)
+	require.Equal(t, `{"a":"b"}`, string(out))
+}
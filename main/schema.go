@@ -37,9 +37,64 @@ const (
     "timestamp": {
       "description": "An integer, intended to trigger re-execution of the script when changed",
       "type": "integer"
+    },
+    "removeLogsOnUninstall": {
+      "description": "Remove the agent logs and reports on uninstall, which are kept by default",
+      "type": "boolean"
+    },
+    "scriptLimits": {
+      "description": "Resource limits and user of the agent scripts per operation; scripts run as root without limits unless set for their operation",
+      "type": "object",
+      "properties": {
+        "install": {"$ref": "#/definitions/scriptLimits"},
+        "enable": {"$ref": "#/definitions/scriptLimits"},
+        "update": {"$ref": "#/definitions/scriptLimits"},
+        "disable": {"$ref": "#/definitions/scriptLimits"},
+        "uninstall": {"$ref": "#/definitions/scriptLimits"}
+      },
+      "additionalProperties": false
     }
   },
-  "additionalProperties": false
+  "additionalProperties": false,
+  "definitions": {
+    "scriptLimits": {
+      "type": "object",
+      "properties": {
+        "maxMemoryMB": {
+          "description": "Maximum memory in MB, 0 for no limit",
+          "type": "integer",
+          "minimum": 0
+        },
+        "maxOpenFiles": {
+          "description": "Maximum number of open files, 0 for no limit",
+          "type": "integer",
+          "minimum": 0
+        },
+        "maxCpuSeconds": {
+          "description": "Maximum CPU time in seconds, 0 for no limit",
+          "type": "integer",
+          "minimum": 0
+        },
+        "nice": {
+          "description": "Niceness of the script, 0 to run with normal priority",
+          "type": "integer",
+          "minimum": 0,
+          "maximum": 19
+        },
+        "ioClass": {
+          "description": "I/O scheduling class of the script",
+          "type": "string",
+          "enum": ["", "best-effort", "idle"]
+        },
+        "user": {
+          "description": "User to run the script as instead of root",
+          "type": "string",
+          "pattern": "^[a-z_][a-z0-9_-]*[$]?$"
+        }
+      },
+      "additionalProperties": false
+    }
+  }
 }`
 
 	protectedSettingsSchema = `{
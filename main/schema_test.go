@@ -38,6 +38,14 @@ func TestValidatePublicSettings_timestampSupported(t *testing.T) {
 	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "timestamp": 1}`))
 }
 
+func TestValidatePublicSettings_removeLogsOnUninstall(t *testing.T) {
+	err := validatePublicSettings(`{"removeLogsOnUninstall": "yes"}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Expected: boolean, given: string")
+
+	require.Nil(t, validatePublicSettings(`{"removeLogsOnUninstall":true}`))
+}
+
 func TestValidateProtectedSettings_empty(t *testing.T) {
 	require.Nil(t, validateProtectedSettings(""), "empty string")
 	require.Nil(t, validateProtectedSettings("{}"), "empty string")
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+)
+
+// The agent scripts (install.sh, enable.sh, update.sh, disable.sh and
+// uninstall.sh) run with an environment built by scriptEnv, not with the
+// environment of the handler. The contract with the scripts is:
+//
+//	PATH                  always scriptPath
+//	LANG, LC_ALL          always "C"
+//	GC_OPERATION          the operation the script runs for, like "install"
+//	GC_SEQNUM             the sequence number of the settings, like "3"
+//	GC_EXTENSION_VERSION  the version of the extension handler
+//	GC_AGENT_VERSION      the version of the agent, empty if unknown
+//	GC_DATA_DIR           the absolute path of the extension data directory
+//	GC_LOG_DIR            the absolute path of the handler log directory
+//	GC_OUTPUT_DIR         the absolute path of the directory with the stdout
+//	                      and stderr files of the script
+//	GC_SETTINGS_FILE      the absolute path of the N.settings file of the
+//	                      sequence number, which may not exist
+//	GC_RESULT_FILE        the absolute path the script may write its result
+//	                      to, see scriptResultSchema; the exit code decides
+//	                      the outcome of scripts that do not write it. It is
+//	                      in GC_OUTPUT_DIR, or in the temp dir for scripts
+//	                      not run as root
+//
+// The GC_ variables are always set, but may be empty when the handler does
+// not know their value. Besides these, only the variables in
+// scriptEnvAllowlist are passed on from the handler, if set. A script run as
+// another user gets HOME, USER and LOGNAME of that user instead.
+const (
+	scriptPath   = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	scriptLocale = "C"
+)
+
+// scriptEnvAllowlist lists the variables passed on from the handler
+// environment to the scripts.
+var scriptEnvAllowlist = []string{
+	"HOME", "USER", "LOGNAME", "TZ", "TMPDIR",
+	"http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+}
+
+// scriptContext describes a script run to the script through its environment.
+type scriptContext struct {
+	Operation    string
+	SeqNum       int
+	LogDir       string
+	OutputDir    string
+	SettingsFile string
+	Limits       scriptLimits
+	Timeout      time.Duration // 0 for no timeout
+	ResultFile   string        // where the script may write its result, in OutputDir if empty
+}
+
+// newScriptContext returns the context of a script run for the operation of
+// the sequence number, whose output is saved to scriptOutputDir.
+func newScriptContext(hEnv vmextension.HandlerEnvironment, seqNum int, operation string) scriptContext {
+	sc := scriptContext{
+		Operation: operation,
+		SeqNum:    seqNum,
+		LogDir:    handlerLogDir(hEnv),
+		OutputDir: scriptOutputDir(seqNum, operation),
+	}
+	if hEnv.HandlerEnvironment.ConfigFolder != "" {
+		sc.SettingsFile = filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, fmt.Sprintf("%d%s", seqNum, settingsFileSuffix))
+	}
+	return sc
+}
+
+// scriptEnv returns the environment the agent scripts are run with, sorted by
+// name.
+func scriptEnv(sc scriptContext) []string {
+	env := []string{
+		"PATH=" + scriptPath,
+		"LANG=" + scriptLocale,
+		"LC_ALL=" + scriptLocale,
+		"GC_OPERATION=" + sc.Operation,
+		"GC_SEQNUM=" + strconv.Itoa(sc.SeqNum),
+		"GC_EXTENSION_VERSION=" + Version,
+		"GC_AGENT_VERSION=" + agentVersion(),
+		"GC_DATA_DIR=" + absPath(DataDir),
+		"GC_LOG_DIR=" + absPath(sc.LogDir),
+		"GC_OUTPUT_DIR=" + absPath(sc.OutputDir),
+		"GC_SETTINGS_FILE=" + absPath(sc.SettingsFile),
+		"GC_RESULT_FILE=" + absPath(scriptResultPath(sc)),
+	}
+	userEnv := scriptUserEnv(sc.Limits.User)
+	for _, k := range scriptEnvAllowlist {
+		if _, ok := userEnv[k]; ok {
+			continue
+		}
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	for k, v := range userEnv {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// absPath returns the absolute path of p, or "" for an empty p.
+func absPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+// runStubScript runs a script that prints its environment, like an agent
+// script would see it, and returns the printed variables.
+func runStubScript(t *testing.T, hEnv vmextension.HandlerEnvironment, seqNum int, operation string) map[string]string {
+	_, agentDir := getAgentPaths()
+	require.Nil(t, os.MkdirAll(agentDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(agentDir, operation+".sh"), []byte("#!/bin/sh\nenv\n"), 0744))
+
+	sc := newScriptContext(hEnv, seqNum, operation)
+	_, err := runCmd(noopLogger, "bash ./"+operation+".sh", agentDir, sc, handlerSettings{})
+	require.Nil(t, err)
+
+	stdout, _ := logPaths(sc.OutputDir)
+	b, err := ioutil.ReadFile(stdout)
+	require.Nil(t, err)
+	env := map[string]string{}
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		kv := strings.SplitN(l, "=", 2)
+		require.Len(t, kv, 2, l)
+		env[kv[0]] = kv[1]
+	}
+	return env
+}
+
+func Test_scriptEnv_contract(t *testing.T) {
+	defer inTempDir(t)()
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, saveAgentVersion("1.26.5"))
+
+	for k, v := range map[string]string{"GC_TEST_SECRET": "hunter2", "https_proxy": "http://proxy:3128", "LANG": "de_DE.UTF-8"} {
+		old, had := os.LookupEnv(k)
+		require.Nil(t, os.Setenv(k, v))
+		if had {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+
+	var he vmextension.HandlerEnvironment
+	he.HandlerEnvironment.ConfigFolder = "/var/lib/waagent/ext/config"
+	he.HandlerEnvironment.LogFolder = "/var/log/azure/ext"
+	env := runStubScript(t, he, 4, "enable")
+
+	require.Equal(t, scriptPath, env["PATH"])
+	require.Equal(t, "C", env["LANG"], "fixed locale")
+	require.Equal(t, "C", env["LC_ALL"])
+	require.Equal(t, "enable", env["GC_OPERATION"])
+	require.Equal(t, "4", env["GC_SEQNUM"])
+	require.Equal(t, Version, env["GC_EXTENSION_VERSION"])
+	require.Equal(t, "1.26.5", env["GC_AGENT_VERSION"])
+	require.Equal(t, wd, env["GC_DATA_DIR"])
+	require.Equal(t, "/var/log/azure/ext", env["GC_LOG_DIR"])
+	require.Equal(t, filepath.Join(wd, "4", "enable"), env["GC_OUTPUT_DIR"])
+	require.Equal(t, "/var/lib/waagent/ext/config/4.settings", env["GC_SETTINGS_FILE"])
+	require.Equal(t, "http://proxy:3128", env["https_proxy"], "allowlisted")
+	_, ok := env["GC_TEST_SECRET"]
+	require.False(t, ok, "the handler environment must not leak to scripts")
+}
+
+func Test_scriptEnv_onlyContractAndAllowlist(t *testing.T) {
+	allowed := map[string]bool{"PATH": true, "LANG": true, "LC_ALL": true}
+	for _, k := range scriptEnvAllowlist {
+		allowed[k] = true
+	}
+
+	env := scriptEnv(scriptContext{})
+	require.True(t, sort.StringsAreSorted(env))
+	for _, kv := range env {
+		k := strings.SplitN(kv, "=", 2)[0]
+		require.True(t, allowed[k] || strings.HasPrefix(k, "GC_"), k)
+	}
+	require.Contains(t, env, "GC_SETTINGS_FILE=", "empty when unknown")
+	require.Contains(t, env, "GC_SEQNUM=0")
+}
+
+func Test_scriptEnv_asUser(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	for k, v := range map[string]string{"HOME": "/root", "USER": "root", "LOGNAME": "root"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	env := scriptEnv(scriptContext{Limits: scriptLimits{User: "nobody"}})
+	require.True(t, sort.StringsAreSorted(env))
+	require.Contains(t, env, "HOME="+nobody.HomeDir)
+	require.Contains(t, env, "USER=nobody")
+	require.Contains(t, env, "LOGNAME=nobody")
+	require.NotContains(t, env, "HOME=/root")
+	require.NotContains(t, env, "USER=root")
+
+	env = scriptEnv(scriptContext{Limits: scriptLimits{User: "root"}})
+	require.Contains(t, env, "HOME=/root", "root keeps the handler environment")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+const (
+	// scriptResultFileName is the file in the output directory of a script run
+	// the script may write its result to, passed as GC_RESULT_FILE.
+	scriptResultFileName = "result.json"
+
+	// maxScriptResultSize is the size above which a result file is invalid
+	maxScriptResultSize = 64 * 1024
+
+	substatusScriptResult = "ScriptResult"
+)
+
+// scriptResultSchema is the contract for the result file of the agent
+// scripts. Metrics are numbers by name, like {"policiesApplied": 3}.
+const scriptResultSchema = `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "Guest Configuration - Agent Script Result",
+  "type": "object",
+  "properties": {
+    "status": {
+      "type": "string",
+      "enum": ["success", "warning", "error"]
+    },
+    "message": {
+      "type": "string"
+    },
+    "agentVersion": {
+      "type": "string",
+      "pattern": "^[0-9]+(\\.[0-9]+)*$"
+    },
+    "substatus": {
+      "type": "array",
+      "maxItems": 20,
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "minLength": 1},
+          "status": {"type": "string", "enum": ["success", "warning", "error"]},
+          "code": {"type": "integer"},
+          "message": {"type": "string"}
+        },
+        "required": ["name", "status"],
+        "additionalProperties": false
+      }
+    },
+    "metrics": {
+      "type": "object",
+      "additionalProperties": {"type": "number"}
+    }
+  },
+  "required": ["status"],
+  "additionalProperties": false
+}`
+
+// scriptResult is the result an agent script reported in its result file.
+type scriptResult struct {
+	Status       string             `json:"status"`
+	Message      string             `json:"message"`
+	AgentVersion string             `json:"agentVersion"`
+	Substatus    []scriptSubstatus  `json:"substatus"`
+	Metrics      map[string]float64 `json:"metrics"`
+}
+
+type scriptSubstatus struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// statusTypes maps the statuses of the result file to status types.
+var statusTypes = map[string]status.Type{
+	"success": status.Success,
+	"warning": status.Warning,
+	"error":   status.Error,
+}
+
+// scriptResultPath returns the path of the result file of a script run.
+func scriptResultPath(sc scriptContext) string {
+	if sc.ResultFile != "" {
+		return sc.ResultFile
+	}
+	if sc.OutputDir == "" {
+		return ""
+	}
+	return filepath.Join(sc.OutputDir, scriptResultFileName)
+}
+
+// userResultDir creates a directory for the result file of scripts run as the
+// user, as they may not reach the output directory of the run: the extension
+// directory is only accessible to root. The directory is in the temp dir and
+// owned by the user. It returns "" for root, and for unknown users, which
+// Exec reports.
+func userResultDir(name string) (string, error) {
+	cred, err := scriptCredential(name)
+	if err != nil || cred == nil {
+		return "", nil
+	}
+	dir, err := ioutil.TempDir("", "gc-result")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create script result dir")
+	}
+	if err := os.Chown(dir, int(cred.Uid), int(cred.Gid)); err != nil {
+		os.RemoveAll(dir)
+		return "", errors.Wrapf(err, "failed to hand the script result dir to %s", name)
+	}
+	return dir, nil
+}
+
+// readScriptResult reads and validates the result file at path. It returns
+// nil without error if the script wrote no result file. A symbolic link is
+// not followed, as the file may be written by an unprivileged script user.
+func readScriptResult(path string) (*scriptResult, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to open script result")
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxScriptResultSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read script result")
+	}
+	if len(b) > maxScriptResultSize {
+		return nil, errors.Errorf("script result is larger than %d bytes", maxScriptResultSize)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(scriptResultSchema))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load script result schema")
+	}
+	if err := validateObjectJSON(schema, string(b)); err != nil {
+		return nil, errors.Wrap(err, "invalid script result JSON")
+	}
+	var r scriptResult
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Wrap(err, "failed to parse script result")
+	}
+	return &r, nil
+}
+
+// applyScriptResult folds the result of a script run into the status and
+// telemetry of the operation. It returns an error if the script reported one.
+func applyScriptResult(lg ExtensionLogger, sc scriptContext, r *scriptResult, elapsed time.Duration) error {
+	lg.customLog(logEvent, "script result", "operation", sc.Operation, "status", r.Status, "message", r.Message,
+		"agentVersion", r.AgentVersion)
+
+	if r.AgentVersion != "" && r.AgentVersion != agentVersion() {
+		if err := saveAgentVersion(r.AgentVersion); err != nil {
+			lg.eventError("failed to save agent version", err)
+		}
+	}
+	for _, s := range r.Substatus {
+		addSubstatus(s.Name, statusTypes[s.Status], s.Code, s.Message)
+	}
+	if r.Status == "warning" {
+		addSubstatus(substatusScriptResult, status.Warning, 0, sc.Operation+": "+r.Message)
+	}
+
+	var params []interface{}
+	names := make([]string, 0, len(r.Metrics))
+	for n := range r.Metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		params = append(params, telemetryParameterDouble{Name: "Metric." + n, Value: r.Metrics[n]})
+	}
+	msg := sc.Operation + " script reported " + r.Status
+	if r.Message != "" {
+		msg += ": " + r.Message
+	}
+	telemetry(TelemetryScenario, msg, r.Status != "error", elapsed, params...)
+
+	if r.Status == "error" {
+		m := r.Message
+		if m == "" {
+			m = "no message"
+		}
+		return errors.New("script reported an error: " + strings.TrimSpace(m))
+	}
+	return nil
+}
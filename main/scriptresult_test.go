@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/stretchr/testify/require"
+)
+
+type telemetryCall struct {
+	message string
+	success bool
+	params  []interface{}
+}
+
+// captureTelemetry records the telemetry events until the returned function
+// is called.
+func captureTelemetry(calls *[]telemetryCall) func() {
+	old := telemetry
+	telemetry = func(_, msg string, ok bool, _ time.Duration, params ...interface{}) error {
+		*calls = append(*calls, telemetryCall{msg, ok, params})
+		return nil
+	}
+	return func() { telemetry = old }
+}
+
+// runResultScript runs a stub agent script for the enable operation with the
+// given body in the current directory.
+func runResultScript(t *testing.T, body string) error {
+	_, agentDir := getAgentPaths()
+	require.Nil(t, os.MkdirAll(agentDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(agentDir, "enable.sh"), []byte(body), 0744))
+	sc := scriptContext{Operation: "enable", SeqNum: 2, OutputDir: scriptOutputDir(2, "enable")}
+	_, err := runCmd(noopLogger, "bash ./enable.sh", agentDir, sc, handlerSettings{})
+	return err
+}
+
+func Test_runCmd_scriptResultAsUser(t *testing.T) {
+	if u, err := user.Current(); err != nil || u.Uid != "0" {
+		t.Skip("running scripts as another user requires root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("no nobody user")
+	}
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chmod(wd, 0755)) // the agent dir must be reachable, the output dir is not
+
+	_, agentDir := getAgentPaths()
+	require.Nil(t, os.MkdirAll(agentDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(agentDir, "enable.sh"),
+		[]byte(`echo '{"status": "warning", "message": "as nobody"}' > "$GC_RESULT_FILE"`), 0755))
+	var cfg handlerSettings
+	cfg.publicSettings.ScriptLimits = map[string]scriptLimits{"enable": {User: "nobody"}}
+	sc := scriptContext{Operation: "enable", SeqNum: 2, OutputDir: scriptOutputDir(2, "enable")}
+	_, err = runCmd(noopLogger, "bash ./enable.sh", agentDir, sc, cfg)
+	require.Nil(t, err)
+
+	require.Len(t, substatus, 1)
+	require.Equal(t, status.Warning, substatus[0].Status)
+	require.Equal(t, "enable: as nobody", substatus[0].FormattedMessage.Message)
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "gc-result*"))
+	require.Empty(t, matches, "the result dir is removed")
+}
+
+func Test_readScriptResult_noSymlinks(t *testing.T) {
+	defer inTempDir(t)()
+	require.Nil(t, ioutil.WriteFile("secret", []byte(`{"status": "success"}`), 0600))
+	require.Nil(t, os.Symlink("secret", "result.json"))
+	_, err := readScriptResult("result.json")
+	require.NotNil(t, err)
+}
+
+func Test_runCmd_scriptResult(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+	var calls []telemetryCall
+	defer captureTelemetry(&calls)()
+
+	err := runResultScript(t, `cat > "$GC_RESULT_FILE" <<EOF
+{"status": "success", "message": "3 policies applied", "agentVersion": "1.29.2",
+ "substatus": [{"name": "Policies", "status": "success", "message": "3 applied"},
+               {"name": "Proxy", "status": "warning", "code": 7, "message": "no proxy"}],
+ "metrics": {"policiesApplied": 3, "durationSeconds": 1.5}}
+EOF`)
+	require.Nil(t, err)
+	require.Equal(t, "1.29.2", agentVersion(), "reported agent version is saved")
+
+	require.Len(t, substatus, 2)
+	require.Equal(t, "Policies", substatus[0].Name)
+	require.Equal(t, status.Warning, substatus[1].Status)
+	require.Equal(t, 7, substatus[1].Code)
+
+	var result *telemetryCall
+	for i, c := range calls {
+		if strings.Contains(c.message, "script reported") {
+			result = &calls[i]
+		}
+	}
+	require.NotNil(t, result)
+	require.Equal(t, "enable script reported success: 3 policies applied", result.message)
+	require.True(t, result.success)
+	b, _ := json.Marshal(result.params)
+	require.JSONEq(t, `[{"name": "Metric.durationSeconds", "value": 1.5}, {"name": "Metric.policiesApplied", "value": 3}]`, string(b))
+}
+
+func Test_runCmd_scriptResultError(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+
+	err := runResultScript(t, `echo '{"status": "error", "message": "policy engine crashed"}' > "$GC_RESULT_FILE"; exit 0`)
+	require.NotNil(t, err, "reported error fails the command despite exit code 0")
+	require.Contains(t, err.Error(), "script reported an error: policy engine crashed")
+}
+
+func Test_runCmd_scriptResultWarning(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+
+	require.Nil(t, runResultScript(t, `echo '{"status": "warning", "message": "slow disk"}' > "$GC_RESULT_FILE"`))
+	require.Len(t, substatus, 1)
+	require.Equal(t, substatusScriptResult, substatus[0].Name)
+	require.Equal(t, "enable: slow disk", substatus[0].FormattedMessage.Message)
+}
+
+func Test_runCmd_noScriptResult(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+
+	require.Nil(t, runResultScript(t, "exit 0"))
+	require.NotNil(t, runResultScript(t, "exit 1"), "the exit code decides")
+
+	// a non-zero exit code fails even with a success result
+	require.NotNil(t, runResultScript(t, `echo '{"status": "success"}' > "$GC_RESULT_FILE"; exit 2`))
+
+	// the result of an earlier run is removed first
+	require.NotNil(t, runResultScript(t, `echo '{"status": "error"}' > "$GC_RESULT_FILE"; exit 0`))
+	require.Nil(t, runResultScript(t, "exit 0"))
+	require.Empty(t, substatus)
+}
+
+func Test_runCmd_invalidScriptResult(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+
+	require.Nil(t, runResultScript(t, `echo '{"status": "done"}' > "$GC_RESULT_FILE"`), "falls back to the exit code")
+	require.Len(t, substatus, 1)
+	require.Equal(t, status.Warning, substatus[0].Status)
+	require.Contains(t, substatus[0].FormattedMessage.Message, "invalid result file of enable")
+
+	substatus = nil
+	require.NotNil(t, runResultScript(t, `echo 'not json' > "$GC_RESULT_FILE"; exit 1`))
+	require.Len(t, substatus, 1)
+}
+
+func Test_readScriptResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, scriptResultFileName)
+
+	r, err := readScriptResult(path)
+	require.Nil(t, err)
+	require.Nil(t, r, "no result file")
+
+	for _, invalid := range []string{
+		``,
+		`{"message": "no status"}`,
+		`{"status": "success", "metrics": {"count": "three"}}`,
+		`{"status": "success", "agentVersion": "latest"}`,
+		`{"status": "success", "substatus": [{"status": "success"}]}`,
+		`{"status": "success", "extra": 1}`,
+		`{"status": "success", "message": "` + strings.Repeat("x", maxScriptResultSize) + `"}`,
+	} {
+		require.Nil(t, ioutil.WriteFile(path, []byte(invalid), 0644))
+		_, err = readScriptResult(path)
+		require.NotNil(t, err, invalid)
+	}
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{"status": "success", "metrics": {"count": 3}}`), 0644))
+	r, err = readScriptResult(path)
+	require.Nil(t, err)
+	require.Equal(t, &scriptResult{Status: "success", Metrics: map[string]float64{"count": 3}}, r)
+}
@@ -1,22 +1,70 @@
 package main
 
 import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
-	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
 	"github.com/pkg/errors"
 )
 
+const (
+	// agentReportsDir is where the agent writes a report for every compliance run
+	agentReportsDir = "/var/lib/GuestConfig/reports"
+
+	substatusAgentVersion      = "AgentVersion"
+	substatusAgentHealth       = "AgentHealth"
+	substatusLastComplianceRun = "LastComplianceRun"
+)
+
+// substatus collects the substatus entries of the current operation, which
+// are reported with its final status.
+var substatus []status.Substatus
+
+// addSubstatus records a substatus entry for the current operation.
+func addSubstatus(name string, t status.Type, code int, msg string) {
+	substatus = append(substatus, status.NewSubstatus(name, t, code, msg))
+}
+
 // reportStatus saves operation status to the status file for the extension
-// handler with the optional given message, if the given cmd requires reporting
-// status.
+// handler with the given code, the optional given message, the agent version
+// and the substatus collected so far, if the given cmd requires reporting
+// status. A success is reported as a warning if any collected substatus is not
+// successful.
 //
 // If an error occurs reporting the status, it will be logged and returned.
-func reportStatus(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int, t status.Type, c cmd, msg string) error {
+func reportStatus(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int, t status.Type, c cmd, code int, msg string) error {
 	if !c.shouldReportStatus {
 		lg.customLog("status", "not reported for operation (by design)")
 		return nil
 	}
-	s := status.NewStatus(t, c.name, statusMsg(c, t, msg))
+	version := agentVersionSubstatus()
+	if t == status.Success {
+		for _, s := range substatus {
+			if s.Status != status.Success {
+				t = status.Warning
+			}
+		}
+	}
+	msg = statusMsg(c, t, msg)
+	if version.Status == status.Success {
+		msg += " (agent " + version.FormattedMessage.Message + ")"
+	}
+	return saveStatus(lg, hEnv, seqNum, t, c.name, code, msg, version)
+}
+
+// saveStatus saves the status of the operation with the given substatus
+// followed by the substatus collected so far, regardless of whether the
+// operation reports status by default.
+func saveStatus(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int, t status.Type, operation string, code int, msg string, sub ...status.Substatus) error {
+	if dryRun() {
+		planStatus(hEnv.HandlerEnvironment.StatusFolder, seqNum, string(t), code, msg)
+		return nil
+	}
+	s := status.New(t, operation, code, secrets.String(msg)).WithSubstatus(redactSubstatus(sub)...).
+		WithSubstatus(redactSubstatus(substatus)...)
 	if err := s.Save(hEnv.HandlerEnvironment.StatusFolder, seqNum); err != nil {
 		lg.eventError("failed to save handler status", err)
 		return errors.Wrap(err, "failed to save handler status")
@@ -24,6 +72,17 @@ func reportStatus(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNu
 	return nil
 }
 
+// redactSubstatus returns a copy of the substatus entries with the secrets in
+// their messages redacted.
+func redactSubstatus(sub []status.Substatus) []status.Substatus {
+	out := make([]status.Substatus, len(sub))
+	for i, s := range sub {
+		s.FormattedMessage.Message = secrets.String(s.FormattedMessage.Message)
+		out[i] = s
+	}
+	return out
+}
+
 // statusMsg creates the reported status message based on the provided operation
 // type and the given message string.
 //
@@ -32,11 +91,13 @@ func reportStatus(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNu
 func statusMsg(c cmd, t status.Type, msg string) string {
 	s := c.name
 	switch t {
-	case status.StatusSuccess:
+	case status.Success:
 		s += " succeeded"
-	case status.StatusTransitioning:
+	case status.Warning:
+		s += " succeeded with warnings"
+	case status.Transitioning:
 		s += " in progress"
-	case status.StatusError:
+	case status.Error:
 		s += " failed"
 	}
 
@@ -46,3 +107,42 @@ func statusMsg(c cmd, t status.Type, msg string) string {
 	}
 	return s
 }
+
+// addAgentSubstatus records the agent health and the time of the last
+// compliance run as substatus. A non-nil healthErr is reported with the given
+// code.
+func addAgentSubstatus(healthErr error, code int) {
+	if healthErr != nil {
+		addSubstatus(substatusAgentHealth, status.Error, code, healthErr.Error())
+	} else {
+		addSubstatus(substatusAgentHealth, status.Success, 0, "healthy")
+	}
+
+	if t, ok := lastComplianceRun(agentReportsDir); ok {
+		addSubstatus(substatusLastComplianceRun, status.Success, 0, t.UTC().Format(time.RFC3339))
+	} else {
+		addSubstatus(substatusLastComplianceRun, status.Success, 0, "no compliance run yet")
+	}
+}
+
+// lastComplianceRun returns the modification time of the most recent report
+// in dir or its subdirectories.
+func lastComplianceRun(dir string) (last time.Time, found bool) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return last, false
+	}
+	for _, f := range files {
+		t := f.ModTime()
+		if f.IsDir() {
+			var ok bool
+			if t, ok = lastComplianceRun(filepath.Join(dir, f.Name())); !ok {
+				continue
+			}
+		}
+		if t.After(last) {
+			last, found = t, true
+		}
+	}
+	return last, found
+}
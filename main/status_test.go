@@ -1,36 +1,38 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
-	"github.com/Azure/azure-docker-extension/pkg/vmextension/status"
 	"github.com/stretchr/testify/require"
 )
 
 var (
-	cmdEnable = cmd{enable, "enable", true, enablePre, 3}
+	cmdEnable = cmd{enable, "enable", true, enablePre, 3, false}
 )
 
 func Test_statusMsg(t *testing.T) {
-	require.Equal(t, "enable succeeded", statusMsg(cmdEnable, status.StatusSuccess, ""))
-	require.Equal(t, "enable succeeded: msg", statusMsg(cmdEnable, status.StatusSuccess, "msg"))
+	require.Equal(t, "enable succeeded", statusMsg(cmdEnable, status.Success, ""))
+	require.Equal(t, "enable succeeded: msg", statusMsg(cmdEnable, status.Success, "msg"))
 
-	require.Equal(t, "enable failed", statusMsg(cmdEnable, status.StatusError, ""))
-	require.Equal(t, "enable failed: msg", statusMsg(cmdEnable, status.StatusError, "msg"))
+	require.Equal(t, "enable failed", statusMsg(cmdEnable, status.Error, ""))
+	require.Equal(t, "enable failed: msg", statusMsg(cmdEnable, status.Error, "msg"))
 
-	require.Equal(t, "enable in progress", statusMsg(cmdEnable, status.StatusTransitioning, ""))
-	require.Equal(t, "enable in progress: msg", statusMsg(cmdEnable, status.StatusTransitioning, "msg"))
+	require.Equal(t, "enable in progress", statusMsg(cmdEnable, status.Transitioning, ""))
+	require.Equal(t, "enable in progress: msg", statusMsg(cmdEnable, status.Transitioning, "msg"))
 }
 
 func Test_reportStatus_fails(t *testing.T) {
 	fakeEnv := vmextension.HandlerEnvironment{}
 	fakeEnv.HandlerEnvironment.StatusFolder = "/non-existing/dir/"
 
-	err := reportStatus(noopLogger, fakeEnv, 1, status.StatusSuccess, cmdEnable, "")
+	err := reportStatus(noopLogger, fakeEnv, 1, status.Success, cmdEnable, 0, "")
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "failed to save handler status")
 }
@@ -43,7 +45,7 @@ func Test_reportStatus_fileExists(t *testing.T) {
 	fakeEnv := vmextension.HandlerEnvironment{}
 	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
 
-	require.Nil(t, reportStatus(noopLogger, fakeEnv, 1, status.StatusError, cmdEnable, "FOO ERROR"))
+	require.Nil(t, reportStatus(noopLogger, fakeEnv, 1, status.Error, cmdEnable, enableCode, "FOO ERROR"))
 
 	path := filepath.Join(tmpDir, "1.status")
 	b, err := ioutil.ReadFile(path)
@@ -59,7 +61,7 @@ func Test_reportStatus_checksIfShouldBeReported(t *testing.T) {
 
 		fakeEnv := vmextension.HandlerEnvironment{}
 		fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
-		require.Nil(t, reportStatus(noopLogger, fakeEnv, 2, status.StatusSuccess, c, ""))
+		require.Nil(t, reportStatus(noopLogger, fakeEnv, 2, status.Success, c, 0, ""))
 
 		fp := filepath.Join(tmpDir, "2.status")
 		_, err = os.Stat(fp) // check if the .status file is there
@@ -75,3 +77,68 @@ func Test_reportStatus_checksIfShouldBeReported(t *testing.T) {
 		}
 	}
 }
+
+func Test_statusMsg_warning(t *testing.T) {
+	require.Equal(t, "enable succeeded with warnings: msg", statusMsg(cmdEnable, status.Warning, "msg"))
+}
+
+func Test_reportStatus_codeAndSubstatus(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	defer func() { substatus = nil }()
+
+	fakeEnv := vmextension.HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+
+	addSubstatus(substatusAgentVersion, status.Success, 0, "1.9.0")
+	addSubstatus(substatusAgentHealth, status.Error, agentHealthCheckFailedCode, "unhealthy")
+	require.Nil(t, reportStatus(noopLogger, fakeEnv, 1, status.Success, cmdEnable, successCode, ""))
+
+	var r status.Report
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(b, &r))
+	require.Len(t, r, 1)
+	require.Equal(t, status.Warning, r[0].Status.Status, "unhealthy substatus turns success into warning")
+	require.Equal(t, successCode, r[0].Status.Code)
+	require.Len(t, r[0].Status.Substatus, 3)
+	require.Equal(t, substatusAgentVersion, r[0].Status.Substatus[0].Name, "agent version comes first")
+	require.Equal(t, agentHealthCheckFailedCode, r[0].Status.Substatus[2].Code)
+}
+
+func Test_packagedAgentVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = packagedAgentVersion(dir, AgentName)
+	require.NotNil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "GC_1.9.0.zip"), nil, 0644))
+	v, err := packagedAgentVersion(dir, AgentName)
+	require.Nil(t, err)
+	require.Equal(t, "1.9.0", v)
+}
+
+func Test_lastComplianceRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, ok := lastComplianceRun(dir)
+	require.False(t, ok)
+
+	latest := time.Date(2019, 12, 23, 11, 0, 0, 0, time.UTC)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "assignment"), 0755))
+	for p, mt := range map[string]time.Time{
+		"old.json":                   latest.Add(-time.Hour),
+		"assignment/compliance.json": latest,
+	} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, p), nil, 0644))
+		require.Nil(t, os.Chtimes(filepath.Join(dir, p), mt, mt))
+	}
+	last, ok := lastComplianceRun(dir)
+	require.True(t, ok)
+	require.True(t, latest.Equal(last), "got %v", last)
+}
@@ -25,6 +25,11 @@ type telemetryParameterLong struct {
 	Value int64  `json:"value"`
 }
 
+type telemetryParameterDouble struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
 type telemetryParameterBool struct {
 	Name  string `json:"name"`
 	Value bool   `json:"value"`
@@ -36,12 +41,15 @@ type telemetryEvent struct {
 	Parameters []interface{} `json:"parameters"`
 }
 
+// telemetryEventWriter writes every event to a new file in the events
+// directory of the guest agent.
 type telemetryEventWriter struct {
-	fh *os.File
+	dir string
+	fh  *os.File
 }
 
 func (w *telemetryEventWriter) Write(bs []byte) (n int, err error) {
-	fn := getTelemetryFileName()
+	fn := getTelemetryFileName(w.dir)
 	temp := fn + ".tmp"
 
 	fh, err := os.OpenFile(temp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0400)
@@ -64,18 +72,40 @@ func (w *telemetryEventWriter) Close() (err error) {
 	return
 }
 
+// telemetryEventSender is a TelemetrySink writing the events in JSON format to
+// a writer, which is closed after every event.
 type telemetryEventSender struct {
 	writer io.WriteCloser
 }
 
-func newTelemetryEventSender() *telemetryEventSender {
-	return newTelemetryEventSenderWithWriteCloser(&telemetryEventWriter{})
+// newTelemetryEventSender returns a sink writing to the events directory dir.
+func newTelemetryEventSender(dir string) *telemetryEventSender {
+	return newTelemetryEventSenderWithWriteCloser(&telemetryEventWriter{dir: dir})
 }
 
-func sendTelemetry(sender *telemetryEventSender, name, version string) func(operation, message string, isSuccess bool, duration time.Duration) error {
-	return func(operation, message string, isSuccess bool, duration time.Duration) error {
+// sendTelemetry returns the function sending the telemetry events of the
+// extension with the given name and version to sink.
+func sendTelemetry(sink TelemetrySink, name, version string) func(operation, message string, isSuccess bool, duration time.Duration, params ...interface{}) error {
+	return func(operation, message string, isSuccess bool, duration time.Duration, params ...interface{}) error {
 		e := newTelemetryEvent(name, version, operation, message, isSuccess, duration)
-		return sender.send(e)
+		e.Parameters = append(e.Parameters, telemetryParameterString{Name: "AgentVersion", Value: agentVersion()})
+		e.Parameters = append(e.Parameters, params...)
+		e.redact()
+		if err := sink.Send(e); err != nil {
+			observeDroppedTelemetry()
+			return err
+		}
+		return nil
+	}
+}
+
+// redact removes the secrets from the string parameters of the event.
+func (e telemetryEvent) redact() {
+	for i, p := range e.Parameters {
+		if s, ok := p.(telemetryParameterString); ok {
+			s.Value = secrets.String(s.Value)
+			e.Parameters[i] = s
+		}
 	}
 }
 
@@ -83,7 +113,8 @@ func newTelemetryEventSenderWithWriteCloser(writer io.WriteCloser) *telemetryEve
 	return &telemetryEventSender{writer: writer}
 }
 
-func (w *telemetryEventSender) send(e telemetryEvent) error {
+// Send writes the event to the writer.
+func (w *telemetryEventSender) Send(e telemetryEvent) error {
 	defer w.writer.Close()
 
 	bs, err := json.Marshal(e)
@@ -99,9 +130,9 @@ func (w *telemetryEventSender) send(e telemetryEvent) error {
 	return nil
 }
 
-func getTelemetryFileName() string {
+func getTelemetryFileName(dir string) string {
 	fn := fmt.Sprintf("%d.tld", time.Now().UnixNano())
-	return path.Join(telemetryEventsPath, fn)
+	return path.Join(dir, fn)
 }
 
 func newTelemetryEvent(name, version, operation, message string, isSuccess bool, duration time.Duration) telemetryEvent {
@@ -93,7 +93,7 @@ func Test_telemetryEventSender(t *testing.T) {
 	event := newTelemetryEvent("--Name--", "--Version--", "--Operation--", "--Message--", true, duration)
 
 	testSubject := newTelemetryEventSenderWithWriteCloser(writeCloser)
-	testSubject.send(event)
+	testSubject.Send(event)
 
 	require.Equal(t, true, writeCloser.isClosed, "expected writeCloser to be closed")
 
@@ -131,6 +131,6 @@ func Test_telemetryEventSender(t *testing.T) {
 }
 
 func Test_getTelemetryFileName(t *testing.T) {
-	testSubject := getTelemetryFileName()
+	testSubject := getTelemetryFileName(telemetryEventsPath)
 	require.True(t, regexp.MustCompile("^/var/lib/waagent/events/\\d{19}\\.tld$").Match([]byte(testSubject)), testSubject)
 }
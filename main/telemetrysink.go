@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// telemetrySinksEnv lists the sinks the telemetry events are sent to,
+	// separated by commas, defaultTelemetrySinks if not set:
+	//
+	//	events        the events directory of the guest agent
+	//	events=<dir>  another events directory
+	//	file=<path>   a file with one JSON event per line
+	//	stdout        the console, one JSON event per line
+	//	http=<url>    a collector accepting every event by HTTP POST
+	telemetrySinksEnv     = "GC_EXTENSION_TELEMETRY"
+	defaultTelemetrySinks = "events"
+
+	// telemetryHTTPTimeout bounds posting a single event to a collector
+	telemetryHTTPTimeout = 5 * time.Second
+)
+
+// TelemetrySink receives the telemetry events of the extension.
+type TelemetrySink interface {
+	Send(e telemetryEvent) error
+}
+
+// fanOutSink sends every event to all of its sinks, even if some fail. An
+// empty fanOutSink drops the events.
+type fanOutSink []TelemetrySink
+
+func (f fanOutSink) Send(e telemetryEvent) error {
+	var errs []string
+	for _, s := range f {
+		if err := s.Send(e); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("failed to send telemetry to %d of %d sinks: %s", len(errs), len(f), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// jsonLinesFile appends every write as a line to the file at path.
+type jsonLinesFile struct {
+	path string
+}
+
+func (w jsonLinesFile) Write(bs []byte) (int, error) {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open telemetry file")
+	}
+	defer f.Close()
+	if _, err := f.Write(append(bs, '\n')); err != nil {
+		return 0, errors.Wrap(err, "failed to append to telemetry file")
+	}
+	return len(bs), nil
+}
+
+func (w jsonLinesFile) Close() error { return nil }
+
+// jsonLinesStream writes every write as a line to a stream it does not own,
+// like stdout.
+type jsonLinesStream struct {
+	w io.Writer
+}
+
+func (w jsonLinesStream) Write(bs []byte) (int, error) {
+	if _, err := w.w.Write(append(bs, '\n')); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+func (w jsonLinesStream) Close() error { return nil }
+
+// httpSink posts every event in JSON format to a collector.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(url string) httpSink {
+	return httpSink{url: url, client: &http.Client{Timeout: telemetryHTTPTimeout}}
+}
+
+func (s httpSink) Send(e telemetryEvent) error {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal telemetry event")
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return errors.Wrap(err, "failed to post telemetry event")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("telemetry collector %s responded with %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// parseTelemetrySinks returns the sinks listed in spec, in the format of
+// telemetrySinksEnv.
+func parseTelemetrySinks(spec string) (fanOutSink, error) {
+	var sinks fanOutSink
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, arg := entry, ""
+		if i := strings.Index(entry, "="); i >= 0 {
+			kind, arg = entry[:i], entry[i+1:]
+		}
+		switch {
+		case kind == "events":
+			if arg == "" {
+				arg = telemetryEventsPath
+			}
+			sinks = append(sinks, newTelemetryEventSender(arg))
+		case kind == "file" && arg != "":
+			sinks = append(sinks, newTelemetryEventSenderWithWriteCloser(jsonLinesFile{arg}))
+		case kind == "stdout" && arg == "":
+			sinks = append(sinks, newTelemetryEventSenderWithWriteCloser(jsonLinesStream{os.Stdout}))
+		case kind == "http" && arg != "":
+			u, err := url.Parse(arg)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, errors.Errorf("invalid telemetry collector URL %q", arg)
+			}
+			sinks = append(sinks, newHTTPSink(arg))
+		default:
+			return nil, errors.Errorf("invalid telemetry sink %q", entry)
+		}
+	}
+	return sinks, nil
+}
+
+// configureTelemetry sends the telemetry events to the sinks configured in
+// telemetrySinksEnv. An invalid configuration is logged and replaced by the
+// default sinks.
+func configureTelemetry(lg ExtensionLogger) {
+	spec := os.Getenv(telemetrySinksEnv)
+	if spec == "" {
+		spec = defaultTelemetrySinks
+	}
+	sinks, err := parseTelemetrySinks(spec)
+	if err != nil {
+		lg.eventError("invalid telemetry configuration, using the default sinks", err)
+		spec = defaultTelemetrySinks
+		sinks, _ = parseTelemetrySinks(spec)
+	}
+	lg.customLog(logEvent, "telemetry configured", "sinks", spec)
+	telemetry = sendTelemetry(sinks, fullName, Version)
+}
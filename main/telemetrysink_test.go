@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// collector is a local telemetry collector recording the posted events.
+type collector struct {
+	mu     sync.Mutex
+	events []telemetryEvent
+	status int
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+		return
+	}
+	var e telemetryEvent
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" ||
+		json.NewDecoder(r.Body).Decode(&e) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.events = append(c.events, e)
+}
+
+// eventMessage returns the Message parameter of a decoded event.
+func eventMessage(e telemetryEvent) string {
+	for _, p := range e.Parameters {
+		if m, ok := p.(map[string]interface{}); ok && m["name"] == "Message" {
+			return m["value"].(string)
+		}
+	}
+	return ""
+}
+
+func Test_parseTelemetrySinks(t *testing.T) {
+	sinks, err := parseTelemetrySinks(defaultTelemetrySinks)
+	require.Nil(t, err)
+	require.Equal(t, fanOutSink{newTelemetryEventSender(telemetryEventsPath)}, sinks)
+
+	sinks, err = parseTelemetrySinks(" events=/tmp/events, file=/tmp/t.jsonl,stdout, http=http://127.0.0.1:8080/events ,")
+	require.Nil(t, err)
+	require.Len(t, sinks, 4)
+	require.Equal(t, newTelemetryEventSender("/tmp/events"), sinks[0])
+	require.Equal(t, newTelemetryEventSenderWithWriteCloser(jsonLinesFile{"/tmp/t.jsonl"}), sinks[1])
+	require.Equal(t, "http://127.0.0.1:8080/events", sinks[3].(httpSink).url)
+
+	for _, invalid := range []string{"syslog", "file", "file=", "stdout=x", "http=", "http=ftp://host/x", "http=/events"} {
+		_, err := parseTelemetrySinks(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
+
+func Test_fanOutSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	eventsDir := filepath.Join(dir, "events")
+	require.Nil(t, os.Mkdir(eventsDir, 0755))
+	jsonLines := filepath.Join(dir, "telemetry.jsonl")
+
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	sinks, err := parseTelemetrySinks("events=" + eventsDir + ",file=" + jsonLines + ",http=" + srv.URL)
+	require.Nil(t, err)
+	send := sendTelemetry(sinks, "name", "1.0")
+	require.Nil(t, send("enable", "first", true, 0))
+	require.Nil(t, send("enable", "second", false, 0))
+
+	files, err := ioutil.ReadDir(eventsDir)
+	require.Nil(t, err)
+	require.Len(t, files, 2, "one file per event")
+
+	b, err := ioutil.ReadFile(jsonLines)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	require.Len(t, lines, 2, "one line per event")
+	var e telemetryEvent
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &e))
+	require.Equal(t, "second", eventMessage(e))
+
+	require.Len(t, c.events, 2)
+	require.Equal(t, "first", eventMessage(c.events[0]))
+
+	// a failing sink does not keep the event from the others
+	c.status = http.StatusServiceUnavailable
+	err = send("enable", "third", true, 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to send telemetry to 1 of 3 sinks")
+	require.Contains(t, err.Error(), "503 Service Unavailable")
+	files, _ = ioutil.ReadDir(eventsDir)
+	require.Len(t, files, 3)
+
+	require.Nil(t, fanOutSink{}.Send(telemetryEvent{}), "no sinks drop the event")
+}
+
+type failingSink struct{}
+
+func (failingSink) Send(telemetryEvent) error { return errors.New("sink down") }
+
+func Test_httpSink_unreachable(t *testing.T) {
+	srv := httptest.NewServer(&collector{})
+	srv.Close()
+	err := newHTTPSink(srv.URL).Send(telemetryEvent{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to post telemetry event")
+
+	err = fanOutSink{failingSink{}, failingSink{}}.Send(telemetryEvent{})
+	require.EqualError(t, err, "failed to send telemetry to 2 of 2 sinks: sink down; sink down")
+}
+
+func Test_configureTelemetry(t *testing.T) {
+	old := telemetry
+	defer func() { telemetry = old }()
+	defer os.Unsetenv(telemetrySinksEnv)
+
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	os.Setenv(telemetrySinksEnv, "http="+srv.URL)
+	configureTelemetry(noopLogger)
+	require.Nil(t, telemetry(TelemetryScenario, "configured", true, 0))
+	require.Len(t, c.events, 1)
+
+	// an invalid configuration falls back to the events directory
+	b := captureLog()
+	defer resetLog()
+	os.Setenv(telemetrySinksEnv, "syslog")
+	configureTelemetry(noopLogger)
+	require.Contains(t, b.String(), `invalid telemetry sink "syslog"`)
+	require.Contains(t, b.String(), "sinks="+defaultTelemetrySinks)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+)
+
+const substatusUpdateFailure = "UpdateFailure"
+
+// updateFailure is the content of the update failure marker. update cannot
+// fail without sending the guest agent into a loop, so it records the failure
+// for the next enable to report and repair.
+type updateFailure struct {
+	TimeUTC      string `json:"timeUTC"`
+	SeqNum       int    `json:"seqNum"`
+	AgentVersion string `json:"agentVersion,omitempty"`
+	Error        string `json:"error"`
+}
+
+// updateFailurePath returns the path of the update failure marker.
+func updateFailurePath() string {
+	return filepath.Join(DataDir, UpdateFailFileName)
+}
+
+func (f updateFailure) String() string {
+	return fmt.Sprintf("update of agent %s at %s (seqNum %d) failed: %s", f.AgentVersion, f.TimeUTC, f.SeqNum, f.Error)
+}
+
+// writeUpdateFailure writes the update failure marker with the details of
+// updateErr.
+func writeUpdateFailure(seqNum int, updateErr error) error {
+	f := updateFailure{
+		TimeUTC:      time.Now().UTC().Format(time.RFC3339),
+		SeqNum:       seqNum,
+		AgentVersion: agentVersion(),
+		Error:        updateErr.Error(),
+	}
+	if dryRun() {
+		plan.add("write update failure marker %s: %s", updateFailurePath(), f)
+		return nil
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal update failure")
+	}
+	return errors.Wrap(ioutil.WriteFile(updateFailurePath(), b, 0644), "failed to write update failure marker")
+}
+
+// readUpdateFailure returns the recorded update failure, or nil if there is
+// none. A marker that cannot be parsed is returned with its raw content as
+// the error.
+func readUpdateFailure() (*updateFailure, error) {
+	b, err := ioutil.ReadFile(updateFailurePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read update failure marker")
+	}
+	var f updateFailure
+	if err := json.Unmarshal(b, &f); err != nil {
+		f = updateFailure{Error: string(b)}
+	}
+	return &f, nil
+}
+
+// clearUpdateFailure removes the update failure marker.
+func clearUpdateFailure() error {
+	if dryRun() {
+		plan.add("remove update failure marker %s", updateFailurePath())
+		return nil
+	}
+	if err := os.Remove(updateFailurePath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove update failure marker")
+	}
+	return nil
+}
+
+// handleUpdateFailure reports an update failure recorded by an earlier update
+// in status and telemetry, and stops and uninstalls the half-updated agent
+// with its disable.sh and uninstall.sh before removing it, so enable
+// reinstalls it from scratch. It returns true if there was a failure to
+// handle. If the agent cannot be uninstalled, it is kept with the marker and
+// the error is returned, so that the next enable tries again.
+func handleUpdateFailure(lg ExtensionLogger, hEnv vmextension.HandlerEnvironment, seqNum int, cfg handlerSettings) (bool, error) {
+	f, err := readUpdateFailure()
+	if err != nil {
+		lg.eventError("failed to read update failure marker", err)
+		return false, nil
+	} else if f == nil {
+		return false, nil
+	}
+
+	lg.customLog(logEvent, "found update failure marker", logError, f.String())
+	telemetry(TelemetryScenario, "Earlier "+f.String(), false, 0)
+	addSubstatus(substatusUpdateFailure, status.Warning, updateCode, "earlier "+f.String()+", reinstalling the agent")
+
+	unzipDir, agentDirectory := getAgentPaths()
+	if _, err := os.Stat(agentDirectory); err == nil {
+		for _, operation := range []string{"disable", "uninstall"} {
+			lg.event(operation + " agent for a clean reinstall")
+			sc := newScriptContext(hEnv, seqNum, operation)
+			if _, err := runCmd(lg, "bash ./"+operation+".sh", agentDirectory, sc, cfg); err != nil {
+				lg.eventError("failed to "+operation+" the agent for a clean reinstall", err)
+				telemetry(TelemetryScenario, "agent "+operation+" for a clean reinstall failed: "+err.Error(), false, 0)
+				return true, agentScriptFailed(errors.Wrapf(err, "%s.sh", operation),
+					"Removing the agent of the failed update failed")
+			}
+		}
+	}
+
+	if dryRun() {
+		plan.add("remove %s to reinstall the agent", unzipDir)
+	} else if err := os.RemoveAll(unzipDir); err != nil {
+		lg.eventError("failed to remove the agent for a clean reinstall", err)
+	}
+	return true, nil
+}
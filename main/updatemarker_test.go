@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_updateFailure_roundTrip(t *testing.T) {
+	defer inTempDir(t)()
+
+	f, err := readUpdateFailure()
+	require.Nil(t, err)
+	require.Nil(t, f)
+
+	require.Nil(t, writeUpdateFailure(4, errors.New("update.sh exited with 1")))
+	f, err = readUpdateFailure()
+	require.Nil(t, err)
+	require.NotNil(t, f)
+	require.Equal(t, 4, f.SeqNum)
+	require.Equal(t, "update.sh exited with 1", f.Error)
+	_, err = time.Parse(time.RFC3339, f.TimeUTC)
+	require.Nil(t, err)
+
+	require.Nil(t, clearUpdateFailure())
+	require.False(t, fileExists(t, updateFailurePath()))
+	require.Nil(t, clearUpdateFailure(), "clearing a missing marker")
+}
+
+func Test_readUpdateFailure_unparsable(t *testing.T) {
+	defer inTempDir(t)()
+	require.Nil(t, ioutil.WriteFile(updateFailurePath(), []byte("update failed"), 0644))
+
+	f, err := readUpdateFailure()
+	require.Nil(t, err)
+	require.Equal(t, "update failed", f.Error)
+}
+
+func Test_writeUpdateFailure_dryRun(t *testing.T) {
+	defer inTempDir(t)()
+
+	actions := withDryRun(func() {
+		require.Nil(t, writeUpdateFailure(1, errors.New("boom")))
+	})
+	require.Len(t, actions, 1)
+	require.Contains(t, actions[0], "write update failure marker "+updateFailurePath())
+	require.False(t, fileExists(t, updateFailurePath()))
+}
+
+// writeAgentScripts writes the agent scripts by operation, each appending
+// the operation to the "ran" file before running the script.
+func writeAgentScripts(t *testing.T, scripts map[string]string) {
+	_, agentDir := getAgentPaths()
+	require.Nil(t, os.MkdirAll(agentDir, 0755))
+	for operation, script := range scripts {
+		script = "echo " + operation + " >> \"$GC_DATA_DIR/ran\"\n" + script + "\n"
+		require.Nil(t, ioutil.WriteFile(filepath.Join(agentDir, operation+".sh"), []byte(script), 0744))
+	}
+}
+
+func Test_handleUpdateFailure(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+	var events []string
+	defer func(old func(string, string, bool, time.Duration, ...interface{}) error) { telemetry = old }(telemetry)
+	telemetry = func(_, msg string, ok bool, _ time.Duration, _ ...interface{}) error {
+		events = append(events, msg)
+		return nil
+	}
+
+	// nothing to handle
+	reinstall, err := handleUpdateFailure(noopLogger, vmextension.HandlerEnvironment{}, 2, handlerSettings{})
+	require.Nil(t, err)
+	require.False(t, reinstall)
+	require.Empty(t, substatus)
+
+	unzipDir, _ := getAgentPaths()
+	writeAgentScripts(t, map[string]string{"disable": "true", "uninstall": "true"})
+	require.Nil(t, writeUpdateFailure(2, errors.New("update.sh exited with 3")))
+
+	reinstall, err = handleUpdateFailure(noopLogger, vmextension.HandlerEnvironment{}, 2, handlerSettings{})
+	require.Nil(t, err)
+	require.True(t, reinstall)
+	b, err := ioutil.ReadFile("ran")
+	require.Nil(t, err)
+	require.Equal(t, "disable\nuninstall\n", string(b), "the agent is stopped and uninstalled")
+	require.False(t, fileExists(t, unzipDir), "agent removed for a clean reinstall")
+	require.Len(t, substatus, 1)
+	require.Equal(t, substatusUpdateFailure, substatus[0].Name)
+	require.Equal(t, status.Warning, substatus[0].Status)
+	require.Contains(t, substatus[0].FormattedMessage.Message, "update.sh exited with 3")
+	require.Len(t, events, 1)
+	require.Contains(t, events[0], "update.sh exited with 3")
+
+	// the marker stays until the reinstall succeeded
+	require.True(t, fileExists(t, updateFailurePath()))
+
+	// without an agent to uninstall, it is reinstalled right away
+	reinstall, err = handleUpdateFailure(noopLogger, vmextension.HandlerEnvironment{}, 2, handlerSettings{})
+	require.Nil(t, err)
+	require.True(t, reinstall)
+}
+
+func Test_handleUpdateFailure_uninstallFails(t *testing.T) {
+	defer inTempDir(t)()
+	defer func() { substatus = nil }()
+
+	unzipDir, _ := getAgentPaths()
+	writeAgentScripts(t, map[string]string{"disable": "true", "uninstall": "exit 4"})
+	require.Nil(t, writeUpdateFailure(2, errors.New("update.sh exited with 3")))
+
+	reinstall, err := handleUpdateFailure(noopLogger, vmextension.HandlerEnvironment{}, 2, handlerSettings{})
+	require.True(t, reinstall)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "uninstall.sh: failed to execute command: command terminated with exit status=4")
+	require.Equal(t, agentScriptFailedCode, exitCode(err, enableCode))
+	require.True(t, fileExists(t, unzipDir), "the agent is kept")
+	require.True(t, fileExists(t, updateFailurePath()), "the marker is kept for the next enable")
+}
+
+func Test_updateFailurePath(t *testing.T) {
+	require.Equal(t, filepath.Join(DataDir, "update_failed"), updateFailurePath())
+}
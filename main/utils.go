@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"fmt"
 	"github.com/Azure/Guest-Configuration-Extension/pkg/seqnum"
+	"github.com/Azure/Guest-Configuration-Extension/pkg/status"
 	"github.com/mcuadros/go-version"
 	"github.com/pkg/errors"
 	"io"
@@ -11,7 +12,6 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"strings"
 	"time"
 )
 
@@ -129,6 +129,10 @@ func checkAndSaveSeqNum(lg ExtensionLogger, seqNum int, mrseqPath string) (shoul
 		// store sequence number is greater than the current sequence number
 		return true, nil
 	}
+	if dryRun() {
+		plan.add("save sequence number %d to %s", seqNum, mrseqPath)
+		return false, nil
+	}
 	if err := seqnum.Set(mrseqPath, seqNum); err != nil {
 		return false, errors.Wrap(err, "failed to save the sequence number")
 	}
@@ -138,46 +142,90 @@ func checkAndSaveSeqNum(lg ExtensionLogger, seqNum int, mrseqPath string) (shoul
 }
 
 // runCmd runs the command (extracted from cfg) in the given dir (assumed to exist).
-func runCmd(lg ExtensionLogger, cmd string, dir string, cfg handlerSettings) (code int, err error) {
-	lg.customLog(logEvent, "executing command", logOutput, dir)
+func runCmd(lg ExtensionLogger, cmd string, dir string, sc scriptContext, cfg handlerSettings) (code int, err error) {
+	outDir := sc.OutputDir
+	sc.Limits = cfg.publicSettings.limitsFor(sc.Operation)
+	lg.customLog(logEvent, "executing command", "dir", dir, logOutput, outDir)
+	if dryRun() {
+		planScript(cmd, dir, sc)
+		return 0, nil
+	}
+	defer lg.step("run '" + cmd + "'")()
+	pruneScriptOutput(lg)
+	os.Remove(scriptResultPath(sc)) // left by an earlier run for the sequence number
+	if dir, err := userResultDir(sc.Limits.User); err != nil {
+		lg.eventError("failed to create the result dir for the script user", err)
+	} else if dir != "" {
+		defer os.RemoveAll(dir)
+		sc.ResultFile = filepath.Join(dir, scriptResultFileName)
+	}
+	resultFile := scriptResultPath(sc)
 
 	begin := time.Now()
-	code, err = ExecCmdInDir(lg, cmd, dir)
+	code, err = ExecCmdInDir(lg, cmd, dir, sc)
 	elapsed := time.Now().Sub(begin)
+
+	// the result file adds to the exit code, which always fails the command
+	// if not 0; an invalid result file is ignored
+	result, resultErr := readScriptResult(resultFile)
+	if resultErr != nil {
+		lg.customLog(logEvent, "invalid script result", logError, resultErr, "file", resultFile)
+		telemetry(TelemetryScenario, "invalid script result: "+resultErr.Error(), false, 0)
+		addSubstatus(substatusScriptResult, status.Warning, 0, "invalid result file of "+sc.Operation+": "+resultErr.Error())
+	} else if result != nil {
+		if resultErr := applyScriptResult(lg, sc, result, elapsed); resultErr != nil && err == nil {
+			err = resultErr
+		}
+	}
 	isSuccess := err == nil
+	observeScript(sc.Operation, elapsed, isSuccess)
 
 	lg.customLog(logEvent, "command executed", "command", cmd, "isSuccess", isSuccess, "time elapsed", elapsed)
 
 	if err != nil {
-		lg.customLog(logEvent, "failed to execute command", logError, err, logOutput, dir)
+		lg.customLog(logEvent, "failed to execute command", logError, err, logOutput, outDir)
 		return code, errors.Wrap(err, "failed to execute command")
 	}
-	lg.customLog(logEvent, "executed command", logOutput, dir)
+	lg.customLog(logEvent, "executed command", logOutput, outDir)
 	return code, nil
 }
 
-// decompresses a zip archive, moving all files and folders within the zip file
-// to an output directory
-func unzipAgent(lg ExtensionLogger, source string, prefix string, dest string) ([]string, error) {
-	var filenames []string
-	var agentZip = ""
-
+// findAgentZip returns the path of the agent package in the source dir: the
+// highest version of the <prefix>_<version>[_<arch>].zip packages for the
+// architecture of the handler.
+func findAgentZip(source string, prefix string) (string, error) {
 	files, err := ioutil.ReadDir(source)
 	if err != nil {
-		return filenames, errors.Wrap(err, "failed to open the source dir: "+source)
+		return "", errors.Wrap(err, "failed to open the source dir: "+source)
 	}
 
+	var names []string
 	for _, file := range files {
-		if strings.Contains(file.Name(), prefix) {
-			agentZip = filepath.Join(source, file.Name())
+		if file.IsDir() {
+			continue
 		}
+		names = append(names, file.Name())
 	}
 
-	if agentZip == "" {
-		return filenames, errors.New("failed to find zip file " + agentZip)
+	name, err := selectAgentPackage(names, prefix, machineArch)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(source, name), nil
+}
+
+// decompresses a zip archive, moving all files and folders within the zip file
+// to an output directory
+func unzipAgent(lg ExtensionLogger, source string, prefix string, dest string) ([]string, error) {
+	var filenames []string
+
+	agentZip, err := findAgentZip(source, prefix)
+	if err != nil {
+		return filenames, err
 	}
 
 	lg.event("Got the agentZip. Agent is: " + agentZip)
+	defer lg.step("unzip " + agentZip)()
 
 	r, err := zip.OpenReader(agentZip)
 	if err != nil {
@@ -247,8 +295,8 @@ func setPermissions() error {
 	return nil
 }
 
-func getStdPipesAndTelemetry(lg ExtensionLogger, logDir string, runErr error) {
-	stdoutF, stderrF := logPaths(logDir)
+func getStdPipesAndTelemetry(lg ExtensionLogger, outDir string, runErr error) {
+	stdoutF, stderrF := logPaths(outDir)
 	stdoutTail, err := tailFile(stdoutF, maxTailLen)
 	if err != nil {
 		lg.eventError("error tailing stdout logs", err)
@@ -269,3 +317,13 @@ func getStdPipesAndTelemetry(lg ExtensionLogger, logDir string, runErr error) {
 	isSuccess := runErr == nil
 	telemetry("output", msgTelemetry, isSuccess, 0)
 }
+
+// removeTempArtifact removes a temporary file or directory created by the
+// handler. With -debug it is kept for inspection instead.
+func removeTempArtifact(lg ExtensionLogger, path string) {
+	if lg.flags.debug {
+		lg.debugf("keeping temporary artifact: %s", path)
+		return
+	}
+	os.RemoveAll(path)
+}
@@ -85,7 +85,7 @@ func Test_runCmd_fail(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	_, err = runCmd(noopLogger, "wrongCmd", dir, handlerSettings{})
+	_, err = runCmd(noopLogger, "wrongCmd", dir, scriptContext{OutputDir: dir}, handlerSettings{})
 	require.NotNil(t, err)
 }
 
@@ -94,7 +94,7 @@ func Test_runCmd_success(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	_, err = runCmd(noopLogger, "date", dir, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date"}})
+	_, err = runCmd(noopLogger, "date", dir, scriptContext{OutputDir: dir}, handlerSettings{publicSettings: publicSettings{CommandToExecute: "date"}})
 	require.Nil(t, err, "command should run successfully")
 
 	// check stdout stderr files
@@ -102,7 +102,7 @@ func Test_runCmd_success(t *testing.T) {
 	require.Nil(t, err, "stdout should exist")
 	_, err = os.Stat(filepath.Join(dir, "stderr"))
 	require.Nil(t, err, "stderr should exist")
-	_, err = runCmd(noopLogger, "", dir, handlerSettings{})
+	_, err = runCmd(noopLogger, "", dir, scriptContext{OutputDir: dir}, handlerSettings{})
 	require.Nil(t, err)
 
 	// check stdout stderr files
@@ -114,7 +114,7 @@ func Test_runCmd_success(t *testing.T) {
 
 func Test_runCmd_withTestFile(t *testing.T) {
 	dir := filepath.Join(DataDir, "testing")
-	_, err := unzipAgent(noopLogger, "../integration-test/testdata/testing/", "testing.zip", DataDir)
+	_, err := unzipAgent(noopLogger, "../integration-test/testdata/testing/", "testing", DataDir)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,7 +125,7 @@ func Test_runCmd_withTestFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = runCmd(noopLogger, "bash ./testing.sh", dir, handlerSettings{})
+	_, err = runCmd(noopLogger, "bash ./testing.sh", dir, scriptContext{OutputDir: dir}, handlerSettings{})
 
 	require.Nil(t, err)
 }
@@ -139,7 +139,7 @@ func Test_unzip_fail(t *testing.T) {
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), `failed to find zip file`)
 
-	_, err = unzipAgent(noopLogger, "../integration-test/testdata/testing/", "testing-corrupt.zip", "agent")
+	_, err = unzipAgent(noopLogger, "../integration-test/testdata/testing/", "corrupt", "agent")
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), `failed to open zip`)
 }
@@ -0,0 +1,148 @@
+// Package distro detects the Linux distribution of the machine and checks it
+// against the support matrix of the Guest Configuration agent.
+package distro
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Info describes a Linux distribution.
+type Info struct {
+	ID      string   `json:"id"`               // lower case identifier, like "ubuntu" or "rhel"
+	IDLike  []string `json:"idLike,omitempty"` // identifiers of related distributions
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Source  string   `json:"source"` // file the information was read from
+}
+
+// String returns the name and version of the distribution.
+func (i Info) String() string {
+	name := i.Name
+	if name == "" {
+		name = i.ID
+	}
+	return strings.TrimSpace(name + " " + i.Version)
+}
+
+// redhatReleaseNames maps the product names found in /etc/redhat-release to
+// the os-release identifiers.
+var redhatReleaseNames = []struct {
+	prefix string
+	id     string
+}{
+	{"Red Hat Enterprise Linux", "rhel"},
+	{"CentOS", "centos"},
+	{"Rocky Linux", "rocky"},
+	{"AlmaLinux", "almalinux"},
+	{"Oracle Linux", "ol"},
+}
+
+var releaseVersionRx = regexp.MustCompile(`release ([0-9][0-9.]*)`)
+
+// Detect identifies the distribution from the files under root ("/" on a
+// real machine). It reads /etc/os-release and falls back to /etc/lsb-release,
+// /etc/redhat-release and /etc/debian_version, in that order.
+func Detect(root string) (Info, error) {
+	detectors := []struct {
+		path   string
+		detect func(b []byte) Info
+	}{
+		{"etc/os-release", fromOSRelease},
+		{"usr/lib/os-release", fromOSRelease},
+		{"etc/lsb-release", fromLSBRelease},
+		{"etc/redhat-release", fromRedhatRelease},
+		{"etc/debian_version", fromDebianVersion},
+	}
+
+	var tried []string
+	for _, d := range detectors {
+		path := filepath.Join(root, d.path)
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return Info{}, errors.Wrapf(err, "distro: failed to read %s", path)
+		}
+		tried = append(tried, path)
+		info := d.detect(b)
+		if info.ID != "" && info.Version != "" {
+			info.Source = path
+			return info, nil
+		}
+	}
+	if len(tried) == 0 {
+		return Info{}, errors.New("distro: no release file found")
+	}
+	return Info{}, errors.Errorf("distro: cannot identify the distribution from %s", strings.Join(tried, ", "))
+}
+
+// parseKeyValues parses the KEY=value lines of shell-like release files.
+func parseKeyValues(b []byte) map[string]string {
+	kv := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		kv[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+	}
+	return kv
+}
+
+func fromOSRelease(b []byte) Info {
+	kv := parseKeyValues(b)
+	info := Info{
+		ID:      strings.ToLower(kv["ID"]),
+		Name:    kv["NAME"],
+		Version: kv["VERSION_ID"],
+	}
+	if like := strings.Fields(strings.ToLower(kv["ID_LIKE"])); len(like) > 0 {
+		info.IDLike = like
+	}
+	return info
+}
+
+func fromLSBRelease(b []byte) Info {
+	kv := parseKeyValues(b)
+	return Info{
+		ID:      strings.ToLower(kv["DISTRIB_ID"]),
+		Name:    kv["DISTRIB_ID"],
+		Version: kv["DISTRIB_RELEASE"],
+	}
+}
+
+func fromRedhatRelease(b []byte) Info {
+	line := strings.TrimSpace(string(b))
+	var info Info
+	for _, n := range redhatReleaseNames {
+		if strings.HasPrefix(line, n.prefix) {
+			info.ID, info.Name = n.id, n.prefix
+			break
+		}
+	}
+	if m := releaseVersionRx.FindStringSubmatch(line); m != nil {
+		info.Version = m[1]
+	}
+	return info
+}
+
+func fromDebianVersion(b []byte) Info {
+	v := strings.TrimSpace(string(b))
+	if !regexp.MustCompile(`^[0-9][0-9.]*$`).MatchString(v) {
+		return Info{} // testing and unstable have a codename like "bullseye/sid"
+	}
+	return Info{ID: "debian", Name: "Debian", Version: v}
+}
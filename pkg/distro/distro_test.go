@@ -0,0 +1,64 @@
+package distro_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/distro"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetect_fixtures(t *testing.T) {
+	cases := []struct {
+		root    string
+		id      string
+		version string
+		source  string
+	}{
+		{"ubuntu1804", "ubuntu", "18.04", "etc/os-release"},
+		{"rocky8", "rocky", "8.5", "etc/os-release"},
+		{"usrlib", "mariner", "2.0", "usr/lib/os-release"},
+		{"lsb", "ubuntu", "18.04", "etc/lsb-release"},
+		{"redhat7", "centos", "7.9.2009", "etc/redhat-release"},
+		{"debian9", "debian", "9.13", "etc/debian_version"},
+		{"opensuse-leap15", "opensuse-leap", "15.5", "etc/os-release"},
+		{"sles-sap15", "sles_sap", "15.4", "etc/os-release"},
+	}
+	for _, c := range cases {
+		root := filepath.Join("testdata", c.root)
+		info, err := distro.Detect(root)
+		require.Nil(t, err, c.root)
+		require.Equal(t, c.id, info.ID, c.root)
+		require.Equal(t, c.version, info.Version, c.root)
+		require.Equal(t, filepath.Join(root, c.source), info.Source, c.root)
+	}
+}
+
+func TestDetect_osReleaseFields(t *testing.T) {
+	info, err := distro.Detect(filepath.Join("testdata", "rocky8"))
+	require.Nil(t, err)
+	require.Equal(t, "Rocky Linux", info.Name)
+	require.Equal(t, []string{"rhel", "centos", "fedora"}, info.IDLike)
+	require.Equal(t, "Rocky Linux 8.5", info.String())
+}
+
+func TestDetect_unidentified(t *testing.T) {
+	_, err := distro.Detect(filepath.Join("testdata", "garbage"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cannot identify the distribution from")
+
+	_, err = distro.Detect(filepath.Join("testdata", "debiansid"))
+	require.NotNil(t, err)
+}
+
+func TestDetect_noReleaseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = distro.Detect(dir)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "distro: no release file found")
+}
@@ -0,0 +1,144 @@
+package distro
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mcuadros/go-version"
+	"github.com/pkg/errors"
+)
+
+// supportMatrixJSON lists the distributions the agent supports. Distributions
+// not listed are checked against the entry of their ID_LIKE, so "suse" covers
+// openSUSE and SLES for SAP. Versions are compared component by component. A
+// maximum version only bounds the components it has, so a maximum of "8"
+// includes 8.9. Architectures use the GOARCH names, and every architecture the
+// bundle has a handler binary and agent packages for must be listed.
+const supportMatrixJSON = `[
+  {"id": "ubuntu",    "minVersion": "14.04", "architectures": ["amd64", "arm64"]},
+  {"id": "debian",    "minVersion": "8",     "architectures": ["amd64", "arm64"]},
+  {"id": "rhel",      "minVersion": "7.0",   "architectures": ["amd64", "arm64"]},
+  {"id": "centos",    "minVersion": "7.0",   "architectures": ["amd64", "arm64"]},
+  {"id": "rocky",     "minVersion": "8",     "architectures": ["amd64", "arm64"]},
+  {"id": "almalinux", "minVersion": "8",     "architectures": ["amd64", "arm64"]},
+  {"id": "ol",        "minVersion": "7",     "architectures": ["amd64", "arm64"]},
+  {"id": "sles",      "minVersion": "12.0",  "architectures": ["amd64", "arm64"]},
+  {"id": "suse",      "minVersion": "12.0",  "architectures": ["amd64", "arm64"]},
+  {"id": "mariner",   "minVersion": "1.0",   "architectures": ["amd64", "arm64"]}
+]`
+
+// Support is an entry of the support matrix.
+type Support struct {
+	ID            string   `json:"id"`
+	MinVersion    string   `json:"minVersion"`
+	MaxVersion    string   `json:"maxVersion,omitempty"`
+	Architectures []string `json:"architectures"`
+}
+
+// Matrix is a list of supported distributions.
+type Matrix []Support
+
+// DefaultMatrix returns the support matrix of the agent.
+func DefaultMatrix() Matrix {
+	m, err := ParseMatrix([]byte(supportMatrixJSON))
+	if err != nil {
+		panic(err) // the embedded matrix is tested
+	}
+	return m
+}
+
+// ParseMatrix parses a support matrix in JSON format.
+func ParseMatrix(b []byte) (Matrix, error) {
+	var m Matrix
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrap(err, "distro: failed to parse support matrix")
+	}
+	for _, s := range m {
+		if s.ID == "" || s.MinVersion == "" || len(s.Architectures) == 0 {
+			return nil, errors.Errorf("distro: incomplete support matrix entry %+v", s)
+		}
+	}
+	return m, nil
+}
+
+// Verdict is the result of checking a distribution against the matrix.
+type Verdict struct {
+	Supported bool     `json:"supported"`
+	Distro    Info     `json:"distro"`
+	Arch      string   `json:"arch"`
+	Rule      *Support `json:"rule,omitempty"` // the matrix entry for the distribution, if any
+	Reason    string   `json:"reason"`
+}
+
+// Check returns whether the distribution on the architecture is supported. A
+// distribution without an entry of its own is checked against the entry of the
+// first of its ID_LIKE identifiers that has one.
+func (m Matrix) Check(info Info, arch string) Verdict {
+	v := Verdict{Distro: info, Arch: arch}
+	rule := m.find(info.ID)
+	for _, like := range info.IDLike {
+		if rule != nil {
+			break
+		}
+		rule = m.find(like)
+	}
+	if rule == nil {
+		v.Reason = fmt.Sprintf("unsupported distribution %s, supported are: %s", info, m.ids())
+		return v
+	}
+	v.Rule = rule
+
+	switch {
+	case version.Compare(info.Version, rule.MinVersion, "<"):
+		v.Reason = fmt.Sprintf("unsupported %s version %s, the minimum is %s", info.ID, info.Version, rule.MinVersion)
+	case rule.MaxVersion != "" && version.Compare(truncate(info.Version, rule.MaxVersion), rule.MaxVersion, ">"):
+		v.Reason = fmt.Sprintf("unsupported %s version %s, the maximum is %s", info.ID, info.Version, rule.MaxVersion)
+	case !contains(rule.Architectures, arch):
+		v.Reason = fmt.Sprintf("unsupported architecture %s for %s, supported are: %s", arch, info, strings.Join(rule.Architectures, ", "))
+	default:
+		v.Supported = true
+		v.Reason = fmt.Sprintf("%s on %s is supported", info, arch)
+		if rule.ID != info.ID {
+			v.Reason += " like " + rule.ID
+		}
+	}
+	return v
+}
+
+// find returns the entry for the distribution id, or nil.
+func (m Matrix) find(id string) *Support {
+	for i := range m {
+		if m[i].ID == id {
+			return &m[i]
+		}
+	}
+	return nil
+}
+
+func (m Matrix) ids() string {
+	var ids []string
+	for _, s := range m {
+		ids = append(ids, s.ID)
+	}
+	return strings.Join(ids, ", ")
+}
+
+// truncate shortens v to as many dot separated components as bound has.
+func truncate(v, bound string) string {
+	n := strings.Count(bound, ".") + 1
+	parts := strings.Split(v, ".")
+	if len(parts) > n {
+		parts = parts[:n]
+	}
+	return strings.Join(parts, ".")
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package distro_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/distro"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultMatrix(t *testing.T) {
+	m := distro.DefaultMatrix()
+	for _, id := range []string{"ubuntu", "debian", "rhel", "centos", "rocky", "almalinux", "ol", "sles", "mariner"} {
+		for _, arch := range []string{"amd64", "arm64"} {
+			v := m.Check(distro.Info{ID: id, Version: "99"}, arch)
+			require.True(t, v.Supported, "%s on %s", id, arch)
+		}
+	}
+	v := m.Check(distro.Info{ID: "ubuntu", Version: "99"}, "386")
+	require.False(t, v.Supported)
+}
+
+func TestDefaultMatrix_suse(t *testing.T) {
+	m := distro.DefaultMatrix()
+	for _, root := range []string{"opensuse-leap15", "sles-sap15"} {
+		info, err := distro.Detect(filepath.Join("testdata", root))
+		require.Nil(t, err, root)
+		for _, arch := range []string{"amd64", "arm64"} {
+			v := m.Check(info, arch)
+			require.True(t, v.Supported, "%s on %s: %s", root, arch, v.Reason)
+			require.Equal(t, "suse", v.Rule.ID, root)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	m, err := distro.ParseMatrix([]byte(`[
+		{"id": "ubuntu", "minVersion": "16.04", "maxVersion": "20", "architectures": ["amd64", "arm64"]},
+		{"id": "rhel", "minVersion": "7", "architectures": ["amd64"]}
+	]`))
+	require.Nil(t, err)
+
+	cases := []struct {
+		id, version, arch string
+		supported         bool
+		reason            string
+	}{
+		{"ubuntu", "18.04", "amd64", true, "ubuntu 18.04 on amd64 is supported"},
+		{"ubuntu", "16.04", "arm64", true, ""},
+		{"ubuntu", "20.04", "amd64", true, ""}, // the maximum bounds the major version only
+		{"ubuntu", "14.04", "amd64", false, "unsupported ubuntu version 14.04, the minimum is 16.04"},
+		{"ubuntu", "22.04", "amd64", false, "unsupported ubuntu version 22.04, the maximum is 20"},
+		{"rhel", "7.9", "amd64", true, ""},
+		{"rhel", "7.9", "arm64", false, "unsupported architecture arm64 for rhel 7.9, supported are: amd64"},
+		{"rhel", "6.10", "amd64", false, "the minimum is 7"},
+		{"arch", "1", "amd64", false, "unsupported distribution arch 1, supported are: ubuntu, rhel"},
+	}
+	for _, c := range cases {
+		v := m.Check(distro.Info{ID: c.id, Version: c.version, IDLike: []string{"fedora"}}, c.arch)
+		require.Equal(t, c.supported, v.Supported, "%+v", c)
+		require.Contains(t, v.Reason, c.reason, "%+v", c)
+		require.Equal(t, c.arch, v.Arch)
+		if c.id != "arch" {
+			require.Equal(t, c.id, v.Rule.ID)
+		} else {
+			require.Nil(t, v.Rule)
+		}
+	}
+
+	// a distribution without an entry is checked like the first of its
+	// ID_LIKE that has one
+	v := m.Check(distro.Info{ID: "rocky", IDLike: []string{"fedora", "rhel", "ubuntu"}, Version: "8.5"}, "amd64")
+	require.True(t, v.Supported)
+	require.Equal(t, "rhel", v.Rule.ID)
+	require.Equal(t, "rocky 8.5 on amd64 is supported like rhel", v.Reason)
+	v = m.Check(distro.Info{ID: "rocky", IDLike: []string{"rhel"}, Version: "6"}, "amd64")
+	require.False(t, v.Supported)
+	require.Contains(t, v.Reason, "unsupported rocky version 6, the minimum is 7")
+}
+
+func TestParseMatrix_invalid(t *testing.T) {
+	_, err := distro.ParseMatrix([]byte(`{`))
+	require.NotNil(t, err)
+
+	_, err = distro.ParseMatrix([]byte(`[{"id": "ubuntu"}]`))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "incomplete support matrix entry")
+}
@@ -0,0 +1,120 @@
+// Package metrics writes metrics in the Prometheus text format to files for
+// the textfile collector of node_exporter.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Type is the type of a metric family.
+type Type string
+
+const (
+	Gauge   Type = "gauge"
+	Counter Type = "counter"
+)
+
+// Family is a metric with its samples.
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Samples []Sample
+}
+
+// Sample is a value of a metric with its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Write writes the families in the Prometheus text format, in the given order.
+// The labels of a sample are sorted by name.
+func Write(w io.Writer, families []Family) error {
+	var b bytes.Buffer
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			b.WriteString(f.Name)
+			writeLabels(&b, s.Labels)
+			b.WriteByte(' ')
+			b.WriteString(formatValue(s.Value))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return errors.Wrap(err, "metrics: failed to write")
+}
+
+// WriteFile replaces dir/name with the families atomically, so the collector
+// never reads a partial file. The temporary file does not end in .prom, which
+// the collector would read.
+func WriteFile(dir, name string, families []Family) error {
+	tmp, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "metrics: failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	if err := Write(tmp, families); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "metrics: failed to write temporary file")
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrap(err, "metrics: failed to set file permissions")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), filepath.Join(dir, name)), "metrics: failed to replace file")
+}
+
+func writeLabels(b *bytes.Buffer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for n := range labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%s=\"%s\"", n, escapeLabel(labels[n]))
+	}
+	b.WriteByte('}')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
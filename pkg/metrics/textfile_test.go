@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var families = []Family{
+	{Name: "up", Help: "Whether it is up.", Type: Gauge, Samples: []Sample{{Value: 1}}},
+	{Name: "errors_total", Help: "Errors\nby \\kind.", Type: Counter, Samples: []Sample{
+		{Labels: map[string]string{"kind": "disk", "host": "a"}, Value: 3},
+		{Labels: map[string]string{"kind": "say \"hi\"\n\\"}, Value: 0.25},
+		{Labels: map[string]string{"kind": "inf"}, Value: math.Inf(1)},
+	}},
+	{Name: "empty", Help: "No samples.", Type: Gauge},
+}
+
+const expected = `# HELP up Whether it is up.
+# TYPE up gauge
+up 1
+# HELP errors_total Errors\nby \\kind.
+# TYPE errors_total counter
+errors_total{host="a",kind="disk"} 3
+errors_total{kind="say \"hi\"\n\\"} 0.25
+errors_total{kind="inf"} +Inf
+# HELP empty No samples.
+# TYPE empty gauge
+`
+
+func TestWrite(t *testing.T) {
+	var b bytes.Buffer
+	require.Nil(t, Write(&b, families))
+	require.Equal(t, expected, b.String())
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.prom")
+	require.Nil(t, ioutil.WriteFile(path, []byte("old"), 0600))
+	require.Nil(t, WriteFile(dir, "test.prom", families))
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, expected, string(b))
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 1, "no temporary file is left")
+
+	require.NotNil(t, WriteFile(filepath.Join(dir, "missing"), "test.prom", families))
+}
@@ -0,0 +1,155 @@
+// Package output captures the output streams of the agent scripts into files,
+// caps them to a bounded size and mirrors them line by line, for instance into
+// a log.
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Create creates or truncates the file at path, with 0600 permissions, for
+// a stream. The file is opened for appending, so that Cap keeps working while
+// a process left behind by a script still writes to it.
+func Create(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "output: failed to create file")
+	}
+	return f, nil
+}
+
+// Cap keeps at most the first head and the last tail bytes of the file at
+// path, with a line stating how much was omitted in between, and returns the
+// number of omitted bytes.
+func Cap(path string, head, tail int) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, errors.Wrap(err, "output: failed to open file")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "output: failed to stat file")
+	}
+	size := fi.Size()
+	if size <= int64(head)+int64(tail) {
+		return 0, nil
+	}
+
+	buf := make([]byte, tail)
+	if _, err := f.ReadAt(buf, size-int64(tail)); err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "output: failed to read tail")
+	}
+	omitted := size - int64(head) - int64(tail)
+	if err := f.Truncate(int64(head)); err != nil {
+		return 0, errors.Wrap(err, "output: failed to truncate file")
+	}
+	buf = append([]byte(fmt.Sprintf("\n[... %d bytes omitted ...]\n", omitted)), buf...)
+	if _, err := f.WriteAt(buf, int64(head)); err != nil {
+		return 0, errors.Wrap(err, "output: failed to write tail")
+	}
+	return omitted, errors.Wrap(f.Close(), "output: failed to close file")
+}
+
+// maxLineLen is the length after which a line without line break is passed on.
+const maxLineLen = 4096
+
+// LineWriter passes every line written to it, without the line break, to a
+// function. Lines are passed until the limit of bytes is reached, then a single
+// line saying so.
+type LineWriter struct {
+	fn      func(line string)
+	limit   int
+	passed  int
+	buf     []byte
+	limited bool
+}
+
+// NewLineWriter returns a LineWriter passing up to limit bytes of lines to fn.
+// A limit of 0 means no limit.
+func NewLineWriter(fn func(line string), limit int) *LineWriter {
+	return &LineWriter{fn: fn, limit: limit}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			if len(w.buf) >= maxLineLen {
+				w.pass(w.buf[:maxLineLen])
+				w.buf = w.buf[maxLineLen:]
+				continue
+			}
+			break
+		}
+		w.pass(bytes.TrimSuffix(w.buf[:i], []byte("\r")))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *LineWriter) pass(line []byte) {
+	if w.limited {
+		return
+	}
+	if w.limit > 0 && w.passed+len(line) > w.limit {
+		w.limited = true
+		w.fn(fmt.Sprintf("[output exceeds %d bytes, see the output files]", w.limit))
+		return
+	}
+	w.passed += len(line)
+	w.fn(string(line))
+}
+
+// Close passes the last line, if it has no line break.
+func (w *LineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.pass(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+// Runs returns the numbered run directories in dir, in ascending order.
+func Runs(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "output: failed to list runs")
+	}
+	var runs []int
+	for _, f := range files {
+		if n, err := strconv.Atoi(f.Name()); err == nil && f.IsDir() && n >= 0 {
+			runs = append(runs, n)
+		}
+	}
+	sort.Ints(runs)
+	return runs, nil
+}
+
+// Prune removes all but the keep highest numbered run directories in dir, and
+// returns the removed directories.
+func Prune(dir string, keep int) ([]string, error) {
+	runs, err := Runs(dir)
+	if err != nil || len(runs) <= keep {
+		return nil, err
+	}
+	var removed []string
+	for _, n := range runs[:len(runs)-keep] {
+		p := filepath.Join(dir, strconv.Itoa(n))
+		if err := os.RemoveAll(p); err != nil {
+			return removed, errors.Wrapf(err, "output: failed to remove %s", p)
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
@@ -0,0 +1,155 @@
+package output
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "output")
+	require.Nil(t, err)
+	return dir
+}
+
+func writeAll(t *testing.T, head, tail int, chunks ...string) string {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stdout")
+
+	f, err := Create(path)
+	require.Nil(t, err)
+	for _, c := range chunks {
+		n, err := f.Write([]byte(c))
+		require.Nil(t, err)
+		require.Equal(t, len(c), n)
+	}
+	require.Nil(t, f.Close())
+	_, err = Cap(path, head, tail)
+	require.Nil(t, err)
+
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	return string(b)
+}
+
+func TestCap_underCap(t *testing.T) {
+	require.Equal(t, "hello\nworld\n", writeAll(t, 8, 8, "hello\n", "world\n"))
+	require.Equal(t, "", writeAll(t, 8, 8))
+}
+
+func TestCap_keepsHeadAndTail(t *testing.T) {
+	require.Equal(t, "0123\n[... 4 bytes omitted ...]\n89ab",
+		writeAll(t, 4, 4, "01", "2345", "6789", "ab"))
+	require.Equal(t, "0123\n[... 8 bytes omitted ...]\n",
+		writeAll(t, 4, 0, "0123456789ab"))
+}
+
+func TestCap_exactlyHeadAndTail(t *testing.T) {
+	require.Equal(t, "01234567", writeAll(t, 4, 4, "01234567"))
+}
+
+func TestCap_omitted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stdout")
+	require.Nil(t, ioutil.WriteFile(path, []byte("0123456789"), 0600))
+
+	omitted, err := Cap(path, 2, 3)
+	require.Nil(t, err)
+	require.EqualValues(t, 5, omitted)
+	omitted, err = Cap(path, 100, 100)
+	require.Nil(t, err)
+	require.EqualValues(t, 0, omitted)
+}
+
+func TestCap_error(t *testing.T) {
+	_, err := Cap("/non-existing-dir/stdout", 1, 1)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "output: failed to open file")
+}
+
+func TestCreate_truncatesAndAppends(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stdout")
+	require.Nil(t, ioutil.WriteFile(path, []byte("old content"), 0600))
+
+	f, err := Create(path)
+	require.Nil(t, err)
+	f.Write([]byte("new"))
+	require.Nil(t, ioutil.WriteFile(path, []byte("capped "), 0600), "capped while still written to")
+	f.Write([]byte("more"))
+	require.Nil(t, f.Close())
+	b, _ := ioutil.ReadFile(path)
+	require.Equal(t, "capped more", string(b))
+}
+
+func TestCreate_error(t *testing.T) {
+	_, err := Create("/non-existing-dir/stdout")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "output: failed to create file")
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := NewLineWriter(func(l string) { lines = append(lines, l) }, 0)
+	w.Write([]byte("first\nsec"))
+	w.Write([]byte("ond\r\n\nlast"))
+	require.Equal(t, []string{"first", "second", ""}, lines)
+	require.Nil(t, w.Close())
+	require.Equal(t, []string{"first", "second", "", "last"}, lines)
+}
+
+func TestLineWriter_longLine(t *testing.T) {
+	var lines []string
+	w := NewLineWriter(func(l string) { lines = append(lines, l) }, 0)
+	w.Write([]byte(strings.Repeat("x", maxLineLen+1)))
+	require.Len(t, lines, 1)
+	require.Len(t, lines[0], maxLineLen)
+	w.Close()
+	require.Equal(t, "x", lines[1])
+}
+
+func TestLineWriter_limit(t *testing.T) {
+	var lines []string
+	w := NewLineWriter(func(l string) { lines = append(lines, l) }, 10)
+	w.Write([]byte("12345\n67890\nmore\nand more\n"))
+	w.Close()
+	require.Equal(t, []string{"12345", "67890", "[output exceeds 10 bytes, see the output files]"}, lines)
+}
+
+func TestPrune(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"1/enable", "2/enable", "10/install", "10/enable", "3", "GCAgent", "-1"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "4"), nil, 0644), "files are not runs")
+
+	runs, err := Runs(dir)
+	require.Nil(t, err)
+	require.Equal(t, []int{1, 2, 3, 10}, runs)
+
+	removed, err := Prune(dir, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "1"), filepath.Join(dir, "2")}, removed)
+	runs, _ = Runs(dir)
+	require.Equal(t, []int{3, 10}, runs)
+
+	removed, err = Prune(dir, 2)
+	require.Nil(t, err)
+	require.Empty(t, removed)
+}
+
+func TestRuns_missingDir(t *testing.T) {
+	_, err := Runs("/non-existing-dir")
+	require.NotNil(t, err)
+}
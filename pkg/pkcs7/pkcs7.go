@@ -0,0 +1,365 @@
+// Package pkcs7 decrypts PKCS#7/CMS enveloped data, which is the format the
+// guest agent uses for the protected settings of an extension. It supports RSA
+// key transport (PKCS#1 v1.5 and OAEP) with AES-CBC or 3DES-CBC content
+// encryption.
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// ContentEncryption identifies a supported content encryption algorithm.
+type ContentEncryption int
+
+const (
+	// AES128CBC is AES-128 in CBC mode
+	AES128CBC ContentEncryption = iota
+	// AES192CBC is AES-192 in CBC mode
+	AES192CBC
+	// AES256CBC is AES-256 in CBC mode
+	AES256CBC
+	// DESEDE3CBC is triple DES in CBC mode
+	DESEDE3CBC
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSAESOAEP     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+
+	contentEncryptions = map[ContentEncryption]struct {
+		oid     asn1.ObjectIdentifier
+		keySize int
+	}{
+		AES128CBC:  {oidAES128CBC, 16},
+		AES192CBC:  {oidAES192CBC, 24},
+		AES256CBC:  {oidAES256CBC, 32},
+		DESEDE3CBC: {oidDESEDE3CBC, 24},
+	}
+
+	// ErrNoMatchingRecipient is returned when none of the recipients of the
+	// enveloped data can be decrypted with the given key.
+	ErrNoMatchingRecipient = errors.New("pkcs7: no recipient could be decrypted with the given key")
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RecipientIdentifier    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type oaepParams struct {
+	HashAlgorithm pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:0"`
+}
+
+// Decrypt decrypts the DER encoded enveloped data with the private key of
+// cert. The recipient issued for cert is tried first; if there is none, every
+// recipient is tried with the key.
+func Decrypt(der []byte, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("pkcs7: unsupported private key type %T, only RSA is supported", key)
+	}
+
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to parse content info")
+	} else if len(rest) > 0 {
+		return nil, errors.New("pkcs7: trailing data after content info")
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, errors.Errorf("pkcs7: content type %v is not enveloped data", ci.ContentType)
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to parse enveloped data")
+	}
+
+	// recipients issued for cert go first
+	var recipients, others []keyTransRecipientInfo
+	for _, raw := range ed.RecipientInfos {
+		var ri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(raw.FullBytes, &ri); err != nil {
+			// not a key transport recipient (e.g. key agreement), skip it
+			continue
+		}
+		if cert != nil && isRecipient(ri, cert) {
+			recipients = append(recipients, ri)
+		} else {
+			others = append(others, ri)
+		}
+	}
+	recipients = append(recipients, others...)
+
+	eci := ed.EncryptedContentInfo
+	var lastErr error
+	for _, ri := range recipients {
+		cek, err := decryptKey(ri, rsaKey)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		content, err := decryptContent(eci, cek)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return content, nil
+	}
+	if lastErr != nil {
+		return nil, errors.Wrap(ErrNoMatchingRecipient, lastErr.Error())
+	}
+	return nil, ErrNoMatchingRecipient
+}
+
+// isRecipient returns true if the recipient identifier refers to cert, either
+// by issuer and serial number or by subject key identifier.
+func isRecipient(ri keyTransRecipientInfo, cert *x509.Certificate) bool {
+	rid := ri.RecipientIdentifier
+	if rid.Class == asn1.ClassContextSpecific && rid.Tag == 0 {
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(rid.Bytes, cert.SubjectKeyId)
+	}
+	var ias issuerAndSerialNumber
+	if _, err := asn1.Unmarshal(rid.FullBytes, &ias); err != nil {
+		return false
+	}
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+// decryptKey decrypts the content encryption key of the recipient.
+func decryptKey(ri keyTransRecipientInfo, key *rsa.PrivateKey) ([]byte, error) {
+	alg := ri.KeyEncryptionAlgorithm
+	switch {
+	case alg.Algorithm.Equal(oidRSAEncryption):
+		return rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey)
+	case alg.Algorithm.Equal(oidRSAESOAEP):
+		var h hash.Hash = sha1.New()
+		var params oaepParams
+		if len(alg.Parameters.FullBytes) > 0 {
+			if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+				return nil, errors.Wrap(err, "pkcs7: failed to parse OAEP parameters")
+			}
+			if params.HashAlgorithm.Algorithm.Equal(oidSHA256) {
+				h = sha256.New()
+			}
+		}
+		return rsa.DecryptOAEP(h, rand.Reader, key, ri.EncryptedKey, nil)
+	}
+	return nil, errors.Errorf("pkcs7: unsupported key encryption algorithm %v", alg.Algorithm)
+}
+
+// decryptContent decrypts the encrypted content with the content encryption
+// key and removes its padding.
+func decryptContent(eci encryptedContentInfo, cek []byte) ([]byte, error) {
+	alg := eci.ContentEncryptionAlgorithm
+	var block cipher.Block
+	var err error
+	switch {
+	case alg.Algorithm.Equal(oidAES128CBC), alg.Algorithm.Equal(oidAES192CBC), alg.Algorithm.Equal(oidAES256CBC):
+		block, err = aes.NewCipher(cek)
+	case alg.Algorithm.Equal(oidDESEDE3CBC):
+		block, err = des.NewTripleDESCipher(cek)
+	default:
+		return nil, errors.Errorf("pkcs7: unsupported content encryption algorithm %v", alg.Algorithm)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "pkcs7: invalid content encryption key")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to parse initialization vector")
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.Errorf("pkcs7: initialization vector length %d does not match block size %d", len(iv), block.BlockSize())
+	}
+
+	ciphertext, err := encryptedContentBytes(eci.EncryptedContent)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.Errorf("pkcs7: encrypted content length %d is not a multiple of the block size", len(ciphertext))
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return unpad(plaintext, block.BlockSize())
+}
+
+// encryptedContentBytes returns the encrypted content, which is either a
+// primitive [0] octet string or a constructed one made of octet strings.
+func encryptedContentBytes(v asn1.RawValue) ([]byte, error) {
+	if !v.IsCompound {
+		return v.Bytes, nil
+	}
+	var out []byte
+	rest := v.Bytes
+	for len(rest) > 0 {
+		var chunk []byte
+		var err error
+		rest, err = asn1.Unmarshal(rest, &chunk)
+		if err != nil {
+			return nil, errors.Wrap(err, "pkcs7: failed to parse encrypted content")
+		}
+		out = append(out, chunk...)
+	}
+	return out, nil
+}
+
+func unpad(b []byte, blockSize int) ([]byte, error) {
+	n := int(b[len(b)-1])
+	if n == 0 || n > blockSize || n > len(b) {
+		return nil, errors.New("pkcs7: invalid padding, the key probably does not match")
+	}
+	for _, p := range b[len(b)-n:] {
+		if int(p) != n {
+			return nil, errors.New("pkcs7: invalid padding, the key probably does not match")
+		}
+	}
+	return b[:len(b)-n], nil
+}
+
+// Encrypt creates DER encoded enveloped data of content for the recipient
+// cert, using RSA PKCS#1 v1.5 key transport and the given content encryption.
+// It produces the same format the guest agent delivers protected settings in.
+func Encrypt(content []byte, cert *x509.Certificate, alg ContentEncryption) ([]byte, error) {
+	ce, ok := contentEncryptions[alg]
+	if !ok {
+		return nil, errors.Errorf("pkcs7: unsupported content encryption %d", alg)
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("pkcs7: unsupported public key type %T, only RSA is supported", cert.PublicKey)
+	}
+
+	cek := make([]byte, ce.keySize)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to generate content encryption key")
+	}
+	var block cipher.Block
+	var err error
+	if alg == DESEDE3CBC {
+		block, err = des.NewTripleDESCipher(cek)
+	} else {
+		block, err = aes.NewCipher(cek)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to create cipher")
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to generate initialization vector")
+	}
+
+	n := block.BlockSize() - len(content)%block.BlockSize()
+	padded := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(n)}, n)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, cek)
+	if err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to encrypt content encryption key")
+	}
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	rid, err := asn1.Marshal(issuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+		SerialNumber: cert.SerialNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ri, err := asn1.Marshal(keyTransRecipientInfo{
+		Version:                0,
+		RecipientIdentifier:    asn1.RawValue{FullBytes: rid},
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+		EncryptedKey:           encryptedKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ed, err := asn1.Marshal(envelopedData{
+		Version:        0,
+		RecipientInfos: []asn1.RawValue{{FullBytes: ri}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: ce.oid, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "pkcs7: failed to marshal enveloped data")
+	}
+	der, err := asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: ed},
+	})
+	return der, errors.Wrap(err, "pkcs7: failed to marshal content info")
+}
+
+// String returns the name of the content encryption algorithm.
+func (c ContentEncryption) String() string {
+	switch c {
+	case AES128CBC:
+		return "aes-128-cbc"
+	case AES192CBC:
+		return "aes-192-cbc"
+	case AES256CBC:
+		return "aes-256-cbc"
+	case DESEDE3CBC:
+		return "des-ede3-cbc"
+	}
+	return fmt.Sprintf("ContentEncryption(%d)", int(c))
+}
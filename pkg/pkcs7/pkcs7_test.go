@@ -0,0 +1,130 @@
+package pkcs7
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCert generates a self-signed certificate and its RSA key.
+func newTestCert(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "pkcs7 test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		SubjectKeyId: []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert, key
+}
+
+func TestEncryptDecrypt_roundTrip(t *testing.T) {
+	cert, key := newTestCert(t)
+	content := []byte(`{"storageAccountKey":"secret"}`)
+
+	for _, alg := range []ContentEncryption{AES128CBC, AES192CBC, AES256CBC, DESEDE3CBC} {
+		der, err := Encrypt(content, cert, alg)
+		require.Nil(t, err, alg.String())
+		out, err := Decrypt(der, cert, key)
+		require.Nil(t, err, alg.String())
+		require.Equal(t, content, out, alg.String())
+
+		// the key alone is enough when the certificate is unknown
+		out, err = Decrypt(der, nil, key)
+		require.Nil(t, err, alg.String())
+		require.Equal(t, content, out, alg.String())
+	}
+}
+
+func TestDecrypt_wrongKey(t *testing.T) {
+	cert, _ := newTestCert(t)
+	otherCert, otherKey := newTestCert(t)
+
+	der, err := Encrypt([]byte("hello"), cert, AES256CBC)
+	require.Nil(t, err)
+	_, err = Decrypt(der, otherCert, otherKey)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no recipient could be decrypted")
+}
+
+func TestDecrypt_invalidInput(t *testing.T) {
+	cert, key := newTestCert(t)
+
+	_, err := Decrypt([]byte("not asn1"), cert, key)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to parse content info")
+
+	_, err = Decrypt([]byte("hello"), cert, "not a key")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unsupported private key type")
+}
+
+func TestIsRecipient(t *testing.T) {
+	cert, _ := newTestCert(t)
+	otherCert, _ := newTestCert(t)
+
+	der, err := Encrypt([]byte("hello"), cert, AES128CBC)
+	require.Nil(t, err)
+	var ci contentInfo
+	_, err = asn1.Unmarshal(der, &ci)
+	require.Nil(t, err)
+	var ed envelopedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &ed)
+	require.Nil(t, err)
+	var ri keyTransRecipientInfo
+	_, err = asn1.Unmarshal(ed.RecipientInfos[0].FullBytes, &ri)
+	require.Nil(t, err)
+
+	require.True(t, isRecipient(ri, cert))
+	require.False(t, isRecipient(ri, otherCert))
+}
+
+// TestDecrypt_openssl decrypts enveloped data produced by openssl, which is
+// what the protected settings looked like to the previous implementation.
+func TestDecrypt_openssl(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl is not installed")
+	}
+	cert, key := newTestCert(t)
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	crt := filepath.Join(dir, "test.crt")
+	require.Nil(t, ioutil.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600))
+
+	content := []byte(`{"commandToExecute":"date"}`)
+	for _, args := range [][]string{
+		{"smime", "-encrypt", "-aes256", "-outform", "DER", crt},
+		{"smime", "-encrypt", "-des3", "-outform", "DER", crt},
+		{"cms", "-encrypt", "-aes128", "-outform", "DER", "-recip", crt, "-keyopt", "rsa_padding_mode:oaep"},
+	} {
+		cmd := exec.Command(openssl, args...)
+		cmd.Stdin = bytes.NewReader(content)
+		der, err := cmd.Output()
+		require.Nil(t, err, "%v", args)
+
+		out, err := Decrypt(der, cert, key)
+		require.Nil(t, err, "%v", args)
+		require.Equal(t, content, out, "%v", args)
+	}
+}
@@ -0,0 +1,138 @@
+package preflight
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// binDirs are searched for required binaries. A fixed list keeps the check
+// independent of the PATH of the caller.
+var binDirs = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem of path; tests replace it.
+var freeSpace = func(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// FreeDisk fails if the filesystem of dir has less than required bytes
+// available, and warns if it has less than twice as much.
+func FreeDisk(dir string, required uint64) Check {
+	return Check{
+		Name: "free disk space in " + dir,
+		Run: func(root Root) (Outcome, string) {
+			free, err := freeSpace(root.Path(dir))
+			if err != nil {
+				return Fail, fmt.Sprintf("cannot determine free space: %v", err)
+			}
+			msg := fmt.Sprintf("%d MB available, %d MB required", free>>20, required>>20)
+			switch {
+			case free < required:
+				return Fail, msg
+			case free < 2*required:
+				return Warn, msg
+			}
+			return Pass, msg
+		},
+	}
+}
+
+// Writable fails if a file cannot be created in dir. The directory is
+// created if it does not exist yet.
+func Writable(name, dir string) Check {
+	return Check{
+		Name: name + " directory writable",
+		Run: func(root Root) (Outcome, string) {
+			path := root.Path(dir)
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return Fail, fmt.Sprintf("cannot create %s: %v", dir, err)
+			}
+			f, err := ioutil.TempFile(path, ".preflight")
+			if err != nil {
+				return Fail, fmt.Sprintf("cannot write to %s: %v", dir, err)
+			}
+			f.Close()
+			os.Remove(f.Name())
+			return Pass, dir + " is writable"
+		},
+	}
+}
+
+// WritableStat is Writable without changing the filesystem, for dry runs. It
+// checks the write permission of dir, or of its closest existing parent if
+// dir does not exist yet.
+func WritableStat(name, dir string) Check {
+	return Check{
+		Name: name + " directory writable",
+		Run: func(root Root) (Outcome, string) {
+			path := root.Path(dir)
+			for {
+				fi, err := os.Stat(path)
+				if err == nil && !fi.IsDir() {
+					return Fail, fmt.Sprintf("cannot create %s: %s is not a directory", dir, path)
+				} else if err == nil {
+					break
+				} else if !os.IsNotExist(err) || filepath.Dir(path) == path {
+					return Fail, fmt.Sprintf("cannot create %s: %v", dir, err)
+				}
+				path = filepath.Dir(path)
+			}
+			if err := syscall.Access(path, wOK); err != nil {
+				return Fail, fmt.Sprintf("cannot write to %s: %v", dir, err)
+			}
+			return Pass, dir + " is writable"
+		},
+	}
+}
+
+// wOK is the W_OK mode of access(2).
+const wOK = 0x2
+
+// Binary looks for an executable in the standard binary directories. A
+// missing binary fails the check if required, and warns otherwise.
+func Binary(name string, required bool, why string) Check {
+	return Check{
+		Name: name + " binary",
+		Run: func(root Root) (Outcome, string) {
+			for _, d := range binDirs {
+				p := d + "/" + name
+				if fi, err := os.Stat(root.Path(p)); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+					return Pass, "found " + p
+				}
+			}
+			msg := fmt.Sprintf("%s not found in %s, %s", name, strings.Join(binDirs, ":"), why)
+			if required {
+				return Fail, msg
+			}
+			return Warn, msg
+		},
+	}
+}
+
+// InitSystem passes if the machine is booted with systemd, warns if another
+// init system is found and fails otherwise.
+func InitSystem() Check {
+	return Check{
+		Name: "init system",
+		Run: func(root Root) (Outcome, string) {
+			// the check systemd itself uses, see sd_booted(3)
+			if fi, err := os.Stat(root.Path("/run/systemd/system")); err == nil && fi.IsDir() {
+				return Pass, "systemd"
+			}
+			for _, p := range []string{"/sbin/init", "/etc/init.d"} {
+				if _, err := os.Stat(root.Path(p)); err == nil {
+					return Warn, "not booted with systemd, found " + p
+				}
+			}
+			return Fail, "no init system found"
+		},
+	}
+}
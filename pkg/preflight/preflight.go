@@ -0,0 +1,89 @@
+// Package preflight runs checks on the machine before the agent is installed,
+// so that missing prerequisites are reported clearly instead of surfacing as
+// obscure failures of the agent scripts.
+//
+// Checks look at the filesystem below a root directory, which is "/" on a real
+// machine and a fake tree in tests.
+package preflight
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Outcome is the result of a single check.
+type Outcome string
+
+const (
+	Pass Outcome = "pass"
+	Warn Outcome = "warn"
+	Fail Outcome = "fail"
+)
+
+// Check is a single preflight check.
+type Check struct {
+	Name string
+	Run  func(root Root) (Outcome, string)
+}
+
+// Result is the outcome of a check with a message explaining it.
+type Result struct {
+	Name    string  `json:"name"`
+	Outcome Outcome `json:"outcome"`
+	Message string  `json:"message"`
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%s: %s", r.Name, r.Message)
+}
+
+// Root is the directory the checked paths are relative to.
+type Root string
+
+// Path returns p below the root. Relative paths stay relative to the working
+// directory on the real root.
+func (r Root) Path(p string) string {
+	if r == "" || r == "/" {
+		return p
+	}
+	return filepath.Join(string(r), p)
+}
+
+// Report holds the results of all checks, in order.
+type Report []Result
+
+// Run runs every check against root.
+func Run(root Root, checks []Check) Report {
+	var r Report
+	for _, c := range checks {
+		outcome, msg := c.Run(root)
+		r = append(r, Result{Name: c.Name, Outcome: outcome, Message: msg})
+	}
+	return r
+}
+
+// With returns the results with the given outcome.
+func (r Report) With(o Outcome) []Result {
+	var out []Result
+	for _, res := range r {
+		if res.Outcome == o {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// Failed returns true if any check failed.
+func (r Report) Failed() bool {
+	return len(r.With(Fail)) > 0
+}
+
+// Summary joins the results with the given outcome into a single message.
+func Summary(results []Result) string {
+	var s []string
+	for _, res := range results {
+		s = append(s, res.String())
+	}
+	return strings.Join(s, "; ")
+}
@@ -0,0 +1,147 @@
+package preflight
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRoot creates a filesystem root with the given directories and
+// executable files.
+func fakeRoot(t *testing.T, dirs []string, executables []string) Root {
+	root, err := ioutil.TempDir("", "root")
+	require.Nil(t, err)
+	for _, d := range dirs {
+		require.Nil(t, os.MkdirAll(filepath.Join(root, d), 0755))
+	}
+	for _, e := range executables {
+		require.Nil(t, os.MkdirAll(filepath.Join(root, filepath.Dir(e)), 0755))
+		require.Nil(t, ioutil.WriteFile(filepath.Join(root, e), nil, 0755))
+	}
+	return Root(root)
+}
+
+func TestRoot_Path(t *testing.T) {
+	require.Equal(t, "./data", Root("/").Path("./data"))
+	require.Equal(t, "/var/log", Root("").Path("/var/log"))
+	require.Equal(t, "/tmp/root/var/log", Root("/tmp/root").Path("/var/log"))
+	require.Equal(t, "/tmp/root/data", Root("/tmp/root").Path("./data"))
+}
+
+func TestRun_report(t *testing.T) {
+	check := func(name string, o Outcome) Check {
+		return Check{Name: name, Run: func(Root) (Outcome, string) { return o, string(o) + " message" }}
+	}
+	r := Run("/", []Check{check("a", Pass), check("b", Warn), check("c", Fail), check("d", Fail)})
+	require.Len(t, r, 4)
+	require.True(t, r.Failed())
+	require.Equal(t, "b: warn message", Summary(r.With(Warn)))
+	require.Equal(t, "c: fail message; d: fail message", Summary(r.With(Fail)))
+
+	require.False(t, Run("/", []Check{check("a", Pass)}).Failed())
+}
+
+func TestFreeDisk(t *testing.T) {
+	defer func(f func(string) (uint64, error)) { freeSpace = f }(freeSpace)
+	freeSpace = func(string) (uint64, error) { return 300 << 20, nil }
+
+	o, msg := FreeDisk("/var/lib", 100<<20).Run("/")
+	require.Equal(t, Pass, o)
+	require.Equal(t, "300 MB available, 100 MB required", msg)
+	o, _ = FreeDisk("/var/lib", 200<<20).Run("/")
+	require.Equal(t, Warn, o)
+	o, _ = FreeDisk("/var/lib", 400<<20).Run("/")
+	require.Equal(t, Fail, o)
+}
+
+func TestFreeDisk_realFilesystem(t *testing.T) {
+	root := fakeRoot(t, []string{"data"}, nil)
+	defer os.RemoveAll(string(root))
+
+	o, _ := FreeDisk("data", 0).Run(root)
+	require.Equal(t, Pass, o)
+	o, msg := FreeDisk("missing", 0).Run(root)
+	require.Equal(t, Fail, o)
+	require.Contains(t, msg, "cannot determine free space")
+}
+
+func TestWritable(t *testing.T) {
+	root := fakeRoot(t, []string{"status"}, nil)
+	defer os.RemoveAll(string(root))
+
+	o, msg := Writable("status", "/status").Run(root)
+	require.Equal(t, Pass, o, msg)
+	files, err := ioutil.ReadDir(root.Path("/status"))
+	require.Nil(t, err)
+	require.Empty(t, files, "probe file is removed")
+
+	o, _ = Writable("log", "/var/log/ext").Run(root)
+	require.Equal(t, Pass, o, "missing directories are created")
+
+	require.Nil(t, ioutil.WriteFile(root.Path("/file"), nil, 0644))
+	o, msg = Writable("data", "/file/data").Run(root)
+	require.Equal(t, Fail, o)
+	require.Contains(t, msg, "cannot create /file/data")
+}
+
+func TestWritableStat(t *testing.T) {
+	root := fakeRoot(t, []string{"status"}, nil)
+	defer os.RemoveAll(string(root))
+
+	o, msg := WritableStat("status", "/status").Run(root)
+	require.Equal(t, Pass, o, msg)
+	o, msg = WritableStat("log", "/var/log/ext").Run(root)
+	require.Equal(t, Pass, o, msg)
+	_, err := os.Stat(root.Path("/var"))
+	require.True(t, os.IsNotExist(err), "missing directories are not created")
+
+	require.Nil(t, ioutil.WriteFile(root.Path("/file"), nil, 0644))
+	o, msg = WritableStat("data", "/file/data").Run(root)
+	require.Equal(t, Fail, o)
+	require.Contains(t, msg, "cannot create /file/data")
+
+	if os.Geteuid() != 0 { // root may write anywhere
+		require.Nil(t, os.Chmod(root.Path("/status"), 0555))
+		o, msg = WritableStat("status", "/status").Run(root)
+		require.Equal(t, Fail, o)
+		require.Contains(t, msg, "cannot write to /status")
+	}
+}
+
+func TestBinary(t *testing.T) {
+	root := fakeRoot(t, nil, []string{"/usr/bin/bash"})
+	defer os.RemoveAll(string(root))
+	require.Nil(t, ioutil.WriteFile(root.Path("/usr/bin/openssl"), nil, 0644)) // not executable
+
+	o, msg := Binary("bash", true, "").Run(root)
+	require.Equal(t, Pass, o)
+	require.Equal(t, "found /usr/bin/bash", msg)
+
+	o, msg = Binary("openssl", false, "falling back").Run(root)
+	require.Equal(t, Warn, o)
+	require.Contains(t, msg, "openssl not found in")
+	require.Contains(t, msg, "falling back")
+
+	o, _ = Binary("openssl", true, "").Run(root)
+	require.Equal(t, Fail, o)
+}
+
+func TestInitSystem(t *testing.T) {
+	cases := []struct {
+		dirs     []string
+		expected Outcome
+	}{
+		{[]string{"/run/systemd/system"}, Pass},
+		{[]string{"/etc/init.d"}, Warn},
+		{nil, Fail},
+	}
+	for _, c := range cases {
+		root := fakeRoot(t, c.dirs, nil)
+		o, msg := InitSystem().Run(root)
+		require.Equal(t, c.expected, o, msg)
+		os.RemoveAll(string(root))
+	}
+}
@@ -0,0 +1,125 @@
+// Package redact removes secrets, like the protected settings of the extension
+// and credentials recognized by their shape, from text before it is logged or
+// reported.
+package redact
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Placeholder replaces every secret.
+	Placeholder = "<redacted>"
+
+	// minSecretLen is the length below which values are not taken as secrets,
+	// as replacing every "1" or "yes" would garble the text without hiding
+	// anything.
+	minSecretLen = 4
+)
+
+// patterns match credentials regardless of whether they are known secrets.
+// The first group of a pattern, if any, is kept.
+var patterns = []*regexp.Regexp{
+	// the signature of shared access signature (SAS) tokens
+	regexp.MustCompile(`(?i)(\bsig=)[^&\s"'<>]+`),
+	// account keys and shared access keys in connection strings
+	regexp.MustCompile(`(?i)(\b(?:Account|SharedAccess)Key=)[^;\s"'<>]+`),
+	// bearer tokens, like in an Authorization header
+	regexp.MustCompile(`(?i)(\bBearer\s+)[A-Za-z0-9._~+/-]+=*`),
+	// storage account keys on their own: 64 bytes in base64
+	regexp.MustCompile(`()\b[A-Za-z0-9+/]{86}==`),
+}
+
+// Redactor replaces the secrets added to it and the credentials matched by
+// its patterns. It is safe for concurrent use.
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string // longest first, so a secret containing another one is replaced whole
+}
+
+// New returns a Redactor that knows no secrets yet.
+func New() *Redactor {
+	return &Redactor{}
+}
+
+// Add adds secrets to redact. Multi-line secrets are redacted as a whole and
+// line by line, as they are often logged line by line. Secrets shorter than
+// minSecretLen are ignored.
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range secrets {
+		r.add(s)
+		if strings.Contains(s, "\n") {
+			for _, line := range strings.Split(s, "\n") {
+				r.add(strings.TrimSpace(line))
+			}
+		}
+	}
+	sort.SliceStable(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+func (r *Redactor) add(s string) {
+	if len(s) < minSecretLen {
+		return
+	}
+	for _, known := range r.secrets {
+		if known == s {
+			return
+		}
+	}
+	r.secrets = append(r.secrets, s)
+}
+
+// AddValues adds every string in a decoded JSON value, like the protected
+// settings, as a secret.
+func (r *Redactor) AddValues(v interface{}) {
+	switch v := v.(type) {
+	case string:
+		r.Add(v)
+	case []interface{}:
+		for _, e := range v {
+			r.AddValues(e)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			r.AddValues(e)
+		}
+	}
+}
+
+// String returns s with every secret replaced by Placeholder.
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, secret, Placeholder, -1)
+	}
+	r.mu.RUnlock()
+	for _, rx := range patterns {
+		s = rx.ReplaceAllString(s, "${1}"+Placeholder)
+	}
+	return s
+}
+
+// Writer returns a writer that redacts every write before passing it on to w.
+// Secrets are only found within a single write, which suits loggers writing
+// whole lines.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return writer{r, w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
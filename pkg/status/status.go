@@ -0,0 +1,135 @@
+// Package status writes the .status files the guest agent reads to report the
+// state of an extension operation. Besides the operation, status type and
+// message, a status carries a numeric code and any number of substatus
+// entries.
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Type is the status of an operation or a substatus.
+type Type string
+
+const (
+	Transitioning Type = "transitioning"
+	Warning       Type = "warning"
+	Error         Type = "error"
+	Success       Type = "success"
+)
+
+// now returns the time the status is reported at; tests replace it.
+var now = time.Now
+
+// Report is the content of a .status file.
+type Report []Item
+
+// Item is a single status report of an extension.
+type Item struct {
+	Version      float64 `json:"version"`
+	TimestampUTC string  `json:"timestampUTC"`
+	Status       Status  `json:"status"`
+}
+
+// Status is the state of an operation.
+type Status struct {
+	Operation        string           `json:"operation"`
+	Status           Type             `json:"status"`
+	Code             int              `json:"code"`
+	FormattedMessage FormattedMessage `json:"formattedMessage"`
+	Substatus        []Substatus      `json:"substatus,omitempty"`
+}
+
+// Substatus is the state of a single aspect of an operation, such as the
+// agent health.
+type Substatus struct {
+	Name             string           `json:"name"`
+	Status           Type             `json:"status"`
+	Code             int              `json:"code"`
+	FormattedMessage FormattedMessage `json:"formattedMessage"`
+}
+
+// FormattedMessage is a message in a given language.
+type FormattedMessage struct {
+	Lang    string `json:"lang"`
+	Message string `json:"message"`
+}
+
+func newMessage(msg string) FormattedMessage {
+	return FormattedMessage{Lang: "en", Message: msg}
+}
+
+// New returns a report of an operation with the given status type, code and
+// message.
+func New(t Type, operation string, code int, message string) Report {
+	return Report{
+		{
+			Version:      1.0,
+			TimestampUTC: now().UTC().Format(time.RFC3339),
+			Status: Status{
+				Operation:        operation,
+				Status:           t,
+				Code:             code,
+				FormattedMessage: newMessage(message),
+			},
+		},
+	}
+}
+
+// NewSubstatus returns a substatus entry.
+func NewSubstatus(name string, t Type, code int, message string) Substatus {
+	return Substatus{Name: name, Status: t, Code: code, FormattedMessage: newMessage(message)}
+}
+
+// WithSubstatus appends the substatus entries to the report.
+func (r Report) WithSubstatus(s ...Substatus) Report {
+	for i := range r {
+		r[i].Status.Substatus = append(r[i].Status.Substatus, s...)
+	}
+	return r
+}
+
+func (r Report) marshal() ([]byte, error) {
+	return json.MarshalIndent(r, "", "\t")
+}
+
+// Save persists the report to the status file of the sequence number in
+// statusFolder. The report is written to a temporary file in the same folder,
+// flushed and moved to the final destination, so the guest agent never reads a
+// partial file.
+func (r Report) Save(statusFolder string, seqNum int) error {
+	b, err := r.marshal()
+	if err != nil {
+		return errors.Wrap(err, "status: failed to marshal into json")
+	}
+
+	fn := fmt.Sprintf("%d.status", seqNum)
+	path := filepath.Join(statusFolder, fn)
+	tmp, err := ioutil.TempFile(statusFolder, fn)
+	if err != nil {
+		return errors.Wrap(err, "status: failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "status: failed to write path=%s", tmp.Name())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "status: failed to flush path=%s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "status: failed to close path=%s", tmp.Name())
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrapf(err, "status: failed to chmod path=%s", tmp.Name())
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "status: failed to move to path=%s", path)
+}
@@ -0,0 +1,87 @@
+package status
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func fixedNow() time.Time { return time.Date(2019, 12, 23, 11, 38, 0, 0, time.UTC) }
+
+// requireGolden compares the status file at path with testdata/<name>.golden.
+func requireGolden(t *testing.T, path, name string) {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		require.Nil(t, ioutil.WriteFile(golden, b, 0644))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	require.Nil(t, err)
+	require.Equal(t, string(expected), string(b))
+}
+
+func saveToTemp(t *testing.T, r Report) (dir, path string) {
+	dir, err := ioutil.TempDir("", "status")
+	require.Nil(t, err)
+	require.Nil(t, r.Save(dir, 3))
+	return dir, filepath.Join(dir, "3.status")
+}
+
+func TestSave_golden(t *testing.T) {
+	now = fixedNow
+	defer func() { now = time.Now }()
+
+	cases := []struct {
+		name   string
+		report Report
+	}{
+		{"transitioning", New(Transitioning, "enable", 0, "enable in progress")},
+		{"error", New(Error, "install", 51, "install failed: unsupported distribution")},
+		{"substatus", New(Warning, "enable", 0, "enable succeeded with warnings").WithSubstatus(
+			NewSubstatus("AgentVersion", Success, 0, "1.9.0"),
+			NewSubstatus("AgentHealth", Error, 201, "agent health check failed"),
+			NewSubstatus("LastComplianceRun", Success, 0, "2019-12-23T11:00:00Z"),
+		)},
+	}
+	for _, c := range cases {
+		dir, path := saveToTemp(t, c.report)
+		requireGolden(t, path, c.name)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSave_noTemporaryFilesLeft(t *testing.T) {
+	dir, _ := saveToTemp(t, New(Success, "enable", 0, "enable succeeded"))
+	defer os.RemoveAll(dir)
+
+	// overwriting keeps a single file
+	require.Nil(t, New(Error, "enable", 200, "enable failed").Save(dir, 3))
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, fis, 1)
+	require.Equal(t, "3.status", fis[0].Name())
+	require.Equal(t, os.FileMode(0644), fis[0].Mode().Perm())
+}
+
+func TestSave_nonExistingDir(t *testing.T) {
+	err := New(Success, "enable", 0, "").Save("/non/existing/dir", 1)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "status: failed to create temporary file")
+}
+
+func TestWithSubstatus_appends(t *testing.T) {
+	r := New(Success, "enable", 0, "").
+		WithSubstatus(NewSubstatus("a", Success, 0, "")).
+		WithSubstatus(NewSubstatus("b", Warning, 1, "msg"))
+	require.Len(t, r[0].Status.Substatus, 2)
+	require.Equal(t, "b", r[0].Status.Substatus[1].Name)
+	require.Equal(t, FormattedMessage{"en", "msg"}, r[0].Status.Substatus[1].FormattedMessage)
+}
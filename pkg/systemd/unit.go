@@ -0,0 +1,112 @@
+// Package systemd reads the state of systemd units through systemctl and
+// judges whether a service is healthy.
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CrashLoopRestarts is the number of automatic restarts from which a service
+// that is not active is considered crash-looping. NRestarts counts the
+// restarts over the lifetime of the unit, so it says nothing about a service
+// that is running now.
+const CrashLoopRestarts = 3
+
+var properties = []string{"LoadState", "ActiveState", "SubState", "NRestarts", "ExecMainStatus"}
+
+// UnitState is the state of a unit as reported by systemctl show.
+type UnitState struct {
+	Name           string `json:"name"`
+	LoadState      string `json:"loadState"`
+	ActiveState    string `json:"activeState"`
+	SubState       string `json:"subState"`
+	NRestarts      int    `json:"nRestarts"`      // -1 if systemd is too old to count restarts
+	ExecMainStatus int    `json:"execMainStatus"` // exit status of the last main process
+}
+
+// Show returns the state of the unit by running the given systemctl binary.
+func Show(systemctl, unit string) (UnitState, error) {
+	cmd := exec.Command(systemctl, "show", unit, "--property="+strings.Join(properties, ","))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return UnitState{}, errors.Wrapf(err, "systemd: systemctl show %s failed: %s", unit, strings.TrimSpace(stderr.String()))
+	}
+	return parseShow(unit, stdout.Bytes())
+}
+
+// parseShow parses the Key=Value lines of systemctl show.
+func parseShow(unit string, b []byte) (UnitState, error) {
+	u := UnitState{Name: unit, NRestarts: -1}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var err error
+		switch parts[0] {
+		case "LoadState":
+			u.LoadState = parts[1]
+		case "ActiveState":
+			u.ActiveState = parts[1]
+		case "SubState":
+			u.SubState = parts[1]
+		case "NRestarts":
+			u.NRestarts, err = strconv.Atoi(parts[1])
+		case "ExecMainStatus":
+			u.ExecMainStatus, err = strconv.Atoi(parts[1])
+		}
+		if err != nil {
+			return u, errors.Wrapf(err, "systemd: invalid %s", parts[0])
+		}
+	}
+	if u.ActiveState == "" {
+		return u, errors.Errorf("systemd: no state reported for %s", unit)
+	}
+	return u, nil
+}
+
+// Health is the verdict on a service.
+type Health string
+
+const (
+	Healthy      Health = "healthy"
+	Starting     Health = "starting"      // not running yet, but not failed either
+	NotFound     Health = "not-found"     // the unit is not installed
+	Failed       Health = "failed"        // stopped with an error
+	CrashLooping Health = "crash-looping" // waiting to restart, or not active after CrashLoopRestarts restarts
+)
+
+// Health judges the unit state.
+func (u UnitState) Health() Health {
+	switch {
+	case u.LoadState == "not-found":
+		return NotFound
+	case u.SubState == "auto-restart":
+		return CrashLooping
+	case u.ActiveState != "active" && u.NRestarts >= CrashLoopRestarts:
+		return CrashLooping
+	case u.ActiveState == "failed":
+		return Failed
+	case u.ActiveState == "active":
+		return Healthy
+	}
+	return Starting
+}
+
+func (u UnitState) String() string {
+	restarts := "unknown"
+	if u.NRestarts >= 0 {
+		restarts = strconv.Itoa(u.NRestarts)
+	}
+	return fmt.Sprintf("%s is %s (%s/%s, restarts: %s, last exit status: %d)",
+		u.Name, u.Health(), u.ActiveState, u.SubState, restarts, u.ExecMainStatus)
+}
@@ -0,0 +1,94 @@
+package systemd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Azure/Guest-Configuration-Extension/pkg/systemd"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSystemctl writes a systemctl stand-in that prints output and exits
+// with code, and records its arguments next to it.
+func fakeSystemctl(t *testing.T, output string, code int) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "systemctl")
+	require.Nil(t, err)
+	path = filepath.Join(dir, "systemctl")
+	script := "#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/args\"\ncat <<'EOF'\n" + output + "EOF\n" +
+		"echo 'failure' >&2\nexit " + strconv.Itoa(code) + "\n"
+	require.Nil(t, ioutil.WriteFile(path, []byte(script), 0755))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestShow(t *testing.T) {
+	systemctl, cleanup := fakeSystemctl(t, "LoadState=loaded\nActiveState=active\nSubState=running\nNRestarts=1\nExecMainStatus=0\n", 0)
+	defer cleanup()
+
+	u, err := systemd.Show(systemctl, "gcd.service")
+	require.Nil(t, err)
+	require.Equal(t, systemd.UnitState{
+		Name: "gcd.service", LoadState: "loaded", ActiveState: "active", SubState: "running", NRestarts: 1,
+	}, u)
+	require.Equal(t, systemd.Healthy, u.Health())
+	require.Equal(t, "gcd.service is healthy (active/running, restarts: 1, last exit status: 0)", u.String())
+
+	args, err := ioutil.ReadFile(filepath.Join(filepath.Dir(systemctl), "args"))
+	require.Nil(t, err)
+	require.Equal(t, "show gcd.service --property=LoadState,ActiveState,SubState,NRestarts,ExecMainStatus\n", string(args))
+}
+
+func TestShow_oldSystemdWithoutRestartCount(t *testing.T) {
+	systemctl, cleanup := fakeSystemctl(t, "LoadState=loaded\nActiveState=failed\nSubState=failed\nExecMainStatus=1\n", 0)
+	defer cleanup()
+
+	u, err := systemd.Show(systemctl, "gcd.service")
+	require.Nil(t, err)
+	require.Equal(t, -1, u.NRestarts)
+	require.Equal(t, systemd.Failed, u.Health())
+	require.Contains(t, u.String(), "restarts: unknown, last exit status: 1")
+}
+
+func TestShow_errors(t *testing.T) {
+	systemctl, cleanup := fakeSystemctl(t, "", 1)
+	defer cleanup()
+	_, err := systemd.Show(systemctl, "gcd.service")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "systemctl show gcd.service failed: failure")
+
+	systemctl, cleanup = fakeSystemctl(t, "LoadState=loaded\n", 0)
+	defer cleanup()
+	_, err = systemd.Show(systemctl, "gcd.service")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no state reported")
+
+	systemctl, cleanup = fakeSystemctl(t, "ActiveState=active\nNRestarts=many\n", 0)
+	defer cleanup()
+	_, err = systemd.Show(systemctl, "gcd.service")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid NRestarts")
+
+	_, err = systemd.Show("/non/existing/systemctl", "gcd.service")
+	require.NotNil(t, err)
+}
+
+func TestHealth(t *testing.T) {
+	cases := []struct {
+		u        systemd.UnitState
+		expected systemd.Health
+	}{
+		{systemd.UnitState{LoadState: "loaded", ActiveState: "active", SubState: "running"}, systemd.Healthy},
+		{systemd.UnitState{LoadState: "loaded", ActiveState: "activating", SubState: "auto-restart", NRestarts: 1}, systemd.CrashLooping},
+		{systemd.UnitState{LoadState: "loaded", ActiveState: "active", SubState: "running", NRestarts: 5}, systemd.Healthy},
+		{systemd.UnitState{LoadState: "loaded", ActiveState: "failed", SubState: "failed", NRestarts: 3}, systemd.CrashLooping},
+		{systemd.UnitState{LoadState: "loaded", ActiveState: "activating", SubState: "start", NRestarts: 4}, systemd.CrashLooping},
+		{systemd.UnitState{LoadState: "loaded", ActiveState: "failed", SubState: "failed", NRestarts: -1}, systemd.Failed},
+		{systemd.UnitState{LoadState: "loaded", ActiveState: "activating", SubState: "start"}, systemd.Starting},
+		{systemd.UnitState{LoadState: "not-found", ActiveState: "inactive", SubState: "dead"}, systemd.NotFound},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expected, c.u.Health(), "%+v", c.u)
+	}
+}